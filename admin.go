@@ -0,0 +1,288 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-http-utils/headers"
+)
+
+// AdminPathPrefix is the URI prefix of the administration endpoints that are
+// exposed when the dispatcher runs with Config.EnableAdmin.
+const AdminPathPrefix = "/mock/"
+
+// PingPath is the liveness endpoint. It is served regardless of
+// Config.EnableAdmin, as it reveals nothing about the mock state.
+const PingPath = AdminPathPrefix + "ping"
+
+// maxSeedBytes limits the size of a /mock/seed request body.
+const maxSeedBytes = 1 << 20
+
+// seedClient talks to the backends while seeding; the timeout keeps a hung
+// backend from blocking the admin request forever.
+var seedClient = &http.Client{Timeout: 10 * time.Second}
+
+// seedKind describes how resources of one kind of a seed document are created
+// on their backend.
+type seedKind struct {
+	// name is the key of the resource list in the seed document.
+	name string
+	// backend selects the base URL from Endpoints.
+	backend func(Endpoints) string
+	// path is the collection path the create request is POSTed to.
+	path string
+	// wrapper is the key the resource is nested under in the request body;
+	// empty for APIs taking flat documents (Glance, Designate).
+	wrapper string
+	// element is the key the created resource is nested under in the
+	// response body.
+	element string
+}
+
+// seedKinds lists the supported resource kinds in the order they are created.
+// The backends assign resource IDs themselves, so a seed document cannot
+// reference resources created by the same request (e.g. a subnet's
+// network_id); seed those in two consecutive requests instead.
+var seedKinds = []seedKind{
+	{name: "images", backend: func(e Endpoints) string { return e.Image }, path: "/v2/images", element: "image"},
+	{name: "flavors", backend: func(e Endpoints) string { return e.Compute }, path: "/flavors", wrapper: "flavor", element: "flavor"},
+	{name: "keypairs", backend: func(e Endpoints) string { return e.Compute }, path: "/os-keypairs", wrapper: "keypair", element: "keypair"},
+	{name: "networks", backend: func(e Endpoints) string { return e.Networking }, path: "/v2.0/networks", wrapper: "network", element: "network"},
+	{name: "subnets", backend: func(e Endpoints) string { return e.Networking }, path: "/subnets", wrapper: "subnet", element: "subnet"},
+	{name: "volumes", backend: func(e Endpoints) string { return e.BlockStorage }, path: "/volumes", wrapper: "volume", element: "volume"},
+	{name: "zones", backend: func(e Endpoints) string { return e.DNS }, path: "/zones", element: "zone"},
+}
+
+// seededResource summarizes a resource created via /mock/seed.
+type seededResource struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// newAdminHandler returns the handler serving the endpoints below
+// AdminPathPrefix. Responses are indented if cfg.PrettyJSON is set.
+//
+// POST /mock/seed creates the resources of a seed document such as
+// {"flavors": [{"name": "m1.small", "ram": 2048, "vcpus": 1}]} and answers with
+// a summary of the created resources. The document is validated before any
+// resource is created. Seeding stops at the first backend failure; the 502
+// response then lists the resources created so far under "created", as they
+// are not rolled back.
+//
+// POST /mock/reset calls the reset functions, restoring the initial state of
+// the mock backends and the dispatcher's counters, and answers with 204.
+//
+// GET /mock/recordings returns the exchanges kept in recordings, oldest
+// first, DELETE clears them. Without recordings (Config.Recordings is 0) the
+// endpoint answers with 404.
+//
+// GET /mock/clock returns the time of clock and its offset to the real time,
+// POST sets the offset from a document like {"offset": "2h"}; both answer
+// with the clock state.
+//
+// GET /mock/faults returns whether each of faults is on, POST turns the
+// faults of a document like {"backend_errors": true} on or off; both answer
+// with the fault state.
+func newAdminHandler(e Endpoints, cfg Config, recordings *recordingBuffer, clock *mockClock, faults *faultSwitches, resets []func()) http.Handler {
+	respond := func(w http.ResponseWriter, status int, v interface{}) {
+		writeJSONFormatted(w, status, v, cfg.PrettyJSON)
+	}
+	fail := func(w http.ResponseWriter, status int, message string) {
+		respond(w, status, map[string]interface{}{"error": errorBody(status, message)})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminPathPrefix+"seed", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var doc map[string][]json.RawMessage
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSeedBytes)).Decode(&doc); err != nil {
+			fail(w, http.StatusBadRequest, fmt.Sprintf("invalid seed document: %v", err))
+			return
+		}
+		for name := range doc {
+			if !isSeedKind(name) {
+				fail(w, http.StatusBadRequest, fmt.Sprintf("unknown resource kind %q in seed document", name))
+				return
+			}
+		}
+		created := map[string][]seededResource{}
+		for _, kind := range seedKinds {
+			for _, raw := range doc[kind.name] {
+				res, err := seedResource(kind, kind.backend(e), raw)
+				if err != nil {
+					respond(w, http.StatusBadGateway, map[string]interface{}{
+						"error":   errorBody(http.StatusBadGateway, fmt.Sprintf("seeding %s failed: %v", kind.name, err)),
+						"created": created,
+					})
+					return
+				}
+				created[kind.name] = append(created[kind.name], res)
+			}
+		}
+		respond(w, http.StatusCreated, map[string]interface{}{"created": created})
+	})
+	mux.HandleFunc(AdminPathPrefix+"reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		for _, reset := range resets {
+			reset()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc(AdminPathPrefix+"recordings", func(w http.ResponseWriter, r *http.Request) {
+		if recordings == nil {
+			fail(w, http.StatusNotFound, "recording is disabled, see -recordings")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			respond(w, http.StatusOK, map[string]interface{}{"recordings": recordings.list()})
+		case http.MethodDelete:
+			recordings.clear()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc(AdminPathPrefix+"clock", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var doc struct {
+				Offset string `json:"offset"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSeedBytes)).Decode(&doc); err != nil {
+				fail(w, http.StatusBadRequest, fmt.Sprintf("invalid clock document: %v", err))
+				return
+			}
+			offset, err := time.ParseDuration(doc.Offset)
+			if err != nil {
+				fail(w, http.StatusBadRequest, fmt.Sprintf("invalid clock offset: %v", err))
+				return
+			}
+			clock.setOffset(offset)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		respond(w, http.StatusOK, clock.state())
+	})
+	mux.HandleFunc(AdminPathPrefix+"faults", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var doc map[string]bool
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSeedBytes)).Decode(&doc); err != nil {
+				fail(w, http.StatusBadRequest, fmt.Sprintf("invalid faults document: %v", err))
+				return
+			}
+			if err := faults.set(doc); err != nil {
+				fail(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		respond(w, http.StatusOK, faults.state())
+	})
+	return mux
+}
+
+func isSeedKind(name string) bool {
+	for _, kind := range seedKinds {
+		if kind.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// seedResource creates a single resource by POSTing it to the backend's
+// collection path, exactly like a regular API client would.
+func seedResource(kind seedKind, base string, raw json.RawMessage) (seededResource, error) {
+	body := []byte(raw)
+	if kind.wrapper != "" {
+		body, _ = json.Marshal(map[string]json.RawMessage{kind.wrapper: raw})
+	}
+	resp, err := seedClient.Post(strings.TrimSuffix(base, "/")+kind.path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return seededResource{}, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return seededResource{}, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return seededResource{}, fmt.Errorf("backend returned %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	var created map[string]seededResource
+	if err := json.Unmarshal(b, &created); err != nil {
+		return seededResource{}, err
+	}
+	res, ok := created[kind.element]
+	if !ok {
+		return seededResource{}, fmt.Errorf("backend response lacks %q: %s", kind.element, strings.TrimSpace(string(b)))
+	}
+	return res, nil
+}
+
+// ping answers liveness checks without touching any backend.
+func ping(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set(headers.ContentType, "text/plain")
+	_, _ = w.Write([]byte("pong"))
+}
+
+// writeJSONError writes an OpenStack style error envelope.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{"error": errorBody(status, message)})
+}
+
+// errorBody returns the content of an OpenStack style error envelope.
+func errorBody(status int, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"code":    status,
+		"title":   http.StatusText(status),
+		"message": message,
+	}
+}
+
+// writeJSON writes v as a compact JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	writeJSONFormatted(w, status, v, false)
+}
+
+// writeJSONFormatted writes v as a JSON response with the given status,
+// indented for humans if pretty is set.
+func writeJSONFormatted(w http.ResponseWriter, status int, v interface{}, pretty bool) {
+	w.Header().Set(headers.ContentType, "application/json")
+	b := marshalJSON(v, pretty)
+	w.WriteHeader(status)
+	_, _ = w.Write(b)
+}
+
+// marshalJSON returns the JSON encoding of v, indented by two spaces if
+// pretty is set.
+func marshalJSON(v interface{}, pretty bool) []byte {
+	if pretty {
+		b, _ := json.MarshalIndent(v, "", "  ")
+		return b
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
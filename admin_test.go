@@ -0,0 +1,344 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdminEndpointsDisabledByDefault(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/mock/seed", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	//nolint:errcheck // Response body Close() call
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 without -enable-admin, got %d", resp.StatusCode)
+	}
+}
+
+func TestPing(t *testing.T) {
+	// No backends at all: ping must not depend on them.
+	ts := httptest.NewServer(NewDispatcher(Endpoints{}))
+	defer ts.Close()
+
+	resp, body := doRequest(t, http.MethodGet, ts.URL+PingPath, nil)
+	if resp.StatusCode != http.StatusOK || body != "pong" {
+		t.Errorf("expected 200 pong without -enable-admin, got %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+PingPath, nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for POST, got %d", resp.StatusCode)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t))
+	defer ts.Close()
+
+	for _, p := range []string{"/servers", "/flavors/1", "/v2/images", "/nope"} {
+		doRequest(t, http.MethodGet, ts.URL+p, nil)
+	}
+	resp, body := doRequest(t, http.MethodGet, ts.URL+StatusPath, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 without -enable-admin, got %d: %s", resp.StatusCode, body)
+	}
+	var status struct {
+		StartedAt     string           `json:"started_at"`
+		UptimeSeconds *float64         `json:"uptime_seconds"`
+		RequestsTotal int64            `json:"requests_total"`
+		Requests      map[string]int64 `json:"requests"`
+	}
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatalf("invalid status document %q: %v", body, err)
+	}
+	if status.StartedAt == "" || status.UptimeSeconds == nil || *status.UptimeSeconds < 0 {
+		t.Errorf("expected start time and uptime, got %s", body)
+	}
+	// The four requests above plus the status request itself.
+	if status.RequestsTotal != 5 {
+		t.Errorf("expected 5 requests in total, got %d", status.RequestsTotal)
+	}
+	want := map[string]int64{"compute": 2, "image": 1, "networking": 0, "loadbalancer": 0, "blockstorage": 0, "dns": 0, "objectstore": 0, "keymanager": 0, "orchestration": 0}
+	for s, n := range want {
+		if got, ok := status.Requests[s]; !ok || got != n {
+			t.Errorf("%s: expected %d requests, got %d (present: %v)", s, n, got, ok)
+		}
+	}
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+StatusPath, nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for POST, got %d", resp.StatusCode)
+	}
+}
+
+// seedBackend is a fake backend for seeding tests that records the request
+// bodies it receives and answers with the given status and body.
+type seedBackend struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies []string
+}
+
+func newSeedBackend(t *testing.T, wantPath string, status int, answer string) *seedBackend {
+	t.Helper()
+	sb := &seedBackend{}
+	sb.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != wantPath {
+			t.Errorf("unexpected backend request %s %s", r.Method, r.URL.Path)
+		}
+		b, _ := io.ReadAll(r.Body)
+		sb.mu.Lock()
+		sb.bodies = append(sb.bodies, string(b))
+		sb.mu.Unlock()
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(answer))
+	}))
+	t.Cleanup(sb.Close)
+	return sb
+}
+
+func (sb *seedBackend) received() []string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return append([]string(nil), sb.bodies...)
+}
+
+// seedSummary is the decoded response of /mock/seed.
+type seedSummary struct {
+	Error   map[string]interface{}      `json:"error"`
+	Created map[string][]seededResource `json:"created"`
+}
+
+func postSeed(t *testing.T, e Endpoints, doc string) (int, seedSummary) {
+	t.Helper()
+	ts := httptest.NewServer(NewDispatcher(e, func(c *Config) { c.EnableAdmin = true }))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/mock/seed", "application/json", strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var summary seedSummary
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		t.Fatalf("decoding summary failed: %v", err)
+	}
+	return resp.StatusCode, summary
+}
+
+func TestSeedEndpoint(t *testing.T) {
+	compute := newSeedBackend(t, "/flavors", http.StatusCreated, `{"flavor": {"id": "flavor-1", "name": "m1.small"}}`)
+
+	status, summary := postSeed(t, Endpoints{Compute: compute.URL},
+		`{"flavors": [{"name": "m1.small", "ram": 2048, "vcpus": 1}]}`)
+	if status != http.StatusCreated {
+		t.Fatalf("expected 201 Created, got %d", status)
+	}
+	if got := summary.Created["flavors"]; len(got) != 1 || got[0].ID != "flavor-1" || got[0].Name != "m1.small" {
+		t.Errorf("unexpected seed summary: %+v", summary.Created)
+	}
+	if bodies := compute.received(); len(bodies) != 1 || !strings.HasPrefix(bodies[0], `{"flavor":{"name"`) {
+		t.Errorf("expected flavor wrapped in a Nova create request, got %q", bodies)
+	}
+}
+
+func TestSeedEndpointFlatKind(t *testing.T) {
+	image := newSeedBackend(t, "/v2/images", http.StatusAccepted, `{"image": {"id": "image-1", "name": "ubuntu"}}`)
+
+	status, summary := postSeed(t, Endpoints{Image: image.URL}, `{"images": [{"name": "ubuntu"}]}`)
+	if status != http.StatusCreated {
+		t.Fatalf("expected 201 Created, got %d", status)
+	}
+	if got := summary.Created["images"]; len(got) != 1 || got[0].ID != "image-1" {
+		t.Errorf("unexpected seed summary: %+v", summary.Created)
+	}
+	if bodies := image.received(); len(bodies) != 1 || bodies[0] != `{"name": "ubuntu"}` {
+		t.Errorf("expected image to be sent unwrapped, got %q", bodies)
+	}
+}
+
+func TestSeedEndpointBackendFailure(t *testing.T) {
+	image := newSeedBackend(t, "/v2/images", http.StatusAccepted, `{"image": {"id": "image-1", "name": "ubuntu"}}`)
+	compute := newSeedBackend(t, "/flavors", http.StatusConflict, `{"conflictingRequest": {"message": "exists"}}`)
+
+	status, summary := postSeed(t, Endpoints{Image: image.URL, Compute: compute.URL},
+		`{"images": [{"name": "ubuntu"}], "flavors": [{"name": "m1.small"}]}`)
+	if status != http.StatusBadGateway {
+		t.Fatalf("expected 502 Bad Gateway, got %d", status)
+	}
+	if summary.Error == nil {
+		t.Errorf("expected an error envelope")
+	}
+	if got := summary.Created["images"]; len(got) != 1 || got[0].ID != "image-1" {
+		t.Errorf("expected the resources created before the failure in the summary, got %+v", summary.Created)
+	}
+}
+
+func TestSeedEndpointMissingElement(t *testing.T) {
+	compute := newSeedBackend(t, "/flavors", http.StatusCreated, `{}`)
+
+	status, _ := postSeed(t, Endpoints{Compute: compute.URL}, `{"flavors": [{"name": "m1.small"}]}`)
+	if status != http.StatusBadGateway {
+		t.Fatalf("expected 502 for a response without the created flavor, got %d", status)
+	}
+}
+
+func TestSeedEndpointMethodNotAllowed(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.EnableAdmin = true }))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/mock/seed")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	//nolint:errcheck // Response body Close() call
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for GET, got %d", resp.StatusCode)
+	}
+}
+
+func TestSeedEndpointRejectsUnknownKind(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.EnableAdmin = true }))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/mock/seed", "application/json", strings.NewReader(`{"gadgets": [{}]}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	//nolint:errcheck // Response body Close() call
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown resource kind, got %d", resp.StatusCode)
+	}
+}
+
+func TestClockEndpoint(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) {
+		c.EnableAdmin = true
+		c.EnforceAuth = true
+	}))
+	defer ts.Close()
+
+	clock := func(method, body string) clockState {
+		t.Helper()
+		resp, b := doRequest(t, method, ts.URL+"/mock/clock", strings.NewReader(body))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s /mock/clock: expected 200, got %d: %s", method, resp.StatusCode, b)
+		}
+		var state clockState
+		if err := json.Unmarshal([]byte(b), &state); err != nil {
+			t.Fatalf("decoding clock state failed: %v", err)
+		}
+		return state
+	}
+	if state := clock(http.MethodGet, ""); state.Offset != "0s" || state.OffsetSeconds != 0 {
+		t.Errorf("expected no offset initially, got %+v", state)
+	}
+
+	tok := newToken(t, ts.URL)
+	if state := clock(http.MethodPost, `{"offset": "2h"}`); state.Offset != "2h0m0s" || state.OffsetSeconds != 7200 {
+		t.Errorf("expected the offset to be set, got %+v", state)
+	}
+	state := clock(http.MethodGet, "")
+	if now, err := time.Parse(time.RFC3339Nano, state.Now); err != nil || time.Until(now) < 119*time.Minute {
+		t.Errorf("expected the clock to be 2h ahead, got %+v", state)
+	}
+	if status := getWithHeaders(t, ts.URL+"/servers", map[string]string{"X-Auth-Token": tok}); status != http.StatusUnauthorized {
+		t.Errorf("expected the token to have expired on the mock clock, got %d", status)
+	}
+
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/mock/clock", strings.NewReader(`{"offset": "soon"}`)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid offset, got %d", resp.StatusCode)
+	}
+	doRequest(t, http.MethodPost, ts.URL+"/mock/reset", nil)
+	if state := clock(http.MethodGet, ""); state.Offset != "0s" {
+		t.Errorf("expected reset to restore the real time, got %+v", state)
+	}
+}
+
+func TestWebUI(t *testing.T) {
+	for _, admin := range []bool{false, true} {
+		ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) {
+			c.WebUI = true
+			c.EnableAdmin = admin
+		}))
+		resp, body := doRequest(t, http.MethodGet, ts.URL+WebUIPath, nil)
+		ts.Close()
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+			t.Fatalf("admin %v: expected an HTML page, got %d %s", admin, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		for _, want := range []string{"<code>" + ts.URL + "/v3</code>", "nova", `id="stats"`} {
+			if !strings.Contains(body, want) {
+				t.Errorf("admin %v: expected the page to contain %q", admin, want)
+			}
+		}
+		for _, control := range []string{`id="reset"`, `data-fault="backend_errors"`, `data-fault="token_unavailable"`} {
+			if got := strings.Contains(body, control); got != admin {
+				t.Errorf("admin %v: expected control %s %v, got %v", admin, control, admin, got)
+			}
+		}
+	}
+
+	ts := httptest.NewServer(buildDispatcherForTest(t))
+	defer ts.Close()
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+WebUIPath, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 without -web-ui, got %d", resp.StatusCode)
+	}
+}
+
+func TestFaultsEndpoint(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.EnableAdmin = true }))
+	defer ts.Close()
+
+	setFaults := func(doc string) (int, map[string]bool) {
+		t.Helper()
+		resp, body := doRequest(t, http.MethodPost, ts.URL+"/mock/faults", strings.NewReader(doc))
+		var state map[string]bool
+		_ = json.Unmarshal([]byte(body), &state)
+		return resp.StatusCode, state
+	}
+	status := func(method, path string) int {
+		t.Helper()
+		resp, _ := doRequest(t, method, ts.URL+path, nil)
+		return resp.StatusCode
+	}
+
+	if status(http.MethodGet, "/servers") != http.StatusOK || status(http.MethodPost, "/v3/auth/tokens") != http.StatusCreated {
+		t.Fatalf("expected no faults initially")
+	}
+	if code, state := setFaults(`{"backend_errors": true}`); code != http.StatusOK || !state["backend_errors"] || state["token_unavailable"] {
+		t.Errorf("expected backend_errors on only, got %d %v", code, state)
+	}
+	if got := status(http.MethodGet, "/servers"); got != http.StatusInternalServerError {
+		t.Errorf("expected 500 with backend_errors, got %d", got)
+	}
+	if got := status(http.MethodGet, "/mock/ping"); got != http.StatusOK {
+		t.Errorf("expected the dispatcher's own endpoints to work, got %d", got)
+	}
+	setFaults(`{"backend_unavailable": true, "token_unavailable": true}`)
+	if got := status(http.MethodGet, "/servers"); got != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with backend_unavailable, got %d", got)
+	}
+	if got := status(http.MethodPost, "/v3/auth/tokens"); got != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with token_unavailable, got %d", got)
+	}
+
+	if code, _ := setFaults(`{"disk_full": true}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown fault, got %d", code)
+	}
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/mock/reset", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("reset failed: %d", resp.StatusCode)
+	}
+	if status(http.MethodGet, "/servers") != http.StatusOK || status(http.MethodPost, "/v3/auth/tokens") != http.StatusCreated {
+		t.Errorf("expected the reset to turn all faults off")
+	}
+}
@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenLifetime is the validity of issued tokens.
+const tokenLifetime = time.Hour
+
+// issuedToken is the scope and validity of a token issued by the dispatcher.
+type issuedToken struct {
+	ProjectID string
+	// System marks a system-scoped token, which may address any project.
+	System    bool
+	ExpiresAt time.Time
+	// Document is the v3 token document the token was issued with, returned
+	// when validating it; nil for tokens issued by the v2.0 API.
+	Document []byte
+}
+
+// tokenStore keeps the tokens issued by the dispatcher for validating
+// X-Auth-Token headers. It is safe for concurrent use. Tokens are issued and
+// expire according to clock.
+type tokenStore struct {
+	clock *mockClock
+
+	mu     sync.Mutex
+	tokens map[string]issuedToken
+}
+
+func newTokenStore() *tokenStore {
+	return &tokenStore{clock: &mockClock{}, tokens: map[string]issuedToken{}}
+}
+
+// add stores a newly issued token, dropping the expired ones.
+func (s *tokenStore) add(id string, tok issuedToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.now()
+	for other, t := range s.tokens {
+		if now.After(t.ExpiresAt) {
+			delete(s.tokens, other)
+		}
+	}
+	s.tokens[id] = tok
+}
+
+// lookup returns the token with the given ID unless it is unknown or expired.
+func (s *tokenStore) lookup(id string) (issuedToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tok, ok := s.tokens[id]
+	if !ok || s.clock.now().After(tok.ExpiresAt) {
+		return issuedToken{}, false
+	}
+	return tok, true
+}
+
+// defaultSubjectTokenHeader is the header Keystone returns issued tokens in.
+const defaultSubjectTokenHeader = "X-Subject-Token"
+
+// authTokenHeader returns the request header carrying the token: X-Auth-Token,
+// unless cfg.SubjectTokenHeader renames the token headers.
+func authTokenHeader(cfg Config) string {
+	if cfg.SubjectTokenHeader != "" && cfg.SubjectTokenHeader != defaultSubjectTokenHeader {
+		return cfg.SubjectTokenHeader
+	}
+	return "X-Auth-Token"
+}
+
+// requireToken answers requests without a valid token issued by the
+// dispatcher in header with 401. With projectScope, requests addressing
+// another project than the token's, via an X-Project-Id header or a Swift
+// account path (/v1/AUTH_<project>), are answered with 403, unless the token
+// is system-scoped. A non-empty redirect answers requests without any token
+// with a 302 to this URL instead, like a gateway redirecting to its login
+// page.
+func requireToken(next http.Handler, store *tokenStore, header string, projectScope bool, redirect string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if redirect != "" && r.Header.Get(header) == "" {
+			http.Redirect(w, r, redirect, http.StatusFound)
+			return
+		}
+		tok, ok := store.lookup(r.Header.Get(header))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Keystone uri="`+requestBase(r)+`/v3"`)
+			writeJSONError(w, http.StatusUnauthorized, "The request you have made requires authentication.")
+			return
+		}
+		if projectScope && !tok.System {
+			if project := requestedProject(r); project != "" && project != tok.ProjectID {
+				writeJSONError(w, http.StatusForbidden,
+					fmt.Sprintf("token is scoped to project %s, not %s", tok.ProjectID, project))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestedProject returns the project a request addresses, if any.
+func requestedProject(r *http.Request) string {
+	if project := r.Header.Get("X-Project-Id"); project != "" {
+		return project
+	}
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/v1/AUTH_"); ok {
+		project, _, _ := strings.Cut(rest, "/")
+		return project
+	}
+	return ""
+}
+
+// tokenOutage simulates a transient Keystone outage: after issuing after
+// tokens, it answers the next failures token requests with 503, then issues
+// tokens again.
+type tokenOutage struct {
+	after, failures int
+	format          RetryAfterFormat
+
+	mu             sync.Mutex
+	issued, failed int
+}
+
+func newTokenOutage(after, failures int, format RetryAfterFormat) *tokenOutage {
+	return &tokenOutage{after: after, failures: failures, format: format}
+}
+
+// fail reports whether the next token request fails, counting it.
+func (o *tokenOutage) fail() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.issued < o.after {
+		o.issued++
+		return false
+	}
+	if o.failed < o.failures {
+		o.failed++
+		return true
+	}
+	return false
+}
+
+// wrap answers the token requests of the outage with 503. Only POST requests,
+// which issue tokens, are counted.
+func (o *tokenOutage) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && o.fail() {
+			setRetryAfter(w.Header(), o.format, proxyRetryAfter)
+			writeJSONError(w, http.StatusServiceUnavailable, "identity service is unavailable")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reset starts over with issuing tokens.
+func (o *tokenOutage) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.issued, o.failed = 0, 0
+}
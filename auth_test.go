@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newToken issues a token from the dispatcher at baseURL and returns its ID.
+func newToken(t *testing.T, baseURL string) string {
+	t.Helper()
+	resp, err := http.Post(baseURL+"/v3/auth/tokens", "application/json", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	//nolint:errcheck // Response body Close() call
+	_ = resp.Body.Close()
+	return resp.Header.Get("X-Subject-Token")
+}
+
+// getWithHeaders GETs url with the given headers and returns the status.
+func getWithHeaders(t *testing.T, url string, header map[string]string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", url, err)
+	}
+	//nolint:errcheck // Response body Close() call
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestEnforceAuth(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.EnforceAuth = true }))
+	defer ts.Close()
+
+	if status := getWithHeaders(t, ts.URL+"/servers", nil); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", status)
+	}
+	if status := getWithHeaders(t, ts.URL+"/servers", map[string]string{"X-Auth-Token": "forged"}); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unknown token, got %d", status)
+	}
+	tok := newToken(t, ts.URL)
+	if status := getWithHeaders(t, ts.URL+"/servers", map[string]string{"X-Auth-Token": tok}); status != http.StatusOK {
+		t.Errorf("expected 200 with an issued token, got %d", status)
+	}
+	// Project scope is not checked without -enforce-project-scope.
+	if status := getWithHeaders(t, ts.URL+"/servers", map[string]string{"X-Auth-Token": tok, "X-Project-Id": "other"}); status != http.StatusOK {
+		t.Errorf("expected 200 for another project without scope enforcement, got %d", status)
+	}
+	if status := getWithHeaders(t, ts.URL+IdentityPath, nil); status != http.StatusOK {
+		t.Errorf("expected the identity endpoint not to require a token, got %d", status)
+	}
+}
+
+func TestEnforceProjectScope(t *testing.T) {
+	opt := func(c *Config) {
+		c.EnforceProjectScope = true
+		c.ProjectID = "p1"
+	}
+	ts := httptest.NewServer(buildDispatcherForTest(t, opt))
+	defer ts.Close()
+
+	tok := newToken(t, ts.URL)
+	for _, tc := range []struct {
+		project string
+		want    int
+	}{
+		{project: "", want: http.StatusOK},
+		{project: "p1", want: http.StatusOK},
+		{project: "p2", want: http.StatusForbidden},
+	} {
+		header := map[string]string{"X-Auth-Token": tok}
+		if tc.project != "" {
+			header["X-Project-Id"] = tc.project
+		}
+		if status := getWithHeaders(t, ts.URL+"/volumes", header); status != tc.want {
+			t.Errorf("project %q: expected %d, got %d", tc.project, tc.want, status)
+		}
+	}
+	if status := getWithHeaders(t, ts.URL+"/volumes", nil); status != http.StatusUnauthorized {
+		t.Errorf("expected project scope enforcement to imply auth, got %d", status)
+	}
+}
+
+func TestRedirectUnauth(t *testing.T) {
+	const login = "https://sso.example/login"
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) {
+		c.EnforceAuth = true
+		c.RedirectUnauth = login
+	}))
+	defer ts.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(ts.URL + "/servers")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	//nolint:errcheck // Response body Close() call
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != login {
+		t.Errorf("expected a 302 to %s, got %d to %q", login, resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if status := getWithHeaders(t, ts.URL+"/servers", map[string]string{"X-Auth-Token": "forged"}); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unknown token, got %d", status)
+	}
+	if status := getWithHeaders(t, ts.URL+"/servers", map[string]string{"X-Auth-Token": newToken(t, ts.URL)}); status != http.StatusOK {
+		t.Errorf("expected 200 with an issued token, got %d", status)
+	}
+}
+
+func TestTokenStoreExpiry(t *testing.T) {
+	store := newTokenStore()
+	store.add("old", issuedToken{ProjectID: "p", ExpiresAt: time.Now().Add(-time.Second)})
+	store.add("new", issuedToken{ProjectID: "p", ExpiresAt: time.Now().Add(time.Hour)})
+	if _, ok := store.lookup("old"); ok {
+		t.Errorf("expected an expired token to be invalid")
+	}
+	if tok, ok := store.lookup("new"); !ok || tok.ProjectID != "p" {
+		t.Errorf("expected a valid token for project p, got %+v", tok)
+	}
+}
+
+func TestSubjectTokenHeader(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) {
+		c.EnforceAuth = true
+		c.SubjectTokenHeader = "X-Gateway-Token"
+	}))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/v3/auth/tokens", "application/json", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	//nolint:errcheck // Response body Close() call
+	_ = resp.Body.Close()
+	tok := resp.Header.Get("X-Gateway-Token")
+	if tok == "" || resp.Header.Get("X-Subject-Token") != "" {
+		t.Fatalf("expected the token in X-Gateway-Token only, got %v", resp.Header)
+	}
+	if status := getWithHeaders(t, ts.URL+"/servers", map[string]string{"X-Gateway-Token": tok}); status != http.StatusOK {
+		t.Errorf("expected 200 with the token in X-Gateway-Token, got %d", status)
+	}
+	if status := getWithHeaders(t, ts.URL+"/servers", map[string]string{"X-Auth-Token": tok}); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 with the token in X-Auth-Token, got %d", status)
+	}
+}
+
+func TestTokenFailAfter(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) {
+		c.EnableAdmin = true
+		c.TokenFailAfter = 2
+		c.TokenFailCount = 2
+	}))
+	defer ts.Close()
+
+	statuses := func(n int) []int {
+		var got []int
+		for i := 0; i < n; i++ {
+			path := "/v3/auth/tokens"
+			if i%2 == 1 {
+				path = V2TokensPath
+			}
+			resp, _ := doRequest(t, http.MethodPost, ts.URL+path, nil)
+			if resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") == "" {
+				t.Errorf("expected Retry-After with 503")
+			}
+			// Both APIs count alike.
+			if resp.StatusCode == http.StatusOK {
+				resp.StatusCode = http.StatusCreated
+			}
+			got = append(got, resp.StatusCode)
+		}
+		return got
+	}
+
+	want := []int{201, 201, 503, 503, 201, 201}
+	if got := statuses(6); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/mock/reset", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("reset failed with %d", resp.StatusCode)
+	}
+	if got := statuses(4); !reflect.DeepEqual(got, want[:4]) {
+		t.Errorf("expected %v after reset, got %v", want[:4], got)
+	}
+}
@@ -0,0 +1,24 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+)
+
+// serveOnFixedPort starts an httptest server for handler that listens on the
+// given host and port instead of a random localhost port. Binding fails if the
+// port is already in use; there is no fallback to another port, as callers
+// rely on the backend being reachable at the requested address.
+func serveOnFixedPort(handler http.Handler, host string, port int) (*httptest.Server, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot bind port %d: %w", port, err)
+	}
+	srv := &httptest.Server{Listener: ln, Config: &http.Server{Handler: handler}}
+	srv.Start()
+	return srv, nil
+}
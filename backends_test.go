@@ -0,0 +1,44 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestServeOnFixedPort(t *testing.T) {
+	// Reserve a free port, release it and bind the backend to it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+
+	srv, err := serveOnFixedPort(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), "127.0.0.1", port)
+	if err != nil {
+		t.Fatalf("serveOnFixedPort failed: %v", err)
+	}
+	defer srv.Close()
+	if want := "http://127.0.0.1:" + strconv.Itoa(port); srv.URL != want {
+		t.Errorf("expected URL %s, got %s", want, srv.URL)
+	}
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	//nolint:errcheck // Response body Close() call
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected 204 from handler, got %d", resp.StatusCode)
+	}
+
+	// A second backend on the same port must fail instead of silently moving.
+	if _, err := serveOnFixedPort(http.NotFoundHandler(), "127.0.0.1", port); err == nil {
+		t.Errorf("expected an error binding an occupied port")
+	}
+}
@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MockCacheHeader reports whether a response of a cached route was served
+// from the cache (HIT) or by the backend (MISS).
+const MockCacheHeader = "X-Mock-Cache"
+
+// responseCache keeps successful GET responses of the routes matching its
+// rules for their TTL. Any other request except HEAD and OPTIONS to a cached
+// route invalidates all cached responses of the route.
+type responseCache struct {
+	rules   cacheRules
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+}
+
+// cachedResponse is a response kept by responseCache.
+type cachedResponse struct {
+	rule    int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newResponseCache(rules cacheRules) *responseCache {
+	return &responseCache{rules: rules, entries: map[string]cachedResponse{}}
+}
+
+func (c *responseCache) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule, ok := c.rules.lookup(r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		default:
+			c.invalidate(rule)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.URL.RequestURI()
+		if entry, ok := c.get(key); ok {
+			for k, v := range entry.header {
+				w.Header()[k] = append([]string(nil), v...)
+			}
+			w.Header().Set(MockCacheHeader, "HIT")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(entry.body)
+			return
+		}
+		w.Header().Set(MockCacheHeader, "MISS")
+		cw := &cachingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(cw, r)
+		if cw.status == http.StatusOK {
+			header := w.Header().Clone()
+			header.Del(MockCacheHeader)
+			c.put(key, cachedResponse{rule: rule, header: header, body: cw.body.Bytes(), expires: time.Now().Add(c.rules[rule].TTL)})
+		}
+	})
+}
+
+func (c *responseCache) get(key string) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return cachedResponse{}, false
+	}
+	return entry, true
+}
+
+func (c *responseCache) put(key string, entry cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = entry
+}
+
+// invalidate drops the cached responses of the given rule.
+func (c *responseCache) invalidate(rule int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if entry.rule == rule {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// cachingWriter passes a response on while keeping a copy of its status and
+// body.
+type cachingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *cachingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cachingWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *cachingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// cacheRule caches the GET responses for paths starting with Prefix for TTL.
+type cacheRule struct {
+	Prefix string
+	TTL    time.Duration
+}
+
+// cacheRules is a flag.Value holding a comma-separated list of prefix:ttl
+// rules, e.g. "/flavors:60s".
+type cacheRules []cacheRule
+
+func (l *cacheRules) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for _, rule := range *l {
+		items = append(items, rule.Prefix+":"+rule.TTL.String())
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *cacheRules) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	*l = nil
+	for _, item := range items {
+		prefix, ttl, ok := strings.Cut(item, ":")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("invalid cache rule %q (want /path:ttl)", item)
+		}
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid TTL in cache rule %q", item)
+		}
+		*l = append(*l, cacheRule{Prefix: prefix, TTL: d})
+	}
+	return nil
+}
+
+// lookup returns the index of the rule with the longest prefix of path.
+func (l cacheRules) lookup(path string) (int, bool) {
+	best := -1
+	for i, rule := range l {
+		if strings.HasPrefix(path, rule.Prefix) && (best < 0 || len(rule.Prefix) > len(l[best].Prefix)) {
+			best = i
+		}
+	}
+	return best, best >= 0
+}
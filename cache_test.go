@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	var calls atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"call": %d}`, n)
+	}))
+	defer backend.Close()
+	opt := func(c *Config) { _ = c.Cache.Set("/flavors:1h,/servers:50ms") }
+	ts := httptest.NewServer(NewDispatcher(Endpoints{Compute: backend.URL}, opt))
+	defer ts.Close()
+
+	expect := func(method, path, wantCache, wantBody string) {
+		t.Helper()
+		resp, body := doRequest(t, method, ts.URL+path, nil)
+		if got := resp.Header.Get(MockCacheHeader); got != wantCache {
+			t.Errorf("%s %s: expected %s %q, got %q", method, path, MockCacheHeader, wantCache, got)
+		}
+		if wantBody != "" && body != wantBody {
+			t.Errorf("%s %s: expected body %s, got %s", method, path, wantBody, body)
+		}
+		if wantCache == "HIT" && resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: expected the cached headers, got %v", method, path, resp.Header)
+		}
+	}
+
+	expect(http.MethodGet, "/flavors/detail", "MISS", `{"call": 1}`)
+	expect(http.MethodGet, "/flavors/detail", "HIT", `{"call": 1}`)
+	expect(http.MethodGet, "/flavors/detail?minRam=512", "MISS", `{"call": 2}`)
+
+	// A mutating request invalidates the route's entries.
+	expect(http.MethodPost, "/flavors", "", "")
+	expect(http.MethodGet, "/flavors/detail", "MISS", `{"call": 4}`)
+	expect(http.MethodGet, "/flavors/detail", "HIT", `{"call": 4}`)
+
+	// Entries expire after their TTL.
+	expect(http.MethodGet, "/servers", "MISS", `{"call": 5}`)
+	expect(http.MethodGet, "/servers", "HIT", `{"call": 5}`)
+	time.Sleep(100 * time.Millisecond)
+	expect(http.MethodGet, "/servers", "MISS", `{"call": 6}`)
+
+	// Other routes are not cached.
+	expect(http.MethodGet, "/os-keypairs", "", `{"call": 7}`)
+}
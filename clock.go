@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// mockClock is the dispatcher's notion of the current time, the real time
+// shifted by an offset that POST /mock/clock sets, so that token expiry can be
+// tested without waiting. It is safe for concurrent use; a nil clock is the
+// real time.
+type mockClock struct {
+	offset atomic.Int64
+}
+
+// now returns the current mock time.
+func (c *mockClock) now() time.Time {
+	return time.Now().Add(c.getOffset())
+}
+
+func (c *mockClock) getOffset() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return time.Duration(c.offset.Load())
+}
+
+func (c *mockClock) setOffset(d time.Duration) {
+	c.offset.Store(int64(d))
+}
+
+// reset restores the real time.
+func (c *mockClock) reset() {
+	c.setOffset(0)
+}
+
+// clockState is the document of GET /mock/clock.
+type clockState struct {
+	Now           string  `json:"now"`
+	Offset        string  `json:"offset"`
+	OffsetSeconds float64 `json:"offset_seconds"`
+}
+
+// state returns the current mock time and offset.
+func (c *mockClock) state() clockState {
+	offset := c.getOffset()
+	return clockState{
+		Now:           c.now().UTC().Format(time.RFC3339Nano),
+		Offset:        offset.String(),
+		OffsetSeconds: offset.Seconds(),
+	}
+}
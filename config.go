@@ -0,0 +1,1313 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the optional dispatcher behavior that can be tuned via
+// command-line flags. The values returned by DefaultConfig reproduce the
+// behavior of a plain NewDispatcher call.
+type Config struct {
+	// EnableAdmin exposes the /mock/ administration endpoints.
+	EnableAdmin bool
+	// Region is the region name advertised in the service catalog.
+	Region string
+	// RegionID is the region_id advertised in the service catalog; empty
+	// means the same as Region.
+	RegionID string
+	// Roles lists the role names included in issued tokens.
+	Roles []string
+	// StableEndpointIDs derives the catalog service and endpoint IDs from
+	// service type, interface and region instead of randomizing them per
+	// token.
+	StableEndpointIDs bool
+	// IdentityProvider, if set, marks issued tokens as federated by adding
+	// token.user.OS-FEDERATION with this identity provider and
+	// FederationProtocol.
+	IdentityProvider   string
+	FederationProtocol string
+	// MaxImageBytes limits the size of Glance image data uploads; 0 means
+	// unlimited.
+	MaxImageBytes int64
+	// ExactRoutes matches request paths exactly against the routing table
+	// instead of by longest prefix; see matchRoute.
+	ExactRoutes bool
+	// ForceClose closes every client connection after its response.
+	ForceClose bool
+	// DNSAsync reports zones created via POST /zones as PENDING until
+	// DNSAsyncDelay has passed, simulating asynchronous zone creation.
+	DNSAsync      bool
+	DNSAsyncDelay time.Duration
+	// AllowIPs restricts the clients served to these networks; empty
+	// allows all clients.
+	AllowIPs []*net.IPNet
+	// IPAvailability serves synthetic Neutron network IP availabilities
+	// instead of proxying them to the networking backend.
+	IPAvailability bool
+	// NovaServices serves a synthetic Nova service list instead of proxying
+	// /os-services to the compute backend.
+	NovaServices bool
+	// QuotaSets serves fixed Nova and Cinder quota sets instead of proxying
+	// the os-quota-sets paths to the compute and block storage backends.
+	QuotaSets bool
+	// AutoTopology serves a synthetic Neutron auto-allocated topology
+	// instead of proxying it to the networking backend.
+	AutoTopology bool
+	// Aggregates serves synthetic Nova host aggregates instead of proxying
+	// /os-aggregates to the compute backend.
+	Aggregates bool
+	// ImageSchema serves a minimal Glance image schema instead of proxying
+	// /v2/schemas/image to the image backend.
+	ImageSchema bool
+	// NeutronAgents serves synthetic Neutron agents instead of proxying
+	// /v2.0/agents to the networking backend.
+	NeutronAgents bool
+	// ProjectID is the ID of the token's project.
+	ProjectID string
+	// ProjectDomainID and ProjectDomainName describe token.project.domain.
+	ProjectDomainID   string
+	ProjectDomainName string
+	// RetryAfterFormat selects how Retry-After headers are formatted.
+	RetryAfterFormat RetryAfterFormat
+	// MaxHeaderBytes limits the size of request headers read by the
+	// dispatcher's server; larger requests get 431.
+	MaxHeaderBytes int
+	// ForceContentType replaces the Content-Type of proxied responses.
+	ForceContentType contentTypeOverrides
+	// Latency delays the requests proxied to the named backend services by
+	// delays drawn from the given distributions. LatencySeed seeds the random
+	// number generator; 0 picks a random seed, which is logged.
+	Latency     latencySpecs
+	LatencySeed int64
+	// Truncate cuts off the responses to matching requests after a number of
+	// bytes and aborts the connection.
+	Truncate truncateRules
+	// ServerHeader is the Server header of all responses; empty omits it.
+	ServerHeader string
+	// PrettyJSON indents the JSON responses of the token, identity and
+	// administration endpoints.
+	PrettyJSON bool
+	// ResetRate is the fraction of requests whose connection is reset
+	// without a response. ResetSeed seeds the random number generator
+	// choosing them; 0 picks a random seed, which is logged.
+	ResetRate probability
+	ResetSeed int64
+	// MaxIdleConnsPerHost and MaxConnsPerHost tune the connection pools of
+	// the backend proxies, per service; see newBackendTransport.
+	MaxIdleConnsPerHost serviceLimits
+	MaxConnsPerHost     serviceLimits
+	// TimingDump is the file the per-route latency statistics are written
+	// to on shutdown; empty disables them.
+	TimingDump string
+	// NormalizeSlash adds or strips the trailing slash of request paths
+	// before forwarding them to the backends.
+	NormalizeSlash SlashMode
+	// Recordings is the number of recent exchanges kept in memory for
+	// GET /mock/recordings; 0 disables recording.
+	Recordings int
+	// FailOnNth answers the Nth request matching a rule with 500.
+	FailOnNth failRules
+	// MaxConcurrent sheds requests with 503 while this many are in flight;
+	// 0 means unlimited.
+	MaxConcurrent int
+	// EnforceAuth requires a valid X-Auth-Token issued by the dispatcher
+	// for the proxied services.
+	EnforceAuth bool
+	// EnforceProjectScope additionally rejects requests for another project
+	// than the token's; it implies EnforceAuth.
+	EnforceProjectScope bool
+	// NotFoundBody is the file served with NotFoundContentType for
+	// unmatched routes; empty keeps the built-in 404 body.
+	NotFoundBody        string
+	NotFoundContentType string
+	// AuditIDs is the number of random IDs in token.audit_ids, 1 for a
+	// token obtained with credentials, 2 for a rescoped one.
+	AuditIDs int
+	// Cache keeps the GET responses of matching routes for a TTL.
+	Cache cacheRules
+	// WarnDeprecated adds a Warning header to responses of the Keystone
+	// v2.0 API.
+	WarnDeprecated bool
+	// Respond serves GET requests for paths from files instead of proxying
+	// them.
+	Respond respondRules
+	// CatalogInterfaces lists the interfaces of the endpoints advertised per
+	// catalog service, in this order.
+	CatalogInterfaces interfaceList
+	// SynthesizeHead forwards HEAD requests to the backends as GET, for
+	// backends that do not implement HEAD. The response body is discarded.
+	SynthesizeHead bool
+	// ForceChunked sends all responses with chunked transfer encoding.
+	ForceChunked bool
+	// RegionURLs sets the base URL advertised for a region. Regions other
+	// than Region are added to the catalog after it.
+	RegionURLs regionURLs
+	// TokenSkew shifts the issued_at and expires_at timestamps of issued
+	// tokens, simulating a Keystone with a drifting clock.
+	TokenSkew time.Duration
+	// StrictHeaders rejects proxied requests lacking an X-Auth-Token or
+	// sending a non-JSON body with 400.
+	StrictHeaders bool
+	// RejectUnknownMethods answers requests with methods the API does not
+	// define for the addressed collection or item with 405 instead of
+	// proxying them.
+	RejectUnknownMethods bool
+	// Maintenance lists the windows in which a backend service is answered
+	// with 503.
+	Maintenance maintenanceWindows
+	// MaintenanceHideCatalog leaves services in maintenance out of the
+	// catalog of tokens issued during the window.
+	MaintenanceHideCatalog bool
+	// SyntheticLists serves GET requests for paths with generated lists
+	// instead of proxying them.
+	SyntheticLists syntheticListRules
+	// SubjectTokenHeader is the response header carrying issued tokens. A
+	// name other than the default also replaces X-Auth-Token in requests,
+	// as a gateway renaming the header would; see authTokenHeader.
+	SubjectTokenHeader string
+	// TLSCert and TLSKey are the files of the certificate and key the
+	// dispatcher serves HTTPS with; HTTP if empty.
+	TLSCert string
+	TLSKey  string
+	// TLSMinVersion is the minimum TLS version the dispatcher accepts; zero
+	// for Go's default.
+	TLSMinVersion tlsVersion
+	// TLSCiphers restricts the TLS 1.0-1.2 cipher suites the dispatcher
+	// accepts; empty for Go's default.
+	TLSCiphers tlsCiphers
+	// BodyOn204 sends a small JSON body with 204 responses, violating
+	// HTTP, to test clients that mishandle such responses.
+	BodyOn204 bool
+	// HeaderCase selects the casing of the header names of proxied
+	// responses.
+	HeaderCase HeaderCase
+	// BodyRate limits the bytes per second of proxied response bodies; zero
+	// means unlimited.
+	BodyRate int64
+	// HealthzCache is the time /healthz reuses the backend probe results.
+	HealthzCache time.Duration
+	// HostRouting maps request host names to the backend service whose
+	// proxy serves all their requests, ahead of the path routes.
+	HostRouting hostRoutes
+	// BadCatalogEndpoints advertises the backend services in the catalog at
+	// a port nothing listens on, see unreachableBase.
+	BadCatalogEndpoints bool
+	// RequireRequestIDEcho issues request IDs and rejects follow-up requests
+	// that do not echo one, see requestIDEcho.
+	RequireRequestIDEcho bool
+	// ReadDelayAfterWrite hides resources created via POST from GET
+	// requests for this long, simulating eventual consistency; 0 disables.
+	ReadDelayAfterWrite time.Duration
+	// MaxURILength is the maximum length of request URIs; longer ones are
+	// answered with 414. 0 means unlimited.
+	MaxURILength int
+	// BackendInstances are additional instances of the backend services,
+	// which share their requests round-robin with the built-in backends.
+	BackendInstances backendInstances
+	// TokenFailAfter, if positive, answers the TokenFailCount token requests
+	// following the first TokenFailAfter ones with 503, simulating a
+	// transient Keystone outage.
+	TokenFailAfter int
+	TokenFailCount int
+	// HTMLErrors sends the dispatcher's 502, 503 and 504 errors as HTML
+	// pages instead of JSON envelopes.
+	HTMLErrors bool
+	// PreShutdownDelay is the time the dispatcher fails /healthz while still
+	// serving traffic after a termination signal, before it drains; see
+	// shutdownNotice.
+	PreShutdownDelay time.Duration
+	// TokenFieldStyle selects the casing of the field names of issued token
+	// documents.
+	TokenFieldStyle FieldStyle
+	// RegionDown lists the regions whose requests are answered with 503;
+	// see routeRegions.
+	RegionDown stringList
+	// ForceList serves GET requests for paths with list documents from
+	// files, like Respond, regardless of the backend state.
+	ForceList respondRules
+	// RequireSNI fails TLS handshakes whose server name indication differs
+	// from this name; empty accepts any.
+	RequireSNI string
+	// StatusOverrides answer matching requests with a fixed error status
+	// instead of proxying them.
+	StatusOverrides statusOverrides
+	// TokenInBody adds the issued token as token.id to the v3 token
+	// document, besides the header.
+	TokenInBody bool
+	// Prewarm is the number of idle connections opened to each backend at
+	// startup; see prewarmConnections.
+	Prewarm int
+	// RequireUserAgent answers requests without User-Agent header with 400.
+	RequireUserAgent bool
+	// AccessLog logs every request; see logRequests.
+	AccessLog bool
+	// InterfaceURLs sets the base URL advertised for the endpoints of an
+	// interface, instead of the dispatcher URL.
+	InterfaceURLs interfaceURLs
+	// FirstRequestDelay delays the first request on each connection; see
+	// delayFirstRequests.
+	FirstRequestDelay time.Duration
+	// RedirectUnauth answers requests without token with a 302 to this URL
+	// instead of 401 when auth is enforced; empty keeps 401.
+	RedirectUnauth string
+	// TokenDelay delays the token requests by delays drawn from this
+	// distribution, seeded with LatencySeed; the zero value adds none.
+	TokenDelay delayDistribution
+	// CorruptRate is the fraction of proxied JSON responses whose body is
+	// corrupted; see responseCorrupter. CorruptSeed seeds the random number
+	// generator choosing them; 0 picks a random seed, which is logged.
+	CorruptRate probability
+	CorruptSeed int64
+	// AcceptDelay delays accepting each connection of the dispatcher; see
+	// delayedListener.
+	AcceptDelay time.Duration
+	// TLSSelfSigned serves HTTPS with a generated self-signed certificate
+	// unless TLSCert is set; see selfSignedCertificate.
+	TLSSelfSigned bool
+	// Routes are added to the built-in routing table; see WithRoutes.
+	Routes []Route
+	// ServerTiming reports the backend duration and injected latency of
+	// proxied requests in a Server-Timing header.
+	ServerTiming bool
+	// LogRequests logs the route and backend of every request; see
+	// logRoutes.
+	LogRequests bool
+	// RejectEmptyPost answers POST and PUT requests with an empty body to
+	// the proxied services with 400; see rejectEmptyBodies.
+	RejectEmptyPost bool
+	// WebUI serves a page listing the endpoints at WebUIPath.
+	WebUI bool
+
+	// resetHooks are called by POST /mock/reset; see WithResetHook.
+	resetHooks []func()
+
+	// timings records the per-route latency statistics; see WithTimings.
+	timings *timingRecorder
+
+	// shutdown tells that the process is shutting down; see
+	// WithShutdownNotice.
+	shutdown *shutdownNotice
+}
+
+// Option customizes the dispatcher built by NewDispatcher.
+type Option func(*Config)
+
+// DefaultConfig returns the configuration used when no options are given.
+func DefaultConfig() Config {
+	return Config{
+		Region: "RegionOne",
+		Roles:  []string{"member"},
+
+		FederationProtocol:  "saml2",
+		DNSAsyncDelay:       5 * time.Second,
+		ProjectID:           "mock-project-id",
+		ProjectDomainID:     "default",
+		ProjectDomainName:   "Default",
+		RetryAfterFormat:    RetryAfterSeconds,
+		TokenFailCount:      1,
+		MaxHeaderBytes:      http.DefaultMaxHeaderBytes,
+		ServerHeader:        "openstack-mock",
+		NormalizeSlash:      SlashNone,
+		NotFoundContentType: "text/html; charset=utf-8",
+		AuditIDs:            1,
+		CatalogInterfaces:   interfaceList{"public"},
+		SubjectTokenHeader:  defaultSubjectTokenHeader,
+		HeaderCase:          HeaderCanonical,
+		HealthzCache:        5 * time.Second,
+		TokenFieldStyle:     FieldSnake,
+	}
+}
+
+// WithConfig replaces the whole dispatcher configuration, typically with the
+// values parsed from the command line. Options passed before WithConfig are
+// discarded, so it should come first in the option list.
+func WithConfig(c Config) Option {
+	return func(cfg *Config) {
+		*cfg = c
+	}
+}
+
+// WithTimings makes the dispatcher record per-route latency statistics in t.
+func WithTimings(t *timingRecorder) Option {
+	return func(cfg *Config) {
+		cfg.timings = t
+	}
+}
+
+// WithResetHook registers f to be called on POST /mock/reset, e.g. to reset
+// the state of the mock backends.
+func WithResetHook(f func()) Option {
+	return func(cfg *Config) {
+		cfg.resetHooks = append(cfg.resetHooks, f)
+	}
+}
+
+// WithRoutes adds routes to the built-in routing table of the dispatcher, for
+// APIs it does not route by default. NewDispatcher exits if a route names a
+// service without backend.
+func WithRoutes(routes ...Route) Option {
+	return func(cfg *Config) {
+		cfg.Routes = append(cfg.Routes, routes...)
+	}
+}
+
+// WithShutdownNotice makes the dispatcher fail /healthz once n has begun.
+func WithShutdownNotice(n *shutdownNotice) Option {
+	return func(cfg *Config) {
+		cfg.shutdown = n
+	}
+}
+
+// bindFlags registers the command-line flags backing the fields of c. The
+// current values of c are used as flag defaults.
+func bindFlags(fs *flag.FlagSet, c *Config) {
+	fs.BoolVar(&c.EnableAdmin, "enable-admin", c.EnableAdmin, "Expose the /mock/ administration endpoints (e.g. /mock/seed)")
+	fs.StringVar(&c.Region, "region", c.Region, "Region name advertised in the Keystone service catalog")
+	fs.StringVar(&c.RegionID, "region-id", c.RegionID, "Region ID advertised in the Keystone service catalog (default: the region name)")
+	fs.Var((*stringList)(&c.Roles), "roles", "Comma-separated role names included in issued tokens")
+	fs.BoolVar(&c.StableEndpointIDs, "stable-endpoint-ids", c.StableEndpointIDs, "Keep catalog service and endpoint IDs stable across tokens")
+	fs.StringVar(&c.IdentityProvider, "identity-provider", c.IdentityProvider, "Identity provider named in token.user.OS-FEDERATION of issued tokens (default: no federation block)")
+	fs.StringVar(&c.FederationProtocol, "federation-protocol", c.FederationProtocol, "Federation protocol named in token.user.OS-FEDERATION, see -identity-provider")
+	fs.Int64Var(&c.MaxImageBytes, "max-image-bytes", c.MaxImageBytes, "Reject image data uploads (PUT /v2/images/{id}/file) larger than this many bytes with 413 (0: unlimited)")
+	fs.BoolVar(&c.ExactRoutes, "exact-routes", c.ExactRoutes, "Match request paths exactly against the routing table instead of by longest prefix, to debug ambiguous routes")
+	fs.BoolVar(&c.ForceClose, "force-close", c.ForceClose, "Send 'Connection: close' on all responses to force clients to reconnect (per request: X-Mock-Close header)")
+	fs.BoolVar(&c.DNSAsync, "dns-async", c.DNSAsync, "Report newly created DNS zones as PENDING until -dns-async-delay has passed")
+	fs.DurationVar(&c.DNSAsyncDelay, "dns-async-delay", c.DNSAsyncDelay, "Time until zones created with -dns-async become ACTIVE")
+	fs.Var((*cidrList)(&c.AllowIPs), "allow-ips", "Comma-separated CIDRs or IPs of the clients to serve; others get 403 (default: all)")
+	fs.BoolVar(&c.IPAvailability, "ip-availability", c.IPAvailability, "Serve synthetic /v2.0/network-ip-availabilities derived from the networking backend's networks, subnets and ports")
+	fs.BoolVar(&c.NovaServices, "nova-services", c.NovaServices, "Serve a synthetic Nova service list at /os-services")
+	fs.BoolVar(&c.QuotaSets, "quota-sets", c.QuotaSets, "Serve fixed compute and volume quota sets at /os-quota-sets and /v3/<project-id>/os-quota-sets")
+	fs.BoolVar(&c.AutoTopology, "auto-topology", c.AutoTopology, "Serve a synthetic /v2.0/auto-allocated-topology referencing a network of the networking backend")
+	fs.BoolVar(&c.Aggregates, "aggregates", c.Aggregates, "Serve synthetic Nova host aggregates at /os-aggregates")
+	fs.BoolVar(&c.ImageSchema, "image-schema", c.ImageSchema, "Serve a minimal Glance image schema at /v2/schemas/image")
+	fs.BoolVar(&c.NeutronAgents, "neutron-agents", c.NeutronAgents, "Serve synthetic Neutron agents at /v2.0/agents")
+	fs.StringVar(&c.ProjectID, "project-id", c.ProjectID, "ID of the token's project, also used in the object-store account path /v1/AUTH_<project-id>")
+	fs.StringVar(&c.ProjectDomainID, "project-domain-id", c.ProjectDomainID, "ID of the domain of the token's project")
+	fs.StringVar(&c.ProjectDomainName, "project-domain-name", c.ProjectDomainName, "Name of the domain of the token's project")
+	fs.Var(&c.RetryAfterFormat, "retry-after-format", "Format of Retry-After headers: seconds or date (HTTP-date)")
+	fs.Var(&c.ForceContentType, "force-content-type", "Comma-separated Content-Types to set on proxied responses, each optionally limited to a path prefix as prefix:type, e.g. text/html or /servers:text/plain (default: pass through)")
+	fs.Var(&c.Latency, "latency", "Comma-separated service=distribution delays for proxied requests, e.g. compute=normal:200ms:50ms,dns=exp:300ms (distributions: <duration>, uniform:<min>:<max>, normal:<mean>:<stddev>, exp:<mean>)")
+	fs.Int64Var(&c.LatencySeed, "latency-seed", c.LatencySeed, "Seed for the random delays of -latency (0: random, logged at startup)")
+	fs.Var(&c.Truncate, "truncate", "Comma-separated prefix:bytes rules sending only the first bytes of the responses to matching request paths before aborting the connection, e.g. /servers:100")
+	fs.StringVar(&c.ServerHeader, "server-header", c.ServerHeader, "Server header of all responses, e.g. Apache or nginx/openstack (empty: no header)")
+	fs.BoolVar(&c.PrettyJSON, "pretty-json", c.PrettyJSON, "Indent the JSON responses of the token, identity and /mock/ endpoints for manual testing")
+	fs.Var(&c.ResetRate, "reset-rate", "Fraction of requests (0 to 1) whose connection is reset without a response")
+	fs.Int64Var(&c.ResetSeed, "reset-seed", c.ResetSeed, "Seed for choosing the requests reset by -reset-rate (0: random, logged at startup)")
+	fs.Var(&c.MaxIdleConnsPerHost, "max-idle-conns-per-host", "Idle connections kept per backend, as a number for all services and/or comma-separated service=number entries, e.g. 8,image=32 (default: 2)")
+	fs.Var(&c.MaxConnsPerHost, "max-conns-per-host", "Connections per backend, as a number for all services and/or comma-separated service=number entries, e.g. image=16 (default: 0, i.e. unlimited)")
+	fs.StringVar(&c.TimingDump, "timing-dump", c.TimingDump, "Write per-route latency percentiles as JSON to this file on shutdown")
+	fs.Var(&c.NormalizeSlash, "normalize-slash", "Trailing slash of paths forwarded to the backends: add, strip or none (pass through)")
+	fs.IntVar(&c.Recordings, "recordings", c.Recordings, "Keep the most recent this many requests and responses in memory for GET /mock/recordings (requires -enable-admin; 0: disabled)")
+	fs.Var(&c.FailOnNth, "fail-on-nth", "Comma-separated prefix:n rules answering exactly the nth request to matching paths with 500, e.g. /servers:3 (counters restart on POST /mock/reset)")
+	fs.IntVar(&c.MaxConcurrent, "max-concurrent", c.MaxConcurrent, "Answer requests with 503 and Retry-After while this many are in flight (0: unlimited)")
+	fs.BoolVar(&c.EnforceAuth, "enforce-auth", c.EnforceAuth, "Answer requests to the proxied services without a valid X-Auth-Token issued by the dispatcher with 401")
+	fs.BoolVar(&c.EnforceProjectScope, "enforce-project-scope", c.EnforceProjectScope, "Answer requests for another project than the token's (X-Project-Id header or /v1/AUTH_<project> path) with 403; implies -enforce-auth")
+	fs.StringVar(&c.NotFoundBody, "notfound-body", c.NotFoundBody, "File served as the body of 404 responses for unmatched routes (default: built-in text)")
+	fs.StringVar(&c.NotFoundContentType, "notfound-content-type", c.NotFoundContentType, "Content-Type of the -notfound-body responses")
+	fs.IntVar(&c.AuditIDs, "audit-ids", c.AuditIDs, "Number of random IDs in token.audit_ids: 1 as for a new token, 2 as for a rescoped one")
+	fs.Var(&c.Cache, "cache", "Comma-separated prefix:ttl rules caching successful GET responses for matching paths, e.g. /flavors:60s (mutating requests to a prefix invalidate its entries)")
+	fs.BoolVar(&c.WarnDeprecated, "warn-deprecated", c.WarnDeprecated, "Add a 'Warning: 299' deprecation header to responses of the Keystone v2.0 API (POST /v2.0/tokens)")
+	fs.Var(&c.Respond, "respond", "Comma-separated path:file rules serving GET requests for the path with the file's JSON instead of proxying them; {{base}} is replaced by the dispatcher URL")
+	fs.Var(&c.CatalogInterfaces, "catalog-interface-order", "Comma-separated interfaces (public, internal, admin) of the endpoints advertised per catalog service, in this order")
+	fs.BoolVar(&c.SynthesizeHead, "synthesize-head", c.SynthesizeHead, "Forward HEAD requests to the backends as GET and answer with the GET response's status and headers only")
+	fs.BoolVar(&c.ForceChunked, "force-chunked", c.ForceChunked, "Send all responses with 'Transfer-Encoding: chunked' instead of a Content-Length, flushing each body in several chunks")
+	fs.Var(&c.RegionURLs, "region-url", "Comma-separated region=url entries advertising the region's catalog endpoints at url, e.g. RegionTwo=https://rt.example; regions other than -region are added to the catalog (default: the dispatcher URL)")
+	fs.DurationVar(&c.TokenSkew, "token-skew", c.TokenSkew, "Shift the issued_at and expires_at timestamps of issued tokens by this duration, e.g. -5m, to simulate clock drift between Keystone and the client")
+	fs.BoolVar(&c.StrictHeaders, "strict-headers", c.StrictHeaders, "Answer requests to the proxied services without an X-Auth-Token, or with a POST/PUT body that is not 'Content-Type: application/json', with 400")
+	fs.BoolVar(&c.RejectUnknownMethods, "reject-unknown-methods", c.RejectUnknownMethods, "Answer requests with methods the API does not define for the addressed collection or item, e.g. DELETE /flavors, with 405 and an Allow header instead of proxying them")
+	fs.Var(&c.Maintenance, "maintenance", "Comma-separated service=start+duration windows, relative to the dispatcher start, in which requests to the service are answered with 503 and Retry-After, e.g. compute=30s+2m")
+	fs.BoolVar(&c.MaintenanceHideCatalog, "maintenance-hide-catalog", c.MaintenanceHideCatalog, "Leave services in a -maintenance window out of the catalog of tokens issued during the window")
+	fs.Var(&c.SyntheticLists, "synthetic-list", "Comma-separated path:n rules serving GET requests for the path with a generated list of n items, streamed incrementally, e.g. /servers:10000")
+	fs.StringVar(&c.SubjectTokenHeader, "subject-token-header", c.SubjectTokenHeader, "Header carrying issued tokens in token responses; another name also replaces X-Auth-Token in the requests checked by -enforce-auth and -strict-headers")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "Certificate file (PEM) to serve HTTPS with, requires -tls-key (default: HTTP)")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "Private key file (PEM) of -tls-cert")
+	fs.BoolVar(&c.TLSSelfSigned, "tls-self-signed", c.TLSSelfSigned, "Without -tls-cert, serve HTTPS with an in-memory self-signed certificate for the -listen address, printed as PEM at startup")
+	fs.Var(&c.TLSMinVersion, "tls-min-version", "Minimum TLS version accepted with -tls-cert: 1.0, 1.1, 1.2 or 1.3 (default: Go's default)")
+	fs.Var(&c.TLSCiphers, "tls-ciphers", "Comma-separated TLS 1.0-1.2 cipher suites accepted with -tls-cert, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (TLS 1.3 suites are not configurable; default: Go's default)")
+	fs.StringVar(&c.RequireSNI, "require-sni", c.RequireSNI, "Fail TLS handshakes of clients not sending this server name (SNI), e.g. mock.openstack.local; requires -tls-cert")
+	fs.BoolVar(&c.BodyOn204, "body-on-204", c.BodyOn204, "Send a small JSON body with 204 No Content responses, violating HTTP, to test clients mishandling them")
+	fs.Var(&c.HeaderCase, "header-case", "Casing of the header names of proxied responses: canonical (Content-Type), lower (content-type, as in HTTP/2) or preserve (as received)")
+	fs.Int64Var(&c.BodyRate, "body-rate", c.BodyRate, "Send proxied response bodies at this many bytes per second, simulating a slow link (0: unlimited)")
+	fs.DurationVar(&c.HealthzCache, "healthz-cache", c.HealthzCache, "Time /healthz reuses the backend probe results before probing again")
+	fs.Var(&c.HostRouting, "host-routing", "Comma-separated host=service entries routing all requests for the host name to the service's backend, e.g. nova.example=compute; other hosts are routed by path")
+	fs.BoolVar(&c.BadCatalogEndpoints, "bad-catalog-endpoints", c.BadCatalogEndpoints, "Advertise the backend services in the token catalog at an unreachable port, so that clients fail to connect despite a valid token")
+	fs.BoolVar(&c.RequireRequestIDEcho, "require-request-id-echo", c.RequireRequestIDEcho, "Return an X-Openstack-Request-Id with every response and answer follow-up requests of a session not echoing one of the session's IDs with 400")
+	fs.DurationVar(&c.ReadDelayAfterWrite, "read-delay-after-write", c.ReadDelayAfterWrite, "Answer GET requests for resources created via POST with 404 for this long after their creation, simulating eventual consistency (0 disables)")
+	fs.IntVar(&c.MaxURILength, "max-uri-length", c.MaxURILength, "Answer requests whose URI (path and query) is longer than this many bytes with 414, like a gateway would (0 means unlimited)")
+	fs.Var(&c.BackendInstances, "backend-instances", "Comma-separated service=[id@]url entries of additional backend instances, sharing the service's requests round-robin with the built-in backend <service>-0; the X-Mock-Backend-Instance response header names the instance")
+	fs.IntVar(&c.TokenFailAfter, "token-fail-after", c.TokenFailAfter, "Issue this many tokens, then answer the next -token-fail-count token requests with 503 before recovering (0 disables)")
+	fs.IntVar(&c.TokenFailCount, "token-fail-count", c.TokenFailCount, "Number of token requests failing after -token-fail-after tokens")
+	fs.BoolVar(&c.HTMLErrors, "html-errors", c.HTMLErrors, "Send the dispatcher's own 502, 503 and 504 errors as text/html pages instead of JSON, like some gateways do")
+	fs.DurationVar(&c.PreShutdownDelay, "preshutdown-delay", c.PreShutdownDelay, "On SIGINT or SIGTERM, fail /healthz with 503 for this long while still serving traffic before draining, like a load balancer deregistration")
+	fs.Var(&c.TokenFieldStyle, "token-field-style", "Casing of the field names of token documents: snake (expires_at, as Keystone), camel (expiresAt) or pascal (ExpiresAt)")
+	fs.Var(&c.RegionDown, "region-down", "Comma-separated regions whose requests, addressed by a /<region> path prefix or an X-Mock-Region header, are answered with 503")
+	fs.Var(&c.ForceList, "force-list", "Comma-separated path:file rules serving GET requests for the path with the file's JSON list document, e.g. /images:image-list.json, regardless of the backend state")
+	fs.Var(&c.StatusOverrides, "status-override", "prefix:status rule answering requests to matching paths with the status and an error envelope instead of proxying them, e.g. /flavors:500; repeatable, the longest prefix wins")
+	fs.BoolVar(&c.TokenInBody, "token-in-body", c.TokenInBody, "Also return issued v3 tokens as token.id in the response body, for clients not reading the X-Subject-Token header")
+	fs.IntVar(&c.Prewarm, "prewarm", c.Prewarm, "Open this many idle connections to each backend at startup, so that the first requests do not pay for the connection setup")
+	fs.BoolVar(&c.RequireUserAgent, "require-user-agent", c.RequireUserAgent, "Answer requests without User-Agent header with 400, to catch misconfigured clients")
+	fs.BoolVar(&c.AccessLog, "access-log", c.AccessLog, "Log every request with client address, method, URI, status, duration and User-Agent")
+	fs.Var(&c.InterfaceURLs, "interface-url", "Comma-separated [type/]interface=url entries advertising the catalog endpoints of the interface, optionally only of the service type, at url instead of the dispatcher URL, e.g. internal=http://10.0.0.1:19090")
+	fs.DurationVar(&c.FirstRequestDelay, "first-request-delay", c.FirstRequestDelay, "Delay the first request on each new client connection by this duration, simulating connection setup cost; later requests on a kept-alive connection are not delayed (0 disables)")
+	fs.StringVar(&c.RedirectUnauth, "redirect-unauth", c.RedirectUnauth, "With -enforce-auth, answer requests without token with a 302 redirect to this URL instead of 401, like a misbehaving gateway redirecting to a login page (empty keeps 401)")
+	fs.Var(&c.TokenDelay, "token-delay", "Delay token requests by a random delay drawn from this distribution, as for -latency, e.g. normal:200ms:50ms, to model Keystone latency under load (empty disables)")
+	fs.Var(&c.CorruptRate, "corrupt-rate", "Fraction of proxied JSON responses (0 to 1) whose body is corrupted into invalid JSON by dropping and flipping bytes")
+	fs.Int64Var(&c.CorruptSeed, "corrupt-seed", c.CorruptSeed, "Seed for choosing and corrupting the responses of -corrupt-rate (0: random, logged at startup)")
+	fs.DurationVar(&c.AcceptDelay, "accept-delay", c.AcceptDelay, "Delay accepting each new connection by this duration, to test client connect and TLS handshake timeouts (0 disables)")
+	fs.BoolVar(&c.ServerTiming, "server-timing", c.ServerTiming, "Add a Server-Timing header with the backend duration (backend) and the latency injected by -latency (latency) to proxied responses, for browser dev tools")
+	fs.BoolVar(&c.LogRequests, "log-requests", c.LogRequests, "Log every request with method, path, matched route, backend service, status and latency")
+	fs.BoolVar(&c.RejectEmptyPost, "reject-empty-post", c.RejectEmptyPost, "Answer POST and PUT requests with an empty body to the proxied services, except the object store, with 400 instead of proxying them")
+	fs.BoolVar(&c.WebUI, "web-ui", c.WebUI, "Serve a page at /mock/ui listing the service endpoints and the auth URL, with -enable-admin also buttons to reset the mock state, toggle the faults of /mock/faults and view the stats")
+	fs.IntVar(&c.MaxHeaderBytes, "max-header-bytes", c.MaxHeaderBytes, "Maximum size of request headers; larger requests get 431")
+}
+
+// stringList is a flag.Value holding a comma-separated list of strings.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// cidrList is a flag.Value holding a comma-separated list of CIDRs. Plain IP
+// addresses are accepted as single-host networks.
+type cidrList []*net.IPNet
+
+func (l *cidrList) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for _, n := range *l {
+		items = append(items, n.String())
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *cidrList) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	*l = nil
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return fmt.Errorf("invalid IP address %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			*l = append(*l, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, n)
+	}
+	return nil
+}
+
+// RetryAfterFormat selects how Retry-After headers are formatted. It
+// implements flag.Value.
+type RetryAfterFormat string
+
+// Supported Retry-After formats.
+const (
+	// RetryAfterSeconds formats the delay as a number of seconds.
+	RetryAfterSeconds RetryAfterFormat = "seconds"
+	// RetryAfterDate formats the point in time after the delay as HTTP-date.
+	RetryAfterDate RetryAfterFormat = "date"
+)
+
+func (f *RetryAfterFormat) String() string {
+	if f == nil {
+		return ""
+	}
+	return string(*f)
+}
+
+func (f *RetryAfterFormat) Set(v string) error {
+	switch RetryAfterFormat(v) {
+	case RetryAfterSeconds, RetryAfterDate:
+		*f = RetryAfterFormat(v)
+		return nil
+	}
+	return fmt.Errorf("unsupported Retry-After format %q (want %s or %s)", v, RetryAfterSeconds, RetryAfterDate)
+}
+
+// contentTypeOverride replaces the Content-Type of proxied responses whose
+// request path starts with Prefix; an empty Prefix matches all paths.
+type contentTypeOverride struct {
+	Prefix      string
+	ContentType string
+}
+
+// contentTypeOverrides is a flag.Value holding a comma-separated list of
+// content types, each optionally preceded by a path prefix and a colon, e.g.
+// "text/html,/servers:text/plain".
+type contentTypeOverrides []contentTypeOverride
+
+func (l *contentTypeOverrides) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for _, o := range *l {
+		if o.Prefix != "" {
+			items = append(items, o.Prefix+":"+o.ContentType)
+			continue
+		}
+		items = append(items, o.ContentType)
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *contentTypeOverrides) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	*l = nil
+	for _, item := range items {
+		var o contentTypeOverride
+		if strings.HasPrefix(item, "/") {
+			prefix, ct, ok := strings.Cut(item, ":")
+			if !ok {
+				return fmt.Errorf("missing content type for path prefix %q", item)
+			}
+			o.Prefix, item = prefix, ct
+		}
+		if o.ContentType = strings.TrimSpace(item); o.ContentType == "" {
+			return fmt.Errorf("empty content type in %q", v)
+		}
+		*l = append(*l, o)
+	}
+	return nil
+}
+
+// truncateRule cuts off the responses to requests whose path starts with
+// Prefix after Bytes bytes of the body.
+type truncateRule struct {
+	Prefix string
+	Bytes  int64
+}
+
+// truncateRules is a flag.Value holding a comma-separated list of prefix:bytes
+// rules, e.g. "/servers:100,/v2/images:0".
+type truncateRules []truncateRule
+
+func (l *truncateRules) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for _, rule := range *l {
+		items = append(items, rule.Prefix+":"+strconv.FormatInt(rule.Bytes, 10))
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *truncateRules) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	*l = nil
+	for _, item := range items {
+		prefix, n, ok := strings.Cut(item, ":")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("invalid truncation rule %q (want /path:bytes)", item)
+		}
+		bytes, err := strconv.ParseInt(n, 10, 64)
+		if err != nil || bytes < 0 {
+			return fmt.Errorf("invalid byte count in truncation rule %q", item)
+		}
+		*l = append(*l, truncateRule{Prefix: prefix, Bytes: bytes})
+	}
+	return nil
+}
+
+// lookup returns the byte count of the rule with the longest prefix of path.
+func (l truncateRules) lookup(path string) (int64, bool) {
+	best := -1
+	for i, rule := range l {
+		if strings.HasPrefix(path, rule.Prefix) && (best < 0 || len(rule.Prefix) > len(l[best].Prefix)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	return l[best].Bytes, true
+}
+
+// probability is a flag.Value holding a number between 0 and 1.
+type probability float64
+
+func (p *probability) String() string {
+	if p == nil {
+		return "0"
+	}
+	return strconv.FormatFloat(float64(*p), 'g', -1, 64)
+}
+
+func (p *probability) Set(v string) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	if f < 0 || f > 1 {
+		return fmt.Errorf("probability %s out of range [0, 1]", v)
+	}
+	*p = probability(f)
+	return nil
+}
+
+// serviceLimits is a flag.Value holding a comma-separated list of limits per
+// backend service. An entry is either a plain number applying to all services
+// or service=number, overriding it for one service, e.g. "8,image=32". The
+// plain number is stored under the empty service name.
+type serviceLimits map[string]int
+
+func (l *serviceLimits) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for svc, n := range *l {
+		if svc == "" {
+			items = append(items, strconv.Itoa(n))
+			continue
+		}
+		items = append(items, svc+"="+strconv.Itoa(n))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (l *serviceLimits) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	limits := serviceLimits{}
+	for _, item := range items {
+		svc, value, ok := strings.Cut(item, "=")
+		if !ok {
+			svc, value = "", item
+		} else if !isBackendService(svc) {
+			return fmt.Errorf("unknown service %q in %q (want one of %s)", svc, item, strings.Join(backendServices, ", "))
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid limit in %q", item)
+		}
+		limits[svc] = n
+	}
+	*l = limits
+	return nil
+}
+
+// lookup returns the limit for service, falling back to the limit for all
+// services.
+func (l serviceLimits) lookup(service string) (int, bool) {
+	if n, ok := l[service]; ok {
+		return n, true
+	}
+	n, ok := l[""]
+	return n, ok
+}
+
+// SlashMode selects how the trailing slash of forwarded request paths is
+// normalized. It implements flag.Value.
+type SlashMode string
+
+// Supported trailing slash normalizations.
+const (
+	// SlashNone forwards paths unchanged.
+	SlashNone SlashMode = "none"
+	// SlashAdd appends a slash to paths not ending in one.
+	SlashAdd SlashMode = "add"
+	// SlashStrip removes trailing slashes.
+	SlashStrip SlashMode = "strip"
+)
+
+func (m *SlashMode) String() string {
+	if m == nil {
+		return ""
+	}
+	return string(*m)
+}
+
+func (m *SlashMode) Set(v string) error {
+	switch SlashMode(v) {
+	case SlashNone, SlashAdd, SlashStrip:
+		*m = SlashMode(v)
+		return nil
+	}
+	return fmt.Errorf("unsupported slash normalization %q (want %s, %s or %s)", v, SlashAdd, SlashStrip, SlashNone)
+}
+
+// HeaderCase selects the casing of response header names. It implements
+// flag.Value.
+type HeaderCase string
+
+// Supported header name casings.
+const (
+	// HeaderCanonical sends the names in Go's canonical form.
+	HeaderCanonical HeaderCase = "canonical"
+	// HeaderLower sends lowercase names.
+	HeaderLower HeaderCase = "lower"
+	// HeaderPreserve sends the names as received from the backend.
+	HeaderPreserve HeaderCase = "preserve"
+)
+
+func (c *HeaderCase) String() string {
+	if c == nil {
+		return ""
+	}
+	return string(*c)
+}
+
+func (c *HeaderCase) Set(v string) error {
+	switch HeaderCase(v) {
+	case HeaderCanonical, HeaderLower, HeaderPreserve:
+		*c = HeaderCase(v)
+		return nil
+	}
+	return fmt.Errorf("unsupported header case %q (want %s, %s or %s)", v, HeaderCanonical, HeaderLower, HeaderPreserve)
+}
+
+// FieldStyle selects the casing of JSON field names. It implements
+// flag.Value.
+type FieldStyle string
+
+// Supported field name casings.
+const (
+	// FieldSnake keeps the snake_case names of the OpenStack APIs.
+	FieldSnake FieldStyle = "snake"
+	// FieldCamel sends camelCase names.
+	FieldCamel FieldStyle = "camel"
+	// FieldPascal sends PascalCase names.
+	FieldPascal FieldStyle = "pascal"
+)
+
+func (s *FieldStyle) String() string {
+	if s == nil {
+		return ""
+	}
+	return string(*s)
+}
+
+func (s *FieldStyle) Set(v string) error {
+	switch FieldStyle(v) {
+	case FieldSnake, FieldCamel, FieldPascal:
+		*s = FieldStyle(v)
+		return nil
+	}
+	return fmt.Errorf("unsupported field style %q (want %s, %s or %s)", v, FieldSnake, FieldCamel, FieldPascal)
+}
+
+// failRule fails the Nth request whose path starts with Prefix.
+type failRule struct {
+	Prefix string
+	N      int64
+}
+
+// failRules is a flag.Value holding a comma-separated list of prefix:n rules,
+// e.g. "/servers:3".
+type failRules []failRule
+
+func (l *failRules) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for _, rule := range *l {
+		items = append(items, rule.Prefix+":"+strconv.FormatInt(rule.N, 10))
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *failRules) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	*l = nil
+	for _, item := range items {
+		prefix, n, ok := strings.Cut(item, ":")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("invalid failure rule %q (want /path:n)", item)
+		}
+		nth, err := strconv.ParseInt(n, 10, 64)
+		if err != nil || nth < 1 {
+			return fmt.Errorf("invalid request number in failure rule %q", item)
+		}
+		*l = append(*l, failRule{Prefix: prefix, N: nth})
+	}
+	return nil
+}
+
+// lookup returns the index of the rule with the longest prefix of path.
+func (l failRules) lookup(path string) (int, bool) {
+	best := -1
+	for i, rule := range l {
+		if strings.HasPrefix(path, rule.Prefix) && (best < 0 || len(rule.Prefix) > len(l[best].Prefix)) {
+			best = i
+		}
+	}
+	return best, best >= 0
+}
+
+// statusOverride answers the requests whose path starts with Prefix with
+// Status.
+type statusOverride struct {
+	Prefix string
+	Status int
+}
+
+// statusOverrides is a flag.Value holding prefix:status rules, e.g.
+// "/flavors:500". Unlike most list flags, the flag can be repeated to add
+// rules; each value may hold a comma-separated list.
+type statusOverrides []statusOverride
+
+func (l *statusOverrides) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for _, rule := range *l {
+		items = append(items, rule.Prefix+":"+strconv.Itoa(rule.Status))
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *statusOverrides) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	for _, item := range items {
+		prefix, s, ok := strings.Cut(item, ":")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("invalid status override %q (want /path:status)", item)
+		}
+		status, err := strconv.Atoi(s)
+		if err != nil || status < 400 || status > 599 {
+			return fmt.Errorf("invalid status in status override %q (want 400-599)", item)
+		}
+		*l = append(*l, statusOverride{Prefix: prefix, Status: status})
+	}
+	return nil
+}
+
+// lookup returns the status of the rule with the longest prefix of path.
+func (l statusOverrides) lookup(path string) (int, bool) {
+	best := -1
+	for i, rule := range l {
+		if strings.HasPrefix(path, rule.Prefix) && (best < 0 || len(rule.Prefix) > len(l[best].Prefix)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	return l[best].Status, true
+}
+
+// respondRule serves GET requests for Path with the JSON document in File.
+type respondRule struct {
+	Path string
+	File string
+}
+
+// respondRules is a flag.Value holding a comma-separated list of path:file
+// rules, e.g. "/flavors:flavors.json".
+type respondRules []respondRule
+
+func (l *respondRules) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for _, rule := range *l {
+		items = append(items, rule.Path+":"+rule.File)
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *respondRules) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	*l = nil
+	for _, item := range items {
+		path, file, ok := strings.Cut(item, ":")
+		if !ok || !strings.HasPrefix(path, "/") || file == "" {
+			return fmt.Errorf("invalid response rule %q (want /path:file)", item)
+		}
+		*l = append(*l, respondRule{Path: path, File: file})
+	}
+	return nil
+}
+
+// syntheticListRule serves GET requests for Path with a list of Count
+// generated items.
+type syntheticListRule struct {
+	Path  string
+	Count int
+}
+
+// syntheticListRules is a flag.Value holding a comma-separated list of path:n
+// rules, e.g. "/servers:10000".
+type syntheticListRules []syntheticListRule
+
+func (l *syntheticListRules) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for _, rule := range *l {
+		items = append(items, rule.Path+":"+strconv.Itoa(rule.Count))
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *syntheticListRules) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	*l = nil
+	for _, item := range items {
+		path, n, ok := strings.Cut(item, ":")
+		if !ok || !strings.HasPrefix(path, "/") || strings.Trim(path, "/") == "" {
+			return fmt.Errorf("invalid synthetic list rule %q (want /path:n)", item)
+		}
+		count, err := strconv.Atoi(n)
+		if err != nil || count < 0 {
+			return fmt.Errorf("invalid item count in synthetic list rule %q", item)
+		}
+		*l = append(*l, syntheticListRule{Path: path, Count: count})
+	}
+	return nil
+}
+
+// interfaceList is a flag.Value holding a comma-separated list of distinct
+// Keystone endpoint interfaces.
+type interfaceList []string
+
+func (l *interfaceList) String() string {
+	return (*stringList)(l).String()
+}
+
+func (l *interfaceList) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	if len(items) == 0 {
+		return fmt.Errorf("no endpoint interface given")
+	}
+	seen := map[string]bool{}
+	for _, iface := range items {
+		switch iface {
+		case "public", "internal", "admin":
+		default:
+			return fmt.Errorf("unknown endpoint interface %q (want public, internal or admin)", iface)
+		}
+		if seen[iface] {
+			return fmt.Errorf("duplicate endpoint interface %q", iface)
+		}
+		seen[iface] = true
+	}
+	*l = interfaceList(items)
+	return nil
+}
+
+// regionURL advertises the catalog endpoints of Region at URL.
+type regionURL struct {
+	Region string
+	URL    string
+}
+
+// regionURLs is a flag.Value holding a comma-separated list of region=url
+// entries, e.g. "RegionTwo=https://rt.example".
+type regionURLs []regionURL
+
+func (l *regionURLs) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for _, r := range *l {
+		items = append(items, r.Region+"="+r.URL)
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *regionURLs) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	*l = nil
+	for _, item := range items {
+		region, base, ok := strings.Cut(item, "=")
+		if !ok || region == "" {
+			return fmt.Errorf("invalid region URL %q (want region=url)", item)
+		}
+		u, err := url.Parse(base)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid URL for region %s: %q", region, base)
+		}
+		if _, dup := l.lookup(region); dup {
+			return fmt.Errorf("duplicate region %s", region)
+		}
+		*l = append(*l, regionURL{Region: region, URL: strings.TrimSuffix(base, "/")})
+	}
+	return nil
+}
+
+// lookup returns the URL configured for region.
+func (l regionURLs) lookup(region string) (string, bool) {
+	for _, r := range l {
+		if r.Region == region {
+			return r.URL, true
+		}
+	}
+	return "", false
+}
+
+// interfaceURL advertises the catalog endpoints of Interface at URL, for the
+// services of Type or all services if Type is empty.
+type interfaceURL struct {
+	Type      string
+	Interface string
+	URL       string
+}
+
+// interfaceURLs is a flag.Value holding a comma-separated list of
+// [type/]interface=url entries, e.g. "internal=http://10.0.0.1:19090".
+type interfaceURLs []interfaceURL
+
+func (l *interfaceURLs) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for _, u := range *l {
+		key := u.Interface
+		if u.Type != "" {
+			key = u.Type + "/" + key
+		}
+		items = append(items, key+"="+u.URL)
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *interfaceURLs) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	*l = nil
+	for _, item := range items {
+		key, base, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid interface URL %q (want [type/]interface=url)", item)
+		}
+		typ, iface, scoped := strings.Cut(key, "/")
+		if !scoped {
+			typ, iface = "", key
+		}
+		var check interfaceList
+		if err := check.Set(iface); err != nil || len(check) != 1 || (scoped && typ == "") {
+			return fmt.Errorf("invalid interface in %q (want public, internal or admin)", item)
+		}
+		u, err := url.Parse(base)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid URL for interface %s: %q", key, base)
+		}
+		*l = append(*l, interfaceURL{Type: typ, Interface: iface, URL: strings.TrimSuffix(base, "/")})
+	}
+	return nil
+}
+
+// lookup returns the URL configured for the interface of the service type,
+// preferring an entry for the type over one for all services.
+func (l interfaceURLs) lookup(typ, iface string) (string, bool) {
+	base, found := "", false
+	for _, u := range l {
+		if u.Interface != iface {
+			continue
+		}
+		if u.Type == typ {
+			return u.URL, true
+		}
+		if u.Type == "" {
+			base, found = u.URL, true
+		}
+	}
+	return base, found
+}
+
+// tlsVersions maps the values of tlsVersion to the TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsVersion is a flag.Value holding a TLS version such as "1.2"; zero means
+// unset.
+type tlsVersion uint16
+
+func (v *tlsVersion) String() string {
+	for name, version := range tlsVersions {
+		if v != nil && uint16(*v) == version {
+			return name
+		}
+	}
+	return ""
+}
+
+func (v *tlsVersion) Set(s string) error {
+	version, ok := tlsVersions[s]
+	if !ok {
+		return fmt.Errorf("unsupported TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", s)
+	}
+	*v = tlsVersion(version)
+	return nil
+}
+
+// tlsCiphers is a flag.Value holding a comma-separated list of TLS 1.0-1.2
+// cipher suite names, as named by crypto/tls.
+type tlsCiphers []uint16
+
+func (l *tlsCiphers) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for _, id := range *l {
+		items = append(items, tls.CipherSuiteName(id))
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *tlsCiphers) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	*l = nil
+	for _, name := range items {
+		i := slices.IndexFunc(suites, func(s *tls.CipherSuite) bool { return s.Name == name })
+		if i < 0 {
+			return fmt.Errorf("unknown TLS cipher suite %q", name)
+		}
+		if !slices.ContainsFunc(suites[i].SupportedVersions, func(v uint16) bool { return v < tls.VersionTLS13 }) {
+			return fmt.Errorf("TLS 1.3 cipher suite %s is not configurable", name)
+		}
+		*l = append(*l, suites[i].ID)
+	}
+	return nil
+}
+
+// hostRoutes is a flag.Value holding a comma-separated list of host=service
+// entries, e.g. "nova.example=compute,neutron.example=networking".
+type hostRoutes map[string]string
+
+func (m *hostRoutes) String() string {
+	if m == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*m))
+	for host, service := range *m {
+		items = append(items, host+"="+service)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (m *hostRoutes) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	routes := hostRoutes{}
+	for _, item := range items {
+		host, service, ok := strings.Cut(item, "=")
+		if !ok || host == "" || strings.Contains(host, ":") {
+			return fmt.Errorf("invalid host route %q (want host=service)", item)
+		}
+		if !isBackendService(service) {
+			return fmt.Errorf("unknown service %q in host route %q (want one of %s)", service, item, strings.Join(backendServices, ", "))
+		}
+		routes[strings.ToLower(host)] = service
+	}
+	*m = routes
+	return nil
+}
+
+// backendInstance is an additional instance of a backend service.
+type backendInstance struct {
+	Service string
+	ID      string
+	URL     string
+}
+
+// backendInstances is a flag.Value holding a comma-separated list of
+// service=[id@]url entries, e.g. "compute=a@http://127.0.0.1:8774". Instances
+// without ID are numbered per service from <service>-1.
+type backendInstances []backendInstance
+
+func (l *backendInstances) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for _, inst := range *l {
+		items = append(items, inst.Service+"="+inst.ID+"@"+inst.URL)
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *backendInstances) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	*l = nil
+	counts := map[string]int{}
+	ids := map[string]bool{}
+	for _, item := range items {
+		service, target, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid backend instance %q (want service=[id@]url)", item)
+		}
+		if !isBackendService(service) {
+			return fmt.Errorf("unknown service %q in backend instance %q (want one of %s)", service, item, strings.Join(backendServices, ", "))
+		}
+		counts[service]++
+		id := fmt.Sprintf("%s-%d", service, counts[service])
+		if i := strings.Index(target, "@"); i >= 0 && !strings.Contains(target[:i], "/") {
+			id, target = target[:i], target[i+1:]
+		}
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || id == "" {
+			return fmt.Errorf("invalid backend instance %q (want service=[id@]url)", item)
+		}
+		if ids[service+"/"+id] || id == service+"-0" {
+			return fmt.Errorf("duplicate %s instance %s", service, id)
+		}
+		ids[service+"/"+id] = true
+		*l = append(*l, backendInstance{Service: service, ID: id, URL: target})
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"flag"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestBindFlagsStringList(t *testing.T) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	bindFlags(fs, &cfg)
+	if err := fs.Parse([]string{"-roles", "admin, member,,reader"}); err != nil {
+		t.Fatalf("parsing flags failed: %v", err)
+	}
+	if want := []string{"admin", "member", "reader"}; !reflect.DeepEqual(cfg.Roles, want) {
+		t.Errorf("expected roles %v, got %v", want, cfg.Roles)
+	}
+}
+
+func TestBindFlagsContentTypeOverrides(t *testing.T) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	bindFlags(fs, &cfg)
+	if err := fs.Parse([]string{"-force-content-type", "text/html; charset=utf-8,/servers:text/plain"}); err != nil {
+		t.Fatalf("parsing flags failed: %v", err)
+	}
+	want := contentTypeOverrides{{ContentType: "text/html; charset=utf-8"}, {Prefix: "/servers", ContentType: "text/plain"}}
+	if !reflect.DeepEqual(cfg.ForceContentType, want) {
+		t.Errorf("expected overrides %v, got %v", want, cfg.ForceContentType)
+	}
+	if err := fs.Parse([]string{"-force-content-type", "/servers"}); err == nil {
+		t.Errorf("expected an error for a prefix without content type")
+	}
+}
+
+func TestTruncateRulesSet(t *testing.T) {
+	var l truncateRules
+	if err := l.Set("/servers:100,/v2/images:0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := (truncateRules{{Prefix: "/servers", Bytes: 100}, {Prefix: "/v2/images", Bytes: 0}}); !reflect.DeepEqual(l, want) {
+		t.Errorf("expected %v, got %v", want, l)
+	}
+	for _, v := range []string{"/servers", "servers:10", "/servers:-1", "/servers:ten"} {
+		if err := l.Set(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
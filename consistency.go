@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-http-utils/headers"
+)
+
+// readDelayTracker simulates eventual consistency: resources created via
+// POST to a collection are not found by GET requests to their path until
+// delay has passed since their creation.
+type readDelayTracker struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	created map[string]time.Time
+}
+
+func newReadDelayTracker(delay time.Duration) *readDelayTracker {
+	return &readDelayTracker{delay: delay, created: map[string]time.Time{}}
+}
+
+// add registers the resource at path as created now, dropping the resources
+// that have become visible.
+func (t *readDelayTracker) add(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for other, createdAt := range t.created {
+		if now.Sub(createdAt) >= t.delay {
+			delete(t.created, other)
+		}
+	}
+	t.created[path] = now
+}
+
+// hidden reports whether the resource at path is not yet visible.
+func (t *readDelayTracker) hidden(path string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	createdAt, ok := t.created[path]
+	return ok && time.Since(createdAt) < t.delay
+}
+
+// reset makes all resources visible.
+func (t *readDelayTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.created = map[string]time.Time{}
+}
+
+// readDelayTransport answers GET requests for resources hidden by the
+// tracker with 404 and registers the resources created by POST requests.
+type readDelayTransport struct {
+	next    http.RoundTripper
+	tracker *readDelayTracker
+}
+
+func (t *readDelayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	if req.Method == http.MethodGet && t.tracker.hidden(path) {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		b, err := json.Marshal(map[string]interface{}{
+			"error": errorBody(http.StatusNotFound, fmt.Sprintf("%s could not be found", path)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		h := http.Header{}
+		h.Set(headers.ContentType, "application/json")
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", http.StatusNotFound, http.StatusText(http.StatusNotFound)),
+			StatusCode:    http.StatusNotFound,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        h,
+			Body:          io.NopCloser(bytes.NewReader(b)),
+			ContentLength: int64(len(b)),
+			Request:       req,
+		}, nil
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp, err
+	}
+	b, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	if id := createdID(b); id != "" {
+		t.tracker.add(path + "/" + id)
+	}
+	return resp, nil
+}
+
+// createdID returns the ID of the resource in a creation response, which is
+// either a flat resource document or one wrapped in a single member like
+// {"server": {...}}, or "" if there is none.
+func createdID(body []byte) string {
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	var doc map[string]interface{}
+	if d.Decode(&doc) != nil {
+		return ""
+	}
+	if len(doc) == 1 {
+		for _, v := range doc {
+			if inner, ok := v.(map[string]interface{}); ok {
+				doc = inner
+			}
+		}
+	}
+	switch id := doc["id"].(type) {
+	case string:
+		return id
+	case json.Number:
+		return id.String()
+	}
+	return ""
+}
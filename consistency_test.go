@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadDelayAfterWrite(t *testing.T) {
+	// The fake Nova creates servers with the IDs srv-1, srv-2, ... and finds
+	// any server at once.
+	var created int
+	compute := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			created++
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte(`{"server": {"id": "srv-` + strconv.Itoa(created) + `"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"server": {"id": "` + strings.TrimPrefix(r.URL.Path, "/servers/") + `"}}`))
+	}))
+	defer compute.Close()
+
+	const delay = 300 * time.Millisecond
+	ts := httptest.NewServer(NewDispatcher(Endpoints{Compute: compute.URL}, func(c *Config) { c.ReadDelayAfterWrite = delay }))
+	defer ts.Close()
+
+	if resp, body := doRequest(t, http.MethodPost, ts.URL+"/servers", strings.NewReader(`{}`)); resp.StatusCode != http.StatusAccepted || !strings.Contains(body, "srv-1") {
+		t.Fatalf("expected the creation response, got %d %s", resp.StatusCode, body)
+	}
+	for _, path := range []string{"/servers/srv-1", "/servers/srv-1/"} {
+		if resp, body := doRequest(t, http.MethodGet, ts.URL+path, nil); resp.StatusCode != http.StatusNotFound || !strings.Contains(body, `"code":404`) {
+			t.Errorf("%s: expected 404 within the window, got %d %s", path, resp.StatusCode, body)
+		}
+	}
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/servers/srv-0", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected other servers to be found, got %d", resp.StatusCode)
+	}
+
+	time.Sleep(delay)
+	if resp, body := doRequest(t, http.MethodGet, ts.URL+"/servers/srv-1", nil); resp.StatusCode != http.StatusOK || !strings.Contains(body, "srv-1") {
+		t.Errorf("expected the server after the window, got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestCreatedID(t *testing.T) {
+	for body, want := range map[string]string{
+		`{"server": {"id": "srv-1", "name": "a"}}`: "srv-1",
+		`{"id": "zone-1", "name": "a."}`:           "zone-1",
+		`{"aggregate": {"id": 7}}`:                 "7",
+		`{"servers": [{"id": "srv-1"}]}`:           "",
+		`not json`:                                 "",
+	} {
+		if got := createdID([]byte(body)); got != want {
+			t.Errorf("%s: expected %q, got %q", body, want, got)
+		}
+	}
+}
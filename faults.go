@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// faultSwitches are the faults that the admin endpoint /mock/faults turns on
+// and off at runtime, in addition to the faults configured by flags. All are
+// off initially and after a reset. It is safe for concurrent use.
+type faultSwitches struct {
+	format RetryAfterFormat
+	// switches maps the fault names to their state:
+	//
+	//	backend_errors       proxied requests are answered with 500
+	//	backend_unavailable  proxied requests are answered with 503
+	//	token_unavailable    token requests are answered with 503
+	switches map[string]*atomic.Bool
+}
+
+func newFaultSwitches(format RetryAfterFormat) *faultSwitches {
+	f := &faultSwitches{format: format, switches: map[string]*atomic.Bool{}}
+	for _, name := range []string{"backend_errors", "backend_unavailable", "token_unavailable"} {
+		f.switches[name] = &atomic.Bool{}
+	}
+	return f
+}
+
+// names returns the fault names in alphabetical order.
+func (f *faultSwitches) names() []string {
+	names := make([]string, 0, len(f.switches))
+	for name := range f.switches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// state returns whether each fault is on.
+func (f *faultSwitches) state() map[string]bool {
+	state := make(map[string]bool, len(f.switches))
+	for name, on := range f.switches {
+		state[name] = on.Load()
+	}
+	return state
+}
+
+// set turns the faults in state on or off, leaving the others as they are.
+// Unknown fault names are rejected before any fault is changed.
+func (f *faultSwitches) set(state map[string]bool) error {
+	for name := range state {
+		if _, ok := f.switches[name]; !ok {
+			return fmt.Errorf("unknown fault %q", name)
+		}
+	}
+	for name, on := range state {
+		f.switches[name].Store(on)
+	}
+	return nil
+}
+
+// reset turns all faults off. It is nil-safe.
+func (f *faultSwitches) reset() {
+	if f == nil {
+		return
+	}
+	for _, on := range f.switches {
+		on.Store(false)
+	}
+}
+
+// wrapBackend answers the requests to a proxied service while
+// backend_errors or backend_unavailable is on.
+func (f *faultSwitches) wrapBackend(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case f.switches["backend_unavailable"].Load():
+			setRetryAfter(w.Header(), f.format, proxyRetryAfter)
+			writeJSONError(w, http.StatusServiceUnavailable, "service is unavailable (fault backend_unavailable)")
+		case f.switches["backend_errors"].Load():
+			writeJSONError(w, http.StatusInternalServerError, "internal server error (fault backend_errors)")
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// wrapTokens answers token requests with 503 while token_unavailable is on.
+func (f *faultSwitches) wrapTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.switches["token_unavailable"].Load() {
+			setRetryAfter(w.Header(), f.format, proxyRetryAfter)
+			writeJSONError(w, http.StatusServiceUnavailable, "identity service is unavailable (fault token_unavailable)")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthzPath is the health check endpoint reporting the state of the
+// backends. Like PingPath it is served regardless of Config.EnableAdmin.
+const HealthzPath = "/healthz"
+
+// healthProbeClient probes the backends; the timeout keeps a hung backend
+// from blocking health checks.
+var healthProbeClient = &http.Client{Timeout: 2 * time.Second}
+
+// backendHealth is the result of probing a backend.
+type backendHealth struct {
+	Status    string    `json:"status"`
+	LatencyMS float64   `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// healthChecker probes the backends, reusing the results for interval to
+// avoid hammering them on frequent health checks.
+type healthChecker struct {
+	backends map[string]string
+	interval time.Duration
+
+	mu      sync.Mutex
+	results map[string]backendHealth
+	checked time.Time
+}
+
+// newHealthChecker returns a checker for the backends of e that have a URL.
+func newHealthChecker(e Endpoints, interval time.Duration) *healthChecker {
+	backends := map[string]string{}
+	for service, base := range map[string]string{
+		"compute":       e.Compute,
+		"networking":    e.Networking,
+		"loadbalancer":  e.LoadBalancer,
+		"blockstorage":  e.BlockStorage,
+		"dns":           e.DNS,
+		"image":         e.Image,
+		"objectstore":   e.ObjectStore,
+		"keymanager":    e.KeyManager,
+		"orchestration": e.Orchestration,
+	} {
+		if base != "" {
+			backends[service] = base
+		}
+	}
+	return &healthChecker{backends: backends, interval: interval}
+}
+
+// check returns the probe results, probing the backends concurrently if the
+// cached results are older than the interval. Any HTTP response counts as up.
+func (c *healthChecker) check() map[string]backendHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.results != nil && time.Since(c.checked) < c.interval {
+		return c.results
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]backendHealth, len(c.backends))
+	for service, base := range c.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			h := backendHealth{Status: "up", CheckedAt: start.UTC()}
+			resp, err := healthProbeClient.Get(base)
+			h.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+			if err != nil {
+				h.Status = "down"
+				h.Error = err.Error()
+			} else {
+				_ = resp.Body.Close()
+			}
+			mu.Lock()
+			results[service] = h
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	c.results, c.checked = results, time.Now()
+	return results
+}
+
+// shutdownNotice tells the dispatcher that the process is about to shut
+// down. A nil notice never begins.
+type shutdownNotice struct {
+	begun atomic.Bool
+}
+
+// begin announces the shutdown.
+func (n *shutdownNotice) begin() {
+	n.begun.Store(true)
+}
+
+// pending reports whether the shutdown has been announced.
+func (n *shutdownNotice) pending() bool {
+	return n != nil && n.begun.Load()
+}
+
+// serveHealthz answers with the backend states, with 503 if any backend is
+// down or shutdown is pending.
+func (c *healthChecker) serveHealthz(w http.ResponseWriter, r *http.Request, shutdown *shutdownNotice, pretty bool) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if shutdown.pending() {
+		writeJSONFormatted(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "shutting_down"}, pretty)
+		return
+	}
+	results := c.check()
+	status, code := "ok", http.StatusOK
+	for _, h := range results {
+		if h.Status != "up" {
+			status, code = "degraded", http.StatusServiceUnavailable
+		}
+	}
+	writeJSONFormatted(w, code, map[string]interface{}{"status": status, "services": results}, pretty)
+}
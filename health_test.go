@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type healthDocument struct {
+	Status   string                   `json:"status"`
+	Services map[string]backendHealth `json:"services"`
+}
+
+func TestHealthz(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t))
+	defer ts.Close()
+
+	var doc healthDocument
+	getJSON(t, ts.URL+HealthzPath, http.StatusOK, &doc)
+	if doc.Status != "ok" || len(doc.Services) != 6 {
+		t.Fatalf("expected six healthy backends, got %+v", doc)
+	}
+	for service, h := range doc.Services {
+		if h.Status != "up" || h.LatencyMS <= 0 || h.LatencyMS > 2000 || time.Since(h.CheckedAt) > time.Minute {
+			t.Errorf("%s: implausible health %+v", service, h)
+		}
+	}
+
+	// Within the cache interval the backends are not probed again.
+	var again healthDocument
+	getJSON(t, ts.URL+HealthzPath, http.StatusOK, &again)
+	if !again.Services["compute"].CheckedAt.Equal(doc.Services["compute"].CheckedAt) {
+		t.Errorf("expected cached probe results, got %v and %v", doc.Services["compute"].CheckedAt, again.Services["compute"].CheckedAt)
+	}
+}
+
+func TestHealthzBackendDown(t *testing.T) {
+	up := httptest.NewServer(http.NotFoundHandler())
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	ts := httptest.NewServer(NewDispatcher(Endpoints{Compute: up.URL, DNS: down.URL}, func(c *Config) { c.HealthzCache = 0 }))
+	defer ts.Close()
+
+	var doc healthDocument
+	getJSON(t, ts.URL+HealthzPath, http.StatusServiceUnavailable, &doc)
+	if doc.Status != "degraded" || doc.Services["compute"].Status != "up" || doc.Services["dns"].Status != "down" || doc.Services["dns"].Error == "" {
+		t.Errorf("expected compute up and dns down, got %+v", doc)
+	}
+}
+
+func TestPreShutdownHealthz(t *testing.T) {
+	shutdown := &shutdownNotice{}
+	ts := httptest.NewServer(buildDispatcherForTest(t, WithShutdownNotice(shutdown)))
+	defer ts.Close()
+
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+HealthzPath, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected healthy dispatcher before shutdown, got %d", resp.StatusCode)
+	}
+	shutdown.begin()
+	resp, body := doRequest(t, http.MethodGet, ts.URL+HealthzPath, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "shutting_down") {
+		t.Errorf("expected 503 shutting_down during pre-shutdown, got %d %s", resp.StatusCode, body)
+	}
+	if resp, body := doRequest(t, http.MethodGet, ts.URL+"/servers", nil); resp.StatusCode != http.StatusOK || body != "compute: /servers" {
+		t.Errorf("expected routes to keep working during pre-shutdown, got %d %s", resp.StatusCode, body)
+	}
+}
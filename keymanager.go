@@ -0,0 +1,195 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/google/uuid"
+)
+
+// maxSecretBytes limits the size of a key manager request body.
+const maxSecretBytes = 1 << 20
+
+// keyManager is a minimal in-memory Barbican backend, as kops' cloudmock has
+// none. It serves the secrets and containers of the key-manager API:
+//
+//	POST /v1/secrets, /v1/containers           create, answering with the ref
+//	GET  /v1/secrets, /v1/containers           list, oldest first
+//	GET  /v1/secrets/{id}, /v1/containers/{id} metadata
+//	GET  /v1/secrets/{id}/payload              the stored payload
+//	DELETE /v1/secrets/{id}, /v1/containers/{id}
+//
+// Refs are absolute URLs of the host the client addressed. It is safe for
+// concurrent use.
+type keyManager struct {
+	mu         sync.Mutex
+	secrets    map[string]*barbicanSecret
+	containers map[string]map[string]interface{}
+	// order lists the IDs of the secrets and containers by kind, oldest
+	// first.
+	order map[string][]string
+}
+
+// barbicanSecret is a stored secret: its metadata document and the payload.
+type barbicanSecret struct {
+	meta        map[string]interface{}
+	payload     string
+	contentType string
+}
+
+func newKeyManager() *keyManager {
+	return &keyManager{secrets: map[string]*barbicanSecret{}, containers: map[string]map[string]interface{}{}, order: map[string][]string{}}
+}
+
+// Reset drops all secrets and containers.
+func (k *keyManager) Reset() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.secrets = map[string]*barbicanSecret{}
+	k.containers = map[string]map[string]interface{}{}
+	k.order = map[string][]string{}
+}
+
+func (k *keyManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kind, rest, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/"), "/"), "/")
+	if kind != "secrets" && kind != "containers" {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("%s could not be found", r.URL.Path))
+		return
+	}
+	id, sub, _ := strings.Cut(rest, "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		k.create(w, r, kind)
+	case id == "" && r.Method == http.MethodGet:
+		k.list(w, kind)
+	case id != "" && sub == "" && r.Method == http.MethodGet:
+		k.get(w, kind, id)
+	case id != "" && sub == "" && r.Method == http.MethodDelete:
+		k.delete(w, kind, id)
+	case kind == "secrets" && id != "" && sub == "payload" && r.Method == http.MethodGet:
+		k.payload(w, id)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (k *keyManager) create(w http.ResponseWriter, r *http.Request, kind string) {
+	var doc map[string]interface{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSecretBytes)).Decode(&doc); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s document: %v", strings.TrimSuffix(kind, "s"), err))
+		return
+	}
+	id := uuid.New().String()
+	ref := keyManagerBase(r) + "/v1/" + kind + "/" + id
+	now := time.Now().UTC().Format("2006-01-02T15:04:05")
+	meta := map[string]interface{}{"name": doc["name"], "status": "ACTIVE", "created": now, "updated": now}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.order[kind] = append(k.order[kind], id)
+	if kind == "containers" {
+		meta["container_ref"] = ref
+		meta["type"] = stringOr(doc["type"], "generic")
+		refs, _ := doc["secret_refs"].([]interface{})
+		meta["secret_refs"] = append([]interface{}{}, refs...)
+		k.containers[id] = meta
+		writeJSON(w, http.StatusCreated, map[string]string{"container_ref": ref})
+		return
+	}
+	payload, _ := doc["payload"].(string)
+	contentType := stringOr(doc["payload_content_type"], "text/plain")
+	meta["secret_ref"] = ref
+	meta["secret_type"] = stringOr(doc["secret_type"], "opaque")
+	meta["algorithm"] = doc["algorithm"]
+	meta["bit_length"] = doc["bit_length"]
+	meta["mode"] = doc["mode"]
+	meta["expiration"] = doc["expiration"]
+	meta["content_types"] = map[string]string{"default": contentType}
+	k.secrets[id] = &barbicanSecret{meta: meta, payload: payload, contentType: contentType}
+	writeJSON(w, http.StatusCreated, map[string]string{"secret_ref": ref})
+}
+
+func (k *keyManager) list(w http.ResponseWriter, kind string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	items := make([]map[string]interface{}, 0, len(k.order[kind]))
+	for _, id := range k.order[kind] {
+		if kind == "containers" {
+			items = append(items, k.containers[id])
+		} else {
+			items = append(items, k.secrets[id].meta)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{kind: items, "total": len(items)})
+}
+
+func (k *keyManager) get(w http.ResponseWriter, kind, id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if kind == "containers" {
+		if c, ok := k.containers[id]; ok {
+			writeJSON(w, http.StatusOK, c)
+			return
+		}
+	} else if s, ok := k.secrets[id]; ok {
+		writeJSON(w, http.StatusOK, s.meta)
+		return
+	}
+	writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Not Found. Sorry but your %s is in another castle.", strings.TrimSuffix(kind, "s")))
+}
+
+func (k *keyManager) delete(w http.ResponseWriter, kind, id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	found := false
+	if kind == "containers" {
+		_, found = k.containers[id]
+		delete(k.containers, id)
+	} else {
+		_, found = k.secrets[id]
+		delete(k.secrets, id)
+	}
+	k.order[kind] = slices.DeleteFunc(k.order[kind], func(other string) bool { return other == id })
+	if !found {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Not Found. Sorry but your %s is in another castle.", strings.TrimSuffix(kind, "s")))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (k *keyManager) payload(w http.ResponseWriter, id string) {
+	k.mu.Lock()
+	s, ok := k.secrets[id]
+	k.mu.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Not Found. Sorry but your secret is in another castle.")
+		return
+	}
+	w.Header().Set(headers.ContentType, s.contentType)
+	_, _ = w.Write([]byte(s.payload))
+}
+
+// keyManagerBase returns the base URL the client addressed, which is the
+// dispatcher's for requests proxied by it.
+func keyManagerBase(r *http.Request) string {
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		forwarded := r.Clone(r.Context())
+		forwarded.Host = host
+		return requestBase(forwarded)
+	}
+	return requestBase(r)
+}
+
+// stringOr returns v if it is a non-empty string, dflt otherwise.
+func stringOr(v interface{}, dflt string) string {
+	if s, ok := v.(string); ok && s != "" {
+		return s
+	}
+	return dflt
+}
@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// delayDistribution describes the random delay added to requests. The meaning
+// of A and B depends on Kind:
+//
+//	fixed:   always A
+//	uniform: uniformly distributed between A and B
+//	normal:  normally distributed with mean A and standard deviation B,
+//	         negative samples are cut off at 0
+//	exp:     exponentially distributed with mean A
+type delayDistribution struct {
+	Kind string
+	A, B time.Duration
+}
+
+// parseDelayDistribution parses a distribution spec such as "200ms",
+// "uniform:100ms:300ms", "normal:200ms:50ms" or "exp:300ms".
+func parseDelayDistribution(spec string) (delayDistribution, error) {
+	parts := strings.Split(spec, ":")
+	kind, args := parts[0], parts[1:]
+	if len(parts) == 1 {
+		kind, args = "fixed", parts
+	}
+	want := map[string]int{"fixed": 1, "uniform": 2, "normal": 2, "exp": 1}[kind]
+	if want == 0 {
+		return delayDistribution{}, fmt.Errorf("unknown delay distribution %q in %q (want fixed duration, uniform, normal or exp)", kind, spec)
+	}
+	if len(args) != want {
+		return delayDistribution{}, fmt.Errorf("%s delay distribution takes %d duration(s), got %q", kind, want, spec)
+	}
+	d := delayDistribution{Kind: kind}
+	for i, arg := range args {
+		v, err := time.ParseDuration(arg)
+		if err != nil {
+			return delayDistribution{}, fmt.Errorf("invalid delay in %q: %w", spec, err)
+		}
+		if v < 0 {
+			return delayDistribution{}, fmt.Errorf("negative delay in %q", spec)
+		}
+		if i == 0 {
+			d.A = v
+		} else {
+			d.B = v
+		}
+	}
+	if kind == "uniform" && d.B < d.A {
+		return delayDistribution{}, fmt.Errorf("uniform delay maximum below minimum in %q", spec)
+	}
+	return d, nil
+}
+
+func (d delayDistribution) String() string {
+	switch d.Kind {
+	case "":
+		return ""
+	case "fixed":
+		return d.A.String()
+	case "uniform", "normal":
+		return d.Kind + ":" + d.A.String() + ":" + d.B.String()
+	}
+	return d.Kind + ":" + d.A.String()
+}
+
+// Set parses a distribution spec, making a single delayDistribution usable as
+// flag.Value; the zero value adds no delay.
+func (d *delayDistribution) Set(v string) error {
+	parsed, err := parseDelayDistribution(v)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// delaySampler draws delays from a seeded random number generator, so that
+// soak test runs can be reproduced. It is safe for concurrent use.
+type delaySampler struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newDelaySampler(seed int64) *delaySampler {
+	return &delaySampler{rng: rand.New(rand.NewSource(seed))}
+}
+
+// sample returns a delay drawn from d.
+func (s *delaySampler) sample(d delayDistribution) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch d.Kind {
+	case "uniform":
+		return d.A + time.Duration(s.rng.Int63n(int64(d.B-d.A)+1))
+	case "normal":
+		if v := time.Duration(s.rng.NormFloat64()*float64(d.B)) + d.A; v > 0 {
+			return v
+		}
+		return 0
+	case "exp":
+		return time.Duration(s.rng.ExpFloat64() * float64(d.A))
+	}
+	return d.A
+}
+
+// delayedTransport delays each request by a delay drawn from d before sending
+// it. Requests canceled while waiting fail with the context's error. With
+// serverTiming, the delay is added to the response as Server-Timing metric
+// "latency".
+type delayedTransport struct {
+	next         http.RoundTripper
+	d            delayDistribution
+	sampler      *delaySampler
+	serverTiming bool
+}
+
+func (t *delayedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delay := t.sampler.sample(t.d)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		resp, err := t.next.RoundTrip(req)
+		if err == nil && t.serverTiming {
+			addServerTiming(resp.Header, "latency", delay)
+		}
+		return resp, err
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+// delayRequests delays each request by a delay drawn from d before serving
+// it. Requests canceled while waiting are dropped.
+func delayRequests(next http.Handler, d delayDistribution, sampler *delaySampler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timer := time.NewTimer(sampler.sample(d))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			next.ServeHTTP(w, r)
+		case <-r.Context().Done():
+		}
+	})
+}
+
+// latencySpecs is a flag.Value holding a comma-separated list of
+// service=distribution entries, e.g. "compute=normal:200ms:50ms,dns=exp:300ms".
+type latencySpecs map[string]delayDistribution
+
+func (l *latencySpecs) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for svc, d := range *l {
+		items = append(items, svc+"="+d.String())
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (l *latencySpecs) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	specs := latencySpecs{}
+	for _, item := range items {
+		svc, spec, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("missing service in latency %q (want service=distribution)", item)
+		}
+		if !isBackendService(svc) {
+			return fmt.Errorf("unknown service %q in latency %q (want one of %s)", svc, item, strings.Join(backendServices, ", "))
+		}
+		d, err := parseDelayDistribution(spec)
+		if err != nil {
+			return err
+		}
+		specs[svc] = d
+	}
+	*l = specs
+	return nil
+}
@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseDelayDistribution(t *testing.T) {
+	valid := map[string]delayDistribution{
+		"150ms":               {Kind: "fixed", A: 150 * time.Millisecond},
+		"uniform:100ms:300ms": {Kind: "uniform", A: 100 * time.Millisecond, B: 300 * time.Millisecond},
+		"normal:200ms:50ms":   {Kind: "normal", A: 200 * time.Millisecond, B: 50 * time.Millisecond},
+		"exp:300ms":           {Kind: "exp", A: 300 * time.Millisecond},
+	}
+	for spec, want := range valid {
+		got, err := parseDelayDistribution(spec)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", spec, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: expected %+v, got %+v", spec, want, got)
+		}
+		if got.String() != spec {
+			t.Errorf("%s: formatted as %q", spec, got.String())
+		}
+	}
+	for _, spec := range []string{"", "soon", "gamma:1s", "normal:200ms", "exp:1s:2s", "exp:-1s", "uniform:2s:1s"} {
+		if _, err := parseDelayDistribution(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestLatencySpecsSet(t *testing.T) {
+	var l latencySpecs
+	if err := l.Set("compute=normal:200ms:50ms, dns=exp:300ms"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := latencySpecs{
+		"compute": {Kind: "normal", A: 200 * time.Millisecond, B: 50 * time.Millisecond},
+		"dns":     {Kind: "exp", A: 300 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(l, want) {
+		t.Errorf("expected %v, got %v", want, l)
+	}
+	for _, v := range []string{"normal:200ms:50ms", "swift=100ms", "compute=gamma:1s"} {
+		if err := l.Set(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
+
+// sampleStats returns mean and standard deviation of n delays drawn from d.
+func sampleStats(s *delaySampler, d delayDistribution, n int) (mean, stddev time.Duration) {
+	var sum, sumSq float64
+	for i := 0; i < n; i++ {
+		v := float64(s.sample(d))
+		sum += v
+		sumSq += v * v
+	}
+	m := sum / float64(n)
+	return time.Duration(m), time.Duration(math.Sqrt(sumSq/float64(n) - m*m))
+}
+
+func TestDelaySamplerDistributions(t *testing.T) {
+	within := func(got, want, tolerance time.Duration) bool {
+		return got >= want-tolerance && got <= want+tolerance
+	}
+	s := newDelaySampler(42)
+	const n = 20000
+
+	mean, stddev := sampleStats(s, delayDistribution{Kind: "normal", A: 200 * time.Millisecond, B: 50 * time.Millisecond}, n)
+	if !within(mean, 200*time.Millisecond, 5*time.Millisecond) || !within(stddev, 50*time.Millisecond, 5*time.Millisecond) {
+		t.Errorf("normal:200ms:50ms: got mean %v, stddev %v", mean, stddev)
+	}
+	// The exponential distribution's standard deviation equals its mean.
+	mean, stddev = sampleStats(s, delayDistribution{Kind: "exp", A: 300 * time.Millisecond}, n)
+	if !within(mean, 300*time.Millisecond, 15*time.Millisecond) || !within(stddev, 300*time.Millisecond, 20*time.Millisecond) {
+		t.Errorf("exp:300ms: got mean %v, stddev %v", mean, stddev)
+	}
+	uniform := delayDistribution{Kind: "uniform", A: 100 * time.Millisecond, B: 300 * time.Millisecond}
+	for i := 0; i < n; i++ {
+		if v := s.sample(uniform); v < uniform.A || v > uniform.B {
+			t.Fatalf("uniform:100ms:300ms: sample %v out of range", v)
+		}
+	}
+	if mean, _ = sampleStats(s, uniform, n); !within(mean, 200*time.Millisecond, 5*time.Millisecond) {
+		t.Errorf("uniform:100ms:300ms: got mean %v", mean)
+	}
+
+	// The same seed reproduces the same delays.
+	d := delayDistribution{Kind: "exp", A: time.Second}
+	a, b := newDelaySampler(7), newDelaySampler(7)
+	for i := 0; i < 100; i++ {
+		if x, y := a.sample(d), b.sample(d); x != y {
+			t.Fatalf("sample %d differs for the same seed: %v != %v", i, x, y)
+		}
+	}
+}
+
+func TestLatencyInjection(t *testing.T) {
+	opt := func(c *Config) {
+		_ = c.Latency.Set("compute=100ms")
+		c.LatencySeed = 1
+	}
+	ts := httptest.NewServer(buildDispatcherForTest(t, opt))
+	defer ts.Close()
+
+	start := time.Now()
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/flavors", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from compute, got %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected compute requests to be delayed by 100ms, took %v", elapsed)
+	}
+
+	start = time.Now()
+	doRequest(t, http.MethodGet, ts.URL+"/networks", nil)
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("expected networking requests not to be delayed, took %v", elapsed)
+	}
+}
+
+func TestLatencyWithStubs(t *testing.T) {
+	// Stubs in the routing table must not get in the way of latency injection.
+	opt := func(c *Config) {
+		_ = c.Latency.Set("compute=1ms")
+		c.NovaServices = true
+		c.IPAvailability = true
+	}
+	ts := httptest.NewServer(buildDispatcherForTest(t, opt))
+	defer ts.Close()
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/os-services", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 from the stub, got %d", resp.StatusCode)
+	}
+}
+
+func TestTokenDelay(t *testing.T) {
+	opt := func(c *Config) {
+		_ = c.TokenDelay.Set("100ms")
+		c.LatencySeed = 1
+	}
+	ts := httptest.NewServer(buildDispatcherForTest(t, opt))
+	defer ts.Close()
+
+	start := time.Now()
+	if tok := newToken(t, ts.URL); tok == "" {
+		t.Fatalf("expected a token")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected token requests to be delayed by 100ms, took %v", elapsed)
+	}
+	start = time.Now()
+	doRequest(t, http.MethodGet, ts.URL+"/flavors", nil)
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("expected compute requests not to be delayed, took %v", elapsed)
+	}
+}
+
+// BenchmarkTokenDelay issues tokens concurrently with -token-delay and checks
+// that the delays follow the uniform distribution.
+func BenchmarkTokenDelay(b *testing.B) {
+	d := delayDistribution{Kind: "uniform", A: 10 * time.Millisecond, B: 30 * time.Millisecond}
+	ts := httptest.NewServer(buildDispatcherForTest(b, func(c *Config) {
+		c.TokenDelay = d
+		c.LatencySeed = 1
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}
+	var mu sync.Mutex
+	var elapsed []time.Duration
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			start := time.Now()
+			resp, err := client.Post(ts.URL+"/v3/auth/tokens", "application/json", nil)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			//nolint:errcheck // Response body Close() call
+			_ = resp.Body.Close()
+			mu.Lock()
+			elapsed = append(elapsed, time.Since(start))
+			mu.Unlock()
+		}
+	})
+
+	var sum time.Duration
+	for _, e := range elapsed {
+		if e < d.A {
+			b.Errorf("token issued after %v, below the minimum delay %v", e, d.A)
+		}
+		sum += e
+	}
+	// The mean converges to (A+B)/2 plus the request overhead.
+	if mean := sum / time.Duration(len(elapsed)); len(elapsed) >= 100 && (mean < 18*time.Millisecond || mean > 30*time.Millisecond) {
+		b.Errorf("expected a mean delay of about 20ms, got %v", mean)
+	}
+}
@@ -11,11 +11,14 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"os"
@@ -26,13 +29,20 @@ import (
 	"time"
 
 	"github.com/go-http-utils/headers"
-	"github.com/google/uuid"
 	"k8s.io/klog/v2"
 	"k8s.io/kops/pkg/testutils"
 )
 
 const IdentityPath = "/v3/identity"
 
+// IdentityVersionPath is the Keystone v3 version document, which the
+// identity catalog endpoint points at.
+const IdentityVersionPath = "/v3"
+
+// shutdownTimeout bounds the time in-flight requests get to complete on
+// shutdown.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	// Reduce klog noise unless overridden
 	if os.Getenv("KLOG_V") == "" {
@@ -41,7 +51,31 @@ func main() {
 
 	port := flag.Int("port", 19090, "Port for the dispatcher to listen on")
 	listen := flag.String("listen", "127.0.0.1", "Address/interface for the dispatcher to bind to")
+	computePort := flag.Int("compute-port", 0, "Fixed port for the compute backend (default: random)")
+	networkingPort := flag.Int("networking-port", 0, "Fixed port for the networking backend (default: random)")
+	lbPort := flag.Int("loadbalancer-port", 0, "Fixed port for the load balancer backend (default: random)")
+	blockPort := flag.Int("blockstorage-port", 0, "Fixed port for the block storage backend (default: random)")
+	dnsPort := flag.Int("dns-port", 0, "Fixed port for the DNS backend (default: random)")
+	imagePort := flag.Int("image-port", 0, "Fixed port for the image backend (default: random)")
+	objectStoreURL := flag.String("object-store-url", "", "Base URL of an object-store (Swift) backend to advertise and route (default: none)")
+	configFile := flag.String("config", "", "JSON file listing the backend services to enable and additional prefix routes to them (default: all services, built-in routes)")
+	cfg := DefaultConfig()
+	bindFlags(flag.CommandLine, &cfg)
 	flag.Parse()
+	var services serviceConfig
+	if *configFile != "" {
+		var err error
+		if services, err = loadServiceConfig(*configFile); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		log.Fatalf("-tls-cert and -tls-key must be given together")
+	}
+	useTLS := cfg.TLSCert != "" || cfg.TLSSelfSigned
+	if !useTLS && (cfg.TLSMinVersion != 0 || len(cfg.TLSCiphers) > 0 || cfg.RequireSNI != "") {
+		log.Fatalf("-tls-min-version, -tls-ciphers and -require-sni require -tls-cert or -tls-self-signed")
+	}
 
 	klog.Infof("Starting OpenStack mock services...")
 
@@ -52,37 +86,161 @@ func main() {
 		cloud.MockImageClient.Reset()
 	}
 
-	computeBase := cloud.ComputeClient().Endpoint
-	networkingBase := cloud.NetworkingClient().Endpoint
-	lbBase := cloud.LoadBalancerClient().Endpoint
-	blockBase := cloud.BlockStorageClient().Endpoint
-	dnsBase := cloud.DNSClient().Endpoint
-	imageBase := cloud.ImageClient().Endpoint
+	// kOps sets up and seeds all mocks; the ones of the services left out by
+	// the config file are stopped right after. The compute mock creates the
+	// ports of its servers in the networking mock, which therefore keeps
+	// running for it, although it is neither advertised nor routed.
+	for _, b := range []struct {
+		name   string
+		server *httptest.Server
+	}{
+		{"compute", cloud.MockNovaClient.Server},
+		{"networking", cloud.MockNeutronClient.Server},
+		{"loadbalancer", cloud.MockLBClient.Server},
+		{"blockstorage", cloud.MockCinderClient.Server},
+		{"dns", cloud.MockDNSClient.Server},
+		{"image", cloud.MockImageClient.Server},
+	} {
+		if services.enabled(b.name) || b.name == "networking" && services.enabled("compute") {
+			continue
+		}
+		klog.Infof("Stopping the %s mock, which the config file does not enable", b.name)
+		b.server.Close()
+	}
+
+	// Serve backends on fixed ports if requested. The random-port servers keep
+	// running, as the mocks use them for calls between services.
+	for _, b := range []struct {
+		name   string
+		port   int
+		server **httptest.Server
+		mux    http.Handler
+	}{
+		{"compute", *computePort, &cloud.MockNovaClient.Server, cloud.MockNovaClient.Mux},
+		{"networking", *networkingPort, &cloud.MockNeutronClient.Server, cloud.MockNeutronClient.Mux},
+		{"loadbalancer", *lbPort, &cloud.MockLBClient.Server, cloud.MockLBClient.Mux},
+		{"blockstorage", *blockPort, &cloud.MockCinderClient.Server, cloud.MockCinderClient.Mux},
+		{"dns", *dnsPort, &cloud.MockDNSClient.Server, cloud.MockDNSClient.Mux},
+		{"image", *imagePort, &cloud.MockImageClient.Server, cloud.MockImageClient.Mux},
+	} {
+		if b.port == 0 || !services.enabled(b.name) {
+			continue
+		}
+		srv, err := serveOnFixedPort(b.mux, *listen, b.port)
+		if err != nil {
+			log.Fatalf("%s backend: %v", b.name, err)
+		}
+		*b.server = srv
+	}
+
+	// The services left out by the config file are neither advertised nor
+	// routed.
+	endpoint := func(service, base string) string {
+		if !services.enabled(service) {
+			return ""
+		}
+		return base
+	}
+	computeBase := endpoint("compute", cloud.ComputeClient().Endpoint)
+	networkingBase := endpoint("networking", cloud.NetworkingClient().Endpoint)
+	lbBase := endpoint("loadbalancer", cloud.LoadBalancerClient().Endpoint)
+	blockBase := endpoint("blockstorage", cloud.BlockStorageClient().Endpoint)
+	dnsBase := endpoint("dns", cloud.DNSClient().Endpoint)
+	imageBase := endpoint("image", cloud.ImageClient().Endpoint)
+	objectStoreBase := endpoint("objectstore", *objectStoreURL)
+
+	// kops' cloudmock has no Barbican; the in-memory key manager stands in.
+	keyManager := newKeyManager()
+	var keyManagerBase string
+	if services.enabled("keymanager") {
+		keyManagerServer := httptest.NewServer(keyManager)
+		defer keyManagerServer.Close()
+		keyManagerBase = keyManagerServer.URL
+	}
+	// Neither has it Heat; the orchestration stub knows no stacks.
+	var orchestrationBase string
+	if services.enabled("orchestration") {
+		orchestrationServer := httptest.NewServer(newOrchestrationStub())
+		defer orchestrationServer.Close()
+		orchestrationBase = orchestrationServer.URL
+	}
 
 	// Print service endpoints for convenience
 	fmt.Println("OpenStack mock service endpoints (set your clients to these base URLs):")
-	fmt.Printf("  compute      (nova):        %s\n", computeBase)
-	fmt.Printf("  networking   (neutron):     %s\n", networkingBase)
-	fmt.Printf("  loadbalancer (octavia):     %s\n", lbBase)
-	fmt.Printf("  blockstorage (cinder):      %s\n", blockBase)
-	fmt.Printf("  dns          (designate):   %s\n", dnsBase)
-	fmt.Printf("  image        (glance):      %s\n", imageBase)
+	for _, b := range []struct{ label, base string }{
+		{"compute      (nova):     ", computeBase},
+		{"networking   (neutron):  ", networkingBase},
+		{"loadbalancer (octavia):  ", lbBase},
+		{"blockstorage (cinder):   ", blockBase},
+		{"dns          (designate):", dnsBase},
+		{"image        (glance):   ", imageBase},
+		{"keymanager   (barbican): ", keyManagerBase},
+		{"orchestration (heat):    ", orchestrationBase},
+		{"objectstore  (swift):    ", objectStoreBase},
+	} {
+		if b.base != "" {
+			fmt.Printf("  %s   %s\n", b.label, b.base)
+		}
+	}
+
+	var timings *timingRecorder
+	if cfg.TimingDump != "" {
+		timings = newTimingRecorder()
+	}
+	shutdown := &shutdownNotice{}
 
 	dispatcher := NewDispatcher(Endpoints{
-		Compute:      computeBase,
-		Networking:   networkingBase,
-		LoadBalancer: lbBase,
-		BlockStorage: blockBase,
-		DNS:          dnsBase,
-		Image:        imageBase,
-	})
+		Compute:       computeBase,
+		Networking:    networkingBase,
+		LoadBalancer:  lbBase,
+		BlockStorage:  blockBase,
+		DNS:           dnsBase,
+		Image:         imageBase,
+		ObjectStore:   objectStoreBase,
+		KeyManager:    keyManagerBase,
+		Orchestration: orchestrationBase,
+	}, WithConfig(cfg), WithRoutes(services.Routes...), WithTimings(timings), WithShutdownNotice(shutdown), WithResetHook(func() {
+		for _, c := range []interface{ Reset() }{
+			cloud.MockNovaClient, cloud.MockNeutronClient, cloud.MockLBClient,
+			cloud.MockCinderClient, cloud.MockDNSClient, cloud.MockImageClient, keyManager,
+		} {
+			c.Reset()
+		}
+	}))
 
 	addr := fmt.Sprintf("%s:%d", *listen, *port)
-	server := &http.Server{Addr: addr, Handler: dispatcher}
+	server := newDispatcherServer(addr, dispatcher, cfg)
+	if cfg.TLSSelfSigned && cfg.TLSCert == "" {
+		cert, certPEM, err := selfSignedCertificate(*listen)
+		if err != nil {
+			log.Fatalf("generating a self-signed certificate failed: %v", err)
+		}
+		if server.TLSConfig == nil {
+			server.TLSConfig = &tls.Config{}
+		}
+		server.TLSConfig.Certificates = []tls.Certificate{cert}
+		fmt.Println("Self-signed certificate of the dispatcher (trust it as CA in your clients):")
+		fmt.Print(string(certPEM))
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("dispatcher failed: %v", err)
+	}
+	if cfg.AcceptDelay > 0 {
+		ln = &delayedListener{Listener: ln, delay: cfg.AcceptDelay}
+	}
 
 	go func() {
-		klog.Infof("Dispatcher listening on http://%s", addr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if useTLS {
+			// Without files, the self-signed certificate of TLSConfig is used.
+			klog.Infof("Dispatcher listening on https://%s", addr)
+			err = server.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+		} else {
+			klog.Infof("Dispatcher listening on http://%s", addr)
+			err = server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("dispatcher failed: %v", err)
 		}
 	}()
@@ -94,7 +252,75 @@ func main() {
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	<-sigCh
 
+	if cfg.PreShutdownDelay > 0 {
+		klog.Infof("Failing %s for %v before shutting down", HealthzPath, cfg.PreShutdownDelay)
+		shutdown.begin()
+		select {
+		case <-time.After(cfg.PreShutdownDelay):
+		case <-sigCh:
+		}
+	}
 	klog.Infof("Shutting down OpenStack mock services...")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		klog.Warningf("graceful shutdown failed: %v", err)
+	}
+	if timings != nil {
+		if err := timings.dump(cfg.TimingDump); err != nil {
+			klog.Errorf("writing timing dump failed: %v", err)
+		} else {
+			klog.Infof("Wrote timing dump to %s", cfg.TimingDump)
+		}
+	}
+}
+
+// newDispatcherServer returns the HTTP server serving the dispatcher on addr,
+// with the server-level settings of cfg applied.
+func newDispatcherServer(addr string, dispatcher http.Handler, cfg Config) *http.Server {
+	server := &http.Server{
+		Addr:           addr,
+		Handler:        dispatcher,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
+	if cfg.FirstRequestDelay > 0 {
+		server.ConnContext = withConnState
+		server.Handler = delayFirstRequests(server.Handler, cfg.FirstRequestDelay)
+	}
+	if cfg.TLSMinVersion != 0 || len(cfg.TLSCiphers) > 0 || cfg.RequireSNI != "" {
+		server.TLSConfig = &tls.Config{
+			MinVersion:   uint16(cfg.TLSMinVersion),
+			CipherSuites: cfg.TLSCiphers,
+		}
+	}
+	if cfg.RequireSNI != "" {
+		// Returning no config continues the handshake with the server's.
+		server.TLSConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if !strings.EqualFold(hello.ServerName, cfg.RequireSNI) {
+				return nil, fmt.Errorf("unexpected server name %q", hello.ServerName)
+			}
+			return nil, nil
+		}
+	}
+	return server
+}
+
+// delayedListener delays accepting each connection by delay, simulating a
+// server slow to establish connections. The kernel still completes the TCP
+// handshake, but the server neither reads the request nor answers the TLS
+// handshake before the delay; connections are accepted one after another.
+type delayedListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (l *delayedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(l.delay)
+	return conn, nil
 }
 
 // Endpoints defines base URLs for each mock service backend.
@@ -105,88 +331,410 @@ type Endpoints struct {
 	BlockStorage string
 	DNS          string
 	Image        string
+	// ObjectStore is optional; the object-store service is only advertised
+	// and routed if it is set.
+	ObjectStore string
+	// KeyManager is optional like ObjectStore; the key-manager (Barbican)
+	// service is only advertised and routed if it is set.
+	KeyManager string
+	// Orchestration is optional as well; the orchestration (Heat) service is
+	// only advertised and routed if it is set.
+	Orchestration string
+}
+
+// Route routes the requests below Prefix to the backend of Service, named as
+// in backendServices, e.g. {Prefix: "/v2.0/trunks", Service: "networking"}.
+// Routes are added to the built-in routing table with WithRoutes; they
+// override a built-in route with the same prefix, and as for the built-in
+// routes, the longest matching prefix wins.
+type Route struct {
+	Prefix  string `json:"prefix"`
+	Service string `json:"service"`
 }
 
 // NewDispatcher constructs the HTTP handler that serves token/identity endpoints
 // and proxies requests to the provided backend endpoints based on path prefixes.
-func NewDispatcher(e Endpoints) http.Handler {
+// Services whose backend URL is empty are left out of the token catalog.
+// Options tune the optional behavior described by Config; WithRoutes adds
+// prefixes to the routing table.
+func NewDispatcher(e Endpoints, opts ...Option) http.Handler {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	// Optional latency injection per backend service and for tokens
+	var sampler *delaySampler
+	if len(cfg.Latency) > 0 || cfg.TokenDelay.Kind != "" {
+		seed := cfg.LatencySeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		if len(cfg.Latency) > 0 {
+			klog.Infof("Injecting latency %s (seed %d)", cfg.Latency.String(), seed)
+		}
+		if cfg.TokenDelay.Kind != "" {
+			klog.Infof("Delaying tokens by %s (seed %d)", cfg.TokenDelay.String(), seed)
+		}
+		sampler = newDelaySampler(seed)
+	}
+
+	counter := newRequestCounter()
+	health := newHealthChecker(e, cfg.HealthzCache)
+	maintenance := newMaintenanceSchedule(cfg.Maintenance)
+	var readDelay *readDelayTracker
+	if cfg.ReadDelayAfterWrite > 0 {
+		readDelay = newReadDelayTracker(cfg.ReadDelayAfterWrite)
+	}
+
+	var corrupter *responseCorrupter
+	if cfg.CorruptRate > 0 {
+		seed := cfg.CorruptSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		klog.Infof("Corrupting %v of the JSON responses (seed %d)", float64(cfg.CorruptRate), seed)
+		corrupter = newResponseCorrupter(float64(cfg.CorruptRate), seed)
+	}
+
 	// Build reverse proxies for each backend
-	mkProxy := func(base string) *httputil.ReverseProxy {
+	mkProxy := func(service, base string) *httputil.ReverseProxy {
 		u, err := url.Parse(base)
 		if err != nil {
 			log.Fatalf("invalid backend URL %q: %v", base, err)
 		}
+		pool, err := newBackendPool(service, u, cfg.BackendInstances)
+		if err != nil {
+			log.Fatalf("invalid %s instance URL: %v", service, err)
+		}
 		rp := httputil.NewSingleHostReverseProxy(u)
+		transport := newBackendTransport(service, cfg)
+		if cfg.Prewarm > 0 && base != "" {
+			n := prewarmConnections(transport, pool.urls, cfg.Prewarm)
+			klog.Infof("Prewarmed %d connections to the %s backend", n, service)
+		}
+		rp.Transport = &instanceTransport{next: transport, pool: pool}
+		if cfg.ServerTiming {
+			rp.Transport = &serverTimingTransport{next: rp.Transport}
+		}
+		if d, ok := cfg.Latency[service]; ok {
+			rp.Transport = &delayedTransport{next: rp.Transport, d: d, sampler: sampler, serverTiming: cfg.ServerTiming}
+		}
+		if readDelay != nil {
+			rp.Transport = &readDelayTransport{next: rp.Transport, tracker: readDelay}
+		}
+		if maintenance != nil {
+			rp.Transport = &maintenanceTransport{next: rp.Transport, service: service, schedule: maintenance, format: cfg.RetryAfterFormat}
+		}
 		// Preserve the original Host header so handlers that rely on it still work if needed.
 		rp.Director = func(req *http.Request) {
-			req.URL.Scheme = u.Scheme
-			req.URL.Host = u.Host
+			target := pool.urls[pool.pick()]
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			counter.forwarded(service)
+			noteBackend(req, service)
 			// Keep the original path and rawpath; backend muxes expect the same path prefixes
+			normalizeSlash(req.URL, cfg.NormalizeSlash)
+			// The server drops the body of the GET response for the client.
+			if cfg.SynthesizeHead && req.Method == http.MethodHead {
+				req.Method = http.MethodGet
+			}
 			if req.Header.Get("X-Forwarded-Host") == "" {
 				req.Header.Set("X-Forwarded-Host", req.Host)
 			}
-			req.Host = u.Host
+			req.Host = target.Host
+		}
+		// Answer backend failures, e.g. a mock panicking on an unsupported
+		// request, with an error envelope instead of an empty 502.
+		rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			klog.V(2).Infof("proxying %s %s failed: %v", r.Method, r.URL.Path, err)
+			setRetryAfter(w.Header(), cfg.RetryAfterFormat, proxyRetryAfter)
+			writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("backend request failed: %v", err))
+		}
+		if len(cfg.ForceContentType) > 0 {
+			rp.ModifyResponse = forceContentType(cfg.ForceContentType)
+		}
+		if corrupter != nil {
+			// Corrupt based on the backend's content type, before any override.
+			rp.ModifyResponse = chainResponseModifiers(corrupter.modifyResponse, rp.ModifyResponse)
 		}
 		return rp
 	}
 
-	computeProxy := mkProxy(e.Compute)
-	networkingProxy := mkProxy(e.Networking)
-	lbProxy := mkProxy(e.LoadBalancer)
-	blockProxy := mkProxy(e.BlockStorage)
-	dnsProxy := mkProxy(e.DNS)
-	imageProxy := mkProxy(e.Image)
-
-	// Routing table: URI prefix -> proxy
-	routes := map[string]*httputil.ReverseProxy{
-		// Compute (Nova)
-		"/servers/":             computeProxy,
-		"/servers":              computeProxy,
-		"/os-keypairs/":         computeProxy,
-		"/os-keypairs":          computeProxy,
-		"/flavors/":             computeProxy,
-		"/flavors":              computeProxy,
-		"/os-instance-actions/": computeProxy,
-		// Image (Glance)
-		"/v2/images/": imageProxy,
-		"/v2/images":  imageProxy,
-		"/images/":    imageProxy,
-		"/images":     imageProxy,
-		// BlockStorage (Cinder)
-		"/volumes/":             blockProxy,
-		"/volumes":              blockProxy,
-		"/types/":               blockProxy,
-		"/types":                blockProxy,
-		"/os-availability-zone": blockProxy,
-		// DNS (Designate)
-		"/zones/": dnsProxy,
-		"/zones":  dnsProxy,
-		// Networking (Neutron)
-		"/v2.0/networks/":        networkingProxy,
-		"/v2.0/networks":         networkingProxy,
-		"/networks/":             networkingProxy,
-		"/networks":              networkingProxy,
-		"/ports/":                networkingProxy,
-		"/ports":                 networkingProxy,
-		"/routers/":              networkingProxy,
-		"/routers":               networkingProxy,
-		"/security-groups/":      networkingProxy,
-		"/security-groups":       networkingProxy,
-		"/security-group-rules/": networkingProxy,
-		"/security-group-rules":  networkingProxy,
-		"/subnets/":              networkingProxy,
-		"/subnets":               networkingProxy,
-		"/v2.0/floatingips/":     networkingProxy,
-		"/v2.0/floatingips":      networkingProxy,
-		"/floatingips/":          networkingProxy,
-		"/floatingips":           networkingProxy,
-		// LoadBalancer (Octavia)
-		"/lbaas/listeners/":     lbProxy,
-		"/lbaas/listeners":      lbProxy,
-		"/lbaas/loadbalancers/": lbProxy,
-		"/lbaas/loadbalancers":  lbProxy,
-		"/lbaas/pools/":         lbProxy,
-		"/lbaas/pools":          lbProxy,
+	computeProxy := mkProxy("compute", e.Compute)
+	networkingProxy := mkProxy("networking", e.Networking)
+	lbProxy := mkProxy("loadbalancer", e.LoadBalancer)
+	blockProxy := mkProxy("blockstorage", e.BlockStorage)
+	dnsProxy := mkProxy("dns", e.DNS)
+	if cfg.DNSAsync {
+		// Rewrite the zones before a forced Content-Type hides that they are JSON.
+		dnsProxy.ModifyResponse = chainResponseModifiers(newZoneStatusTracker(cfg.DNSAsyncDelay).modifyResponse, dnsProxy.ModifyResponse)
+	}
+	imageProxy := mkProxy("image", e.Image)
+	var objectStoreProxy http.Handler
+	if e.ObjectStore != "" {
+		objectStoreProxy = mkProxy("objectstore", e.ObjectStore)
+	}
+	var keyManagerProxy http.Handler
+	if e.KeyManager != "" {
+		keyManagerProxy = mkProxy("keymanager", e.KeyManager)
+	}
+	var orchestrationProxy http.Handler
+	if e.Orchestration != "" {
+		orchestrationProxy = mkProxy("orchestration", e.Orchestration)
+	}
+
+	// The dispatcher's answer to unrouted requests
+	var notFoundBody []byte
+	if cfg.NotFoundBody != "" {
+		b, err := os.ReadFile(cfg.NotFoundBody)
+		if err != nil {
+			log.Fatalf("cannot read 404 body: %v", err)
+		}
+		notFoundBody = b
+	}
+	notFound := func(w http.ResponseWriter, r *http.Request) {
+		noteRoute(r, "404")
+		if notFoundBody != nil {
+			w.Header().Set(headers.ContentType, cfg.NotFoundContentType)
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write(notFoundBody)
+			return
+		}
+		// Default: 404 with some guidance
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("no route for path: " + r.URL.Path + "\n"))
+	}
+
+	// Routing table: URI prefix -> proxy (or stub). Only services with a
+	// backend are routed; the requests for the others, e.g. left out by the
+	// -config file, get the 404 of unmatched paths.
+	routes := map[string]http.Handler{}
+	route := func(base string, h http.Handler, prefixes ...string) {
+		if base == "" {
+			return
+		}
+		for _, p := range prefixes {
+			routes[p] = h
+		}
+	}
+	// Compute (Nova)
+	route(e.Compute, computeProxy,
+		"/servers/", "/servers",
+		"/os-keypairs/", "/os-keypairs",
+		"/flavors/", "/flavors",
+		"/os-instance-actions/",
+		"/os-services/", "/os-services",
+		"/os-floating-ip-pools/", "/os-floating-ip-pools",
+		"/os-floating-ips/", "/os-floating-ips",
+		"/os-aggregates/", "/os-aggregates")
+	// Image (Glance)
+	route(e.Image, imageProxy,
+		"/v2/images/", "/v2/images",
+		"/v2/tasks/", "/v2/tasks",
+		"/v2/schemas/", "/v2/schemas",
+		"/images/", "/images")
+	// BlockStorage (Cinder)
+	route(e.BlockStorage, blockProxy,
+		"/volumes/", "/volumes",
+		"/types/", "/types",
+		"/os-availability-zone")
+	// DNS (Designate)
+	route(e.DNS, dnsProxy, "/zones/", "/zones")
+	// Networking (Neutron)
+	route(e.Networking, networkingProxy,
+		"/v2.0/networks/", "/v2.0/networks",
+		"/networks/", "/networks",
+		"/ports/", "/ports",
+		"/routers/", "/routers",
+		"/security-groups/", "/security-groups",
+		"/security-group-rules/", "/security-group-rules",
+		"/subnets/", "/subnets",
+		"/v2.0/floatingips/", "/v2.0/floatingips",
+		"/floatingips/", "/floatingips",
+		"/v2.0/network-ip-availabilities/", "/v2.0/network-ip-availabilities",
+		"/v2.0/address-scopes/", "/v2.0/address-scopes",
+		"/v2.0/subnetpools/", "/v2.0/subnetpools",
+		"/v2.0/auto-allocated-topology/", "/v2.0/auto-allocated-topology",
+		"/v2.0/agents/", "/v2.0/agents",
+		"/v2.0/rbac-policies/", "/v2.0/rbac-policies")
+	// LoadBalancer (Octavia)
+	route(e.LoadBalancer, lbProxy,
+		"/lbaas/listeners/", "/lbaas/listeners",
+		"/lbaas/loadbalancers/", "/lbaas/loadbalancers",
+		"/lbaas/pools/", "/lbaas/pools",
+		"/lbaas/quotas/", "/lbaas/quotas",
+		"/lbaas/flavors/", "/lbaas/flavors")
+
+	// Swift clients address the project's account; the object-store backend
+	// gets the container and object path below it.
+	if objectStoreProxy != nil {
+		account := objectStoreAccountPath(cfg.ProjectID)
+		route(e.ObjectStore, stripPathPrefix(account, objectStoreProxy), account+"/", account)
+	}
+	if keyManagerProxy != nil {
+		route(e.KeyManager, keyManagerProxy, "/v1/secrets/", "/v1/secrets", "/v1/containers/", "/v1/containers")
+	}
+	if orchestrationProxy != nil {
+		route(e.Orchestration, orchestrationProxy, "/stacks/", "/stacks")
+	}
+
+	// Optional stubs replace the proxy for APIs the mock backends lack; they
+	// are routed with the service they belong to.
+	if cfg.IPAvailability {
+		route(e.Networking, newIPAvailabilityStub(e.Networking),
+			"/v2.0/network-ip-availabilities/", "/v2.0/network-ip-availabilities")
+	}
+
+	if cfg.AutoTopology {
+		route(e.Networking, newAutoTopologyStub(e.Networking),
+			"/v2.0/auto-allocated-topology/", "/v2.0/auto-allocated-topology")
+	}
+
+	if cfg.NovaServices {
+		route(e.Compute, newNovaServicesStub(), "/os-services/", "/os-services")
+	}
+
+	if cfg.ImageSchema {
+		route(e.Image, newImageSchemaStub(imageProxy), "/v2/schemas/image")
+	}
+
+	if cfg.NeutronAgents {
+		route(e.Networking, newNeutronAgentsStub(), "/v2.0/agents/", "/v2.0/agents")
+	}
+
+	if cfg.Aggregates {
+		route(e.Compute, newAggregatesStub(), "/os-aggregates/", "/os-aggregates")
+	}
+
+	// Nova owns /os-quota-sets; Cinder quotas are reached via the project
+	// scoped path or a service hint, which gets the 404 of unmatched paths
+	// without a block storage backend.
+	computeQuotas, volumeQuotas := http.Handler(computeProxy), http.Handler(blockProxy)
+	if cfg.QuotaSets {
+		computeQuotas = newQuotaSetsStub(computeQuotaLimits)
+		volumeQuotas = newQuotaSetsStub(volumeQuotaLimits)
+	}
+	if e.BlockStorage == "" {
+		volumeQuotas = http.HandlerFunc(notFound)
+	}
+	route(e.Compute, routeQuotaSets(computeQuotas, volumeQuotas), "/os-quota-sets/", "/os-quota-sets")
+	volumeQuotaPath := "/v3/" + cfg.ProjectID + "/os-quota-sets"
+	route(e.BlockStorage, volumeQuotas, volumeQuotaPath+"/", volumeQuotaPath)
+
+	// Optional routing by Host header, ahead of the path routes; services
+	// without backend cannot be routed to.
+	serviceHandlers := map[string]http.Handler{}
+	for service, svc := range map[string]struct {
+		base string
+		h    http.Handler
+	}{
+		"compute":      {e.Compute, computeProxy},
+		"networking":   {e.Networking, networkingProxy},
+		"loadbalancer": {e.LoadBalancer, lbProxy},
+		"blockstorage": {e.BlockStorage, blockProxy},
+		"dns":          {e.DNS, dnsProxy},
+		"image":        {e.Image, imageProxy},
+	} {
+		if svc.base != "" {
+			serviceHandlers[service] = svc.h
+		}
+	}
+	if objectStoreProxy != nil {
+		serviceHandlers["objectstore"] = routes[objectStoreAccountPath(cfg.ProjectID)]
+	}
+	if keyManagerProxy != nil {
+		serviceHandlers["keymanager"] = keyManagerProxy
+	}
+	if orchestrationProxy != nil {
+		serviceHandlers["orchestration"] = orchestrationProxy
+	}
+	for _, r := range cfg.Routes {
+		h, ok := serviceHandlers[r.Service]
+		if !ok {
+			log.Fatalf("route %s is routed to %s, which has no backend", r.Prefix, r.Service)
+		}
+		routes[r.Prefix] = h
+	}
+	hostRoutes := map[string]http.Handler{}
+	for host, service := range cfg.HostRouting {
+		h, ok := serviceHandlers[service]
+		if !ok {
+			log.Fatalf("host %s is routed to %s, which has no backend", host, service)
+		}
+		hostRoutes[host] = h
+	}
+
+	// wrapRoutes applies wrap to the handlers of all path and host routes,
+	// passing the prefix or host as key.
+	wrapRoutes := func(wrap func(key string, h http.Handler) http.Handler) {
+		for p, h := range routes {
+			routes[p] = wrap(p, h)
+		}
+		for host, h := range hostRoutes {
+			hostRoutes[host] = wrap(host, h)
+		}
+	}
+
+	// Optional method checks per route kind
+	if cfg.RejectUnknownMethods {
+		for p, h := range routes {
+			collection := strings.TrimSuffix(p, "/")
+			if methods, ok := routeMethods[collection]; ok {
+				routes[p] = rejectUnknownMethods(h, collection, methods)
+			}
+		}
+	}
+
+	// Optional throttling of the proxied response bodies
+	if cfg.BodyRate > 0 {
+		wrapRoutes(func(_ string, h http.Handler) http.Handler { return throttleBodies(h, cfg.BodyRate) })
+	}
+
+	// Optional header name casing of the proxied responses
+	if cfg.HeaderCase == HeaderLower {
+		wrapRoutes(func(_ string, h http.Handler) http.Handler { return lowercaseHeaders(h) })
+	}
+
+	// Optional rejection of empty request bodies, after the token is validated
+	if cfg.RejectEmptyPost {
+		wrapRoutes(func(key string, h http.Handler) http.Handler {
+			// Swift objects and container updates may be empty.
+			if strings.HasPrefix(key, objectStoreAccountPath(cfg.ProjectID)) || cfg.HostRouting[key] == "objectstore" {
+				return h
+			}
+			return rejectEmptyBodies(h)
+		})
+	}
+
+	// Optional token validation for the proxied services
+	tokens := newTokenStore()
+	if cfg.EnforceAuth || cfg.EnforceProjectScope {
+		wrapRoutes(func(_ string, h http.Handler) http.Handler {
+			return requireToken(h, tokens, authTokenHeader(cfg), cfg.EnforceProjectScope, cfg.RedirectUnauth)
+		})
+	}
+
+	// Optional header checks, before the token is validated
+	if cfg.StrictHeaders {
+		wrapRoutes(func(key string, h http.Handler) http.Handler {
+			// Swift objects may have any content type.
+			jsonBodies := !strings.HasPrefix(key, objectStoreAccountPath(cfg.ProjectID)) && cfg.HostRouting[key] != "objectstore"
+			return requireHeaders(h, authTokenHeader(cfg), jsonBodies)
+		})
+	}
+
+	// Optional per-route timing statistics
+	if cfg.timings != nil {
+		wrapRoutes(cfg.timings.wrap)
+	}
+
+	// Faults toggled at runtime via the admin endpoints
+	var faults *faultSwitches
+	if cfg.EnableAdmin {
+		faults = newFaultSwitches(cfg.RetryAfterFormat)
+		wrapRoutes(func(_ string, h http.Handler) http.Handler { return faults.wrapBackend(h) })
 	}
 
 	// Prepare ordered list of prefixes for deterministic matching
@@ -197,61 +745,35 @@ func NewDispatcher(e Endpoints) http.Handler {
 	// Sort by length descending to match the most specific path first
 	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
 
-	// Minimal Keystone v3 token issuance handler
-	tokenHandler := func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		w.Header().Set(headers.ContentType, "application/json")
-		// Generate a token and set X-Subject-Token header as Keystone does.
-		tok := uuid.New().String()
-		w.Header().Set("X-Subject-Token", tok)
-		// Build a minimal token document with a service catalog
-		region := "RegionOne"
-		makeEndpoint := func(urlStr string) map[string]interface{} {
-			return map[string]interface{}{
-				"id":        uuid.New().String(),
-				"interface": "public",
-				"region":    region,
-				"region_id": region,
-				"url":       urlStr,
-			}
-		}
-		// Determine the external base URL of the dispatcher (scheme and host)
-		base := fmt.Sprintf("%s://%s", func() string {
-			if r.Header.Get("X-Forwarded-Proto") != "" {
-				return r.Header.Get("X-Forwarded-Proto")
-			}
-			if r.URL.Scheme != "" {
-				return r.URL.Scheme
-			}
-			if r.TLS != nil {
-				return "https"
-			}
-			return "http"
-		}(), r.Host)
-		catalog := []map[string]interface{}{
-			{"id": uuid.New().String(), "type": "compute", "name": "nova", "endpoints": []map[string]interface{}{makeEndpoint(base)}},
-			{"id": uuid.New().String(), "type": "network", "name": "neutron", "endpoints": []map[string]interface{}{makeEndpoint(base)}},
-			{"id": uuid.New().String(), "type": "load-balancer", "name": "octavia", "endpoints": []map[string]interface{}{makeEndpoint(base)}},
-			{"id": uuid.New().String(), "type": "block-storage", "name": "cinder", "endpoints": []map[string]interface{}{makeEndpoint(base)}},
-			{"id": uuid.New().String(), "type": "dns", "name": "designate", "endpoints": []map[string]interface{}{makeEndpoint(base)}},
-			{"id": uuid.New().String(), "type": "image", "name": "glance", "endpoints": []map[string]interface{}{makeEndpoint(base)}},
-			{"id": uuid.New().String(), "type": "identity", "name": "keystone", "endpoints": []map[string]interface{}{makeEndpoint(base + IdentityPath)}},
+	// The catalog only lists the services with a backend
+	services := make([]catalogService, 0, len(catalogServices)+1)
+	for _, svc := range catalogServices {
+		if svc.Backend == nil || svc.Backend(e) != "" {
+			services = append(services, svc)
 		}
-		resp := map[string]interface{}{
-			"token": map[string]interface{}{
-				"expires_at": time.Now().Add(1 * time.Hour).UTC().Format(time.RFC3339),
-				"project":    map[string]string{"id": "mock-project-id", "name": "mock"},
-				"user":       map[string]string{"id": "mock-user-id", "name": "mock-user"},
-				"catalog":    catalog,
-			},
-		}
-		b, _ := json.Marshal(resp)
-		w.WriteHeader(http.StatusCreated)
-		_, _ = w.Write(b)
 	}
+	if e.ObjectStore != "" {
+		services = append(services, catalogService{Type: "object-store", Name: "swift", Service: "objectstore", Path: objectStoreAccountPath(cfg.ProjectID)})
+	}
+	// Services in maintenance are optionally left out of the catalog
+	var hidden *maintenanceSchedule
+	if cfg.MaintenanceHideCatalog {
+		hidden = maintenance
+	}
+	var tokenHandler, v2TokenHandler http.Handler = newTokenHandler(cfg, services, tokens, hidden), newV2TokenHandler(cfg, services, tokens, hidden)
+	var outage *tokenOutage
+	if cfg.TokenFailAfter > 0 {
+		outage = newTokenOutage(cfg.TokenFailAfter, cfg.TokenFailCount, cfg.RetryAfterFormat)
+		tokenHandler, v2TokenHandler = outage.wrap(tokenHandler), outage.wrap(v2TokenHandler)
+	}
+	if cfg.TokenDelay.Kind != "" {
+		tokenHandler = delayRequests(tokenHandler, cfg.TokenDelay, sampler)
+		v2TokenHandler = delayRequests(v2TokenHandler, cfg.TokenDelay, sampler)
+	}
+	if faults != nil {
+		tokenHandler, v2TokenHandler = faults.wrapTokens(tokenHandler), faults.wrapTokens(v2TokenHandler)
+	}
+	tokenHandler = cfg.timings.wrap("/v3/auth/tokens", tokenHandler)
 
 	// Minimal Identity discovery endpoint under /v3/identity
 	identityHandler := func(w http.ResponseWriter, r *http.Request) {
@@ -260,18 +782,7 @@ func NewDispatcher(e Endpoints) http.Handler {
 			return
 		}
 		w.Header().Set(headers.ContentType, "application/json")
-		base := fmt.Sprintf("%s://%s", func() string {
-			if r.Header.Get(headers.XForwardedProto) != "" {
-				return r.Header.Get(headers.XForwardedProto)
-			}
-			if r.URL.Scheme != "" {
-				return r.URL.Scheme
-			}
-			if r.TLS != nil {
-				return "https"
-			}
-			return "http"
-		}(), r.Host)
+		base := requestBase(r)
 		// Construct a lightweight, but plausible identity discovery document
 		resp := map[string]interface{}{
 			"identity": map[string]interface{}{
@@ -287,30 +798,272 @@ func NewDispatcher(e Endpoints) http.Handler {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		b, _ := json.Marshal(resp)
+		b := marshalJSON(resp, cfg.PrettyJSON)
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write(b)
 	}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	// Keystone v3 version document at the identity catalog endpoint
+	versionHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set(headers.ContentType, "application/json")
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		resp := map[string]interface{}{
+			"version": map[string]interface{}{
+				"id":      "v3.14",
+				"status":  "stable",
+				"updated": "2020-04-07T00:00:00Z",
+				"links": []map[string]string{
+					{"rel": "self", "href": requestBase(r) + IdentityVersionPath + "/"},
+				},
+				"media-types": []map[string]string{
+					{"base": "application/json", "type": "application/vnd.openstack.identity-v3+json"},
+				},
+			},
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(marshalJSON(resp, cfg.PrettyJSON))
+	}
+
+	var fixedResponses map[string][]byte
+	for i, rule := range append(append(respondRules{}, cfg.Respond...), cfg.ForceList...) {
+		b, err := os.ReadFile(rule.File)
+		if err != nil {
+			log.Fatalf("cannot read response for %s: %v", rule.Path, err)
+		}
+		if i >= len(cfg.Respond) && !isListDocument(b) {
+			log.Fatalf("forced list for %s in %s has no list member", rule.Path, rule.File)
+		}
+		if fixedResponses == nil {
+			fixedResponses = map[string][]byte{}
+		}
+		fixedResponses[rule.Path] = b
+	}
+
+	var recordings *recordingBuffer
+	if cfg.Recordings > 0 {
+		recordings = newRecordingBuffer(cfg.Recordings)
+	}
+
+	resets := append([]func(){}, cfg.resetHooks...)
+	resets = append(resets, counter.reset, tokens.clock.reset)
+	var failer *nthFailer
+	if len(cfg.FailOnNth) > 0 {
+		failer = newNthFailer(cfg.FailOnNth)
+		resets = append(resets, failer.reset)
+	}
+	if readDelay != nil {
+		resets = append(resets, readDelay.reset)
+	}
+	if outage != nil {
+		resets = append(resets, outage.reset)
+	}
+	var requestIDs *requestIDEcho
+	if cfg.RequireRequestIDEcho {
+		requestIDs = newRequestIDEcho(authTokenHeader(cfg))
+		resets = append(resets, requestIDs.reset)
+	}
+	if faults != nil {
+		resets = append(resets, faults.reset)
+	}
+
+	var adminHandler http.Handler
+	if cfg.EnableAdmin {
+		adminHandler = newAdminHandler(e, cfg, recordings, tokens.clock, faults, resets)
+	}
+
+	var webUI http.Handler
+	if cfg.WebUI {
+		webUI = newWebUIHandler(e, services, faults)
+	}
+
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
 		if path == "/v3/auth/tokens" {
-			tokenHandler(w, r)
+			noteRoute(r, "token")
+			tokenHandler.ServeHTTP(w, r)
+			return
+		}
+		if path == V2TokensPath {
+			noteRoute(r, "token")
+			v2TokenHandler.ServeHTTP(w, r)
 			return
 		}
 		if path == IdentityPath || strings.HasPrefix(path, "/v3/identity/") {
+			noteRoute(r, "identity")
 			identityHandler(w, r)
 			return
 		}
-		for _, p := range prefixes {
-			if strings.HasPrefix(path, p) {
-				routes[p].ServeHTTP(w, r)
-				return
-			}
+		if path == IdentityVersionPath || path == IdentityVersionPath+"/" {
+			noteRoute(r, "identity")
+			versionHandler(w, r)
+			return
 		}
-		// Default: 404 with some guidance
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusNotFound)
-		_, _ = w.Write([]byte("no route for path: " + path + "\n"))
+		if path == PingPath {
+			noteRoute(r, "admin")
+			ping(w, r)
+			return
+		}
+		if path == HealthzPath {
+			noteRoute(r, "admin")
+			health.serveHealthz(w, r, cfg.shutdown, cfg.PrettyJSON)
+			return
+		}
+		if path == StatusPath {
+			noteRoute(r, "admin")
+			counter.serveStatus(w, r, cfg.PrettyJSON)
+			return
+		}
+		if webUI != nil && path == WebUIPath {
+			noteRoute(r, "admin")
+			webUI.ServeHTTP(w, r)
+			return
+		}
+		if adminHandler != nil && strings.HasPrefix(path, AdminPathPrefix) {
+			noteRoute(r, "admin")
+			adminHandler.ServeHTTP(w, r)
+			return
+		}
+		if h, ok := hostRoutes[requestHostname(r)]; ok {
+			noteRoute(r, "host")
+			h.ServeHTTP(w, r)
+			return
+		}
+		if p, ok := matchRoute(prefixes, path, cfg.ExactRoutes); ok {
+			noteRoute(r, p)
+			routes[p].ServeHTTP(w, r)
+			return
+		}
+		notFound(w, r)
 	})
+
+	// Optional middleware, innermost first
+	if len(cfg.SyntheticLists) > 0 {
+		handler = serveSyntheticLists(handler, cfg.SyntheticLists)
+	}
+	if fixedResponses != nil {
+		handler = serveFixedResponses(handler, fixedResponses)
+	}
+	if len(cfg.Cache) > 0 {
+		handler = newResponseCache(cfg.Cache).wrap(handler)
+	}
+	if cfg.MaxImageBytes > 0 {
+		handler = limitImageUploads(handler, cfg.MaxImageBytes)
+	}
+	if len(cfg.Truncate) > 0 {
+		handler = truncateResponses(handler, cfg.Truncate)
+	}
+	if failer != nil {
+		handler = failer.wrap(handler)
+	}
+	if len(cfg.StatusOverrides) > 0 {
+		handler = overrideStatus(handler, cfg.StatusOverrides)
+	}
+	if cfg.ForceChunked {
+		handler = forceChunked(handler)
+	}
+	if cfg.BodyOn204 {
+		klog.Warningf("Sending bodies with 204 responses, violating HTTP")
+		handler = bodyOn204(handler)
+	}
+	handler = closeConnections(handler, cfg.ForceClose)
+	if cfg.ServerHeader != "" {
+		handler = setServerHeader(handler, cfg.ServerHeader)
+	}
+	if requestIDs != nil {
+		handler = requestIDs.wrap(handler)
+	}
+	if cfg.MaxConcurrent > 0 {
+		handler = limitConcurrency(handler, int64(cfg.MaxConcurrent), cfg.RetryAfterFormat)
+	}
+	if recordings != nil {
+		handler = recordTraffic(handler, recordings)
+	}
+	if cfg.ResetRate > 0 {
+		seed := cfg.ResetSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		klog.Infof("Resetting %v of the connections (seed %d)", float64(cfg.ResetRate), seed)
+		handler = resetConnections(handler, float64(cfg.ResetRate), seed)
+	}
+	if len(cfg.RegionURLs) > 0 || len(cfg.RegionDown) > 0 {
+		var regions []string
+		for _, region := range catalogRegions(cfg) {
+			regions = append(regions, region.Name)
+		}
+		handler = routeRegions(handler, regions, cfg.RegionDown)
+	}
+	if cfg.MaxURILength > 0 {
+		handler = limitURILength(handler, cfg.MaxURILength)
+	}
+	if len(cfg.AllowIPs) > 0 {
+		handler = allowClients(handler, cfg.AllowIPs)
+	}
+	if cfg.HTMLErrors {
+		handler = htmlErrors(handler)
+	}
+	if cfg.RequireUserAgent {
+		handler = requireUserAgent(handler)
+	}
+	if cfg.AccessLog {
+		handler = logRequests(handler)
+	}
+	if cfg.LogRequests {
+		handler = logRoutes(handler)
+	}
+	return counter.wrap(handler)
+}
+
+// matchRoute returns the first of the registered prefixes that matches path.
+// Prefixes must be ordered by descending length so that the longest, most
+// specific prefix wins. In exact mode, path must equal the registered entry,
+// unless the entry is an explicit wildcard ending in "*" that matches every
+// path starting with the part before the "*". Outside exact mode, a trailing
+// "*" is insignificant.
+func matchRoute(prefixes []string, path string, exact bool) (string, bool) {
+	for _, p := range prefixes {
+		prefix, wildcard := strings.CutSuffix(p, "*")
+		if exact && !wildcard {
+			if path == p {
+				return p, true
+			}
+			continue
+		}
+		if strings.HasPrefix(path, prefix) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// requestHostname returns the lowercase host name the client addressed, without
+// the port.
+func requestHostname(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// requestBase determines the external base URL of the dispatcher (scheme and
+// host) as seen by the client of r.
+func requestBase(r *http.Request) string {
+	scheme := "http"
+	switch {
+	case r.Header.Get(headers.XForwardedProto) != "":
+		scheme = r.Header.Get(headers.XForwardedProto)
+	case r.URL.Scheme != "":
+		scheme = r.URL.Scheme
+	case r.TLS != nil:
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
 }
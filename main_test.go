@@ -2,15 +2,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
 
 // buildDispatcherForTest builds a dispatcher using in-memory backend servers
 // and the NewDispatcher function from main.go.
-func buildDispatcherForTest(t *testing.T) http.Handler {
+func buildDispatcherForTest(t testing.TB, opts ...Option) http.Handler {
 	t.Helper()
 
 	mkBackend := func(name string) (*httptest.Server, string) {
@@ -45,7 +52,7 @@ func buildDispatcherForTest(t *testing.T) http.Handler {
 		BlockStorage: blockBase,
 		DNS:          dnsBase,
 		Image:        imageBase,
-	})
+	}, opts...)
 }
 
 func TestTokenEndpoint(t *testing.T) {
@@ -115,7 +122,13 @@ func TestRoutingAllPrefixes(t *testing.T) {
 		"/os-keypairs", "/os-keypairs/",
 		"/flavors", "/flavors/",
 		"/os-instance-actions/", // only with slash registered in dispatcher
+		"/os-services", "/os-services/",
+		"/os-floating-ip-pools", "/os-floating-ip-pools/",
+		"/os-floating-ips", "/os-floating-ips/",
+		"/os-aggregates", "/os-aggregates/",
 		"/images", "/images/",
+		"/v2/tasks", "/v2/tasks/",
+		"/v2/schemas/image", "/v2/schemas/images",
 		"/volumes", "/volumes/",
 		"/types", "/types/",
 		"/os-availability-zone",
@@ -127,9 +140,18 @@ func TestRoutingAllPrefixes(t *testing.T) {
 		"/security-group-rules", "/security-group-rules/",
 		"/subnets", "/subnets/",
 		"/floatingips", "/floatingips/",
+		"/v2.0/network-ip-availabilities", "/v2.0/network-ip-availabilities/",
+		"/v2.0/address-scopes", "/v2.0/address-scopes/",
+		"/v2.0/subnetpools", "/v2.0/subnetpools/",
 		"/lbaas/listeners", "/lbaas/listeners/",
 		"/lbaas/loadbalancers", "/lbaas/loadbalancers/",
 		"/lbaas/pools", "/lbaas/pools/",
+		"/lbaas/quotas", "/lbaas/quotas/",
+		"/lbaas/flavors", "/lbaas/flavors/",
+		"/os-quota-sets", "/os-quota-sets/",
+		"/v2.0/auto-allocated-topology", "/v2.0/auto-allocated-topology/",
+		"/v2.0/agents", "/v2.0/agents/",
+		"/v2.0/rbac-policies", "/v2.0/rbac-policies/",
 	}
 
 	client := &http.Client{Timeout: 10 * time.Second}
@@ -160,3 +182,451 @@ func TestUnknownPath404(t *testing.T) {
 		t.Fatalf("expected 404 for unknown path, got %d", resp.StatusCode)
 	}
 }
+
+func TestVolumeTypeAccessPassthrough(t *testing.T) {
+	// The block storage backend echoes method, path and body, so the test can
+	// verify all of them survive proxying.
+	block := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(r.Method + " " + r.URL.Path + " " + string(b)))
+	}))
+	defer block.Close()
+	ts := httptest.NewServer(NewDispatcher(Endpoints{BlockStorage: block.URL}))
+	defer ts.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{method: http.MethodGet, path: "/types/type-1/os-volume-type-access"},
+		{method: http.MethodPost, path: "/types/type-1/action", body: `{"addProjectAccess": {"project": "p-1"}}`},
+		{method: http.MethodPost, path: "/types/type-1/action", body: `{"removeProjectAccess": {"project": "p-1"}}`},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", tt.method, tt.path, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		//nolint:errcheck // Response body Close() call
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("%s %s: expected 202 from backend, got %d", tt.method, tt.path, resp.StatusCode)
+		}
+		if want := tt.method + " " + tt.path + " " + tt.body; string(b) != want {
+			t.Errorf("expected backend to see %q, got %q", want, b)
+		}
+	}
+}
+
+func TestExactRoutes(t *testing.T) {
+	tests := []struct {
+		path       string
+		wantPrefix int
+		wantExact  int
+	}{
+		{path: "/servers", wantPrefix: http.StatusOK, wantExact: http.StatusOK},
+		{path: "/servers/", wantPrefix: http.StatusOK, wantExact: http.StatusOK},
+		{path: "/servers/123", wantPrefix: http.StatusOK, wantExact: http.StatusNotFound},
+	}
+	prefixTS := httptest.NewServer(buildDispatcherForTest(t))
+	defer prefixTS.Close()
+	exactTS := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.ExactRoutes = true }))
+	defer exactTS.Close()
+
+	for _, tt := range tests {
+		for _, mode := range []struct {
+			url  string
+			want int
+		}{{prefixTS.URL, tt.wantPrefix}, {exactTS.URL, tt.wantExact}} {
+			resp, err := http.Get(mode.url + tt.path)
+			if err != nil {
+				t.Fatalf("GET %s failed: %v", tt.path, err)
+			}
+			//nolint:errcheck // Response body Close() call
+			_ = resp.Body.Close()
+			if resp.StatusCode != mode.want {
+				t.Errorf("GET %s: expected %d, got %d", tt.path, mode.want, resp.StatusCode)
+			}
+		}
+	}
+}
+
+func TestMatchRouteWildcard(t *testing.T) {
+	prefixes := []string{"/servers/*", "/servers"}
+	if p, ok := matchRoute(prefixes, "/servers/123", true); !ok || p != "/servers/*" {
+		t.Errorf("expected wildcard match in exact mode, got %q, %v", p, ok)
+	}
+	if p, ok := matchRoute(prefixes, "/servers", true); !ok || p != "/servers" {
+		t.Errorf("expected exact match, got %q, %v", p, ok)
+	}
+	if _, ok := matchRoute(prefixes, "/serversX", true); ok {
+		t.Errorf("expected no match for /serversX in exact mode")
+	}
+	if p, ok := matchRoute(prefixes, "/serversX", false); !ok || p != "/servers" {
+		t.Errorf("expected prefix match, got %q, %v", p, ok)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxHeaderBytes = 1024
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newDispatcherServer("", buildDispatcherForTest(t), cfg)
+	ts.Start()
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		token string
+		want  int
+	}{
+		{token: "small", want: http.StatusOK},
+		// Well beyond the limit plus the server's 4096 bytes of slack.
+		{token: strings.Repeat("x", 16<<10), want: http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/flavors", nil)
+		req.Header.Set("X-Auth-Token", tc.token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		//nolint:errcheck // Response body Close() call
+		_ = resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("token of %d bytes: expected %d, got %d", len(tc.token), tc.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestTLSRestrictions(t *testing.T) {
+	cfg := DefaultConfig()
+	_ = cfg.TLSMinVersion.Set("1.2")
+	if err := cfg.TLSCiphers.Set("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(buildDispatcherForTest(t))
+	ts.TLS = newDispatcherServer("", ts.Config.Handler, cfg).TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(client *tls.Config) error {
+		client.RootCAs = ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: client}}
+		resp, err := c.Get(ts.URL + "/servers")
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+	for _, tc := range []struct {
+		name   string
+		client *tls.Config
+		ok     bool
+	}{
+		// The client would refuse TLS 1.1 by itself without MinVersion.
+		{name: "TLS 1.1", client: &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}},
+		{name: "other cipher", client: &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}}},
+		{name: "allowed cipher", client: &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}, ok: true},
+		{name: "TLS 1.3", client: &tls.Config{MinVersion: tls.VersionTLS13}, ok: true},
+	} {
+		if err := get(tc.client); (err == nil) != tc.ok {
+			t.Errorf("%s: expected success %v, got error %v", tc.name, tc.ok, err)
+		}
+	}
+
+	// TLS 1.0 and later, which Go's server would not accept by default.
+	legacy := DefaultConfig()
+	_ = legacy.TLSMinVersion.Set("1.0")
+	ts.Close()
+	ts = httptest.NewUnstartedServer(buildDispatcherForTest(t))
+	ts.TLS = newDispatcherServer("", ts.Config.Handler, legacy).TLSConfig
+	ts.StartTLS()
+	if err := get(&tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}); err != nil {
+		t.Errorf("expected a TLS 1.1 client to succeed with -tls-min-version 1.0, got %v", err)
+	}
+
+	// TLS 1.3 only.
+	_ = cfg.TLSMinVersion.Set("1.3")
+	ts.Close()
+	ts = httptest.NewUnstartedServer(buildDispatcherForTest(t))
+	ts.TLS = newDispatcherServer("", ts.Config.Handler, cfg).TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+	if err := get(&tls.Config{MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Errorf("expected a TLS 1.2 client to fail against a TLS 1.3-only server")
+	}
+
+	var v tlsVersion
+	var c tlsCiphers
+	if v.Set("1.4") == nil || c.Set("TLS_NOPE") == nil || c.Set("TLS_AES_128_GCM_SHA256") == nil {
+		t.Errorf("expected invalid TLS settings to be rejected")
+	}
+}
+
+func TestRequireSNI(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RequireSNI = "mock.openstack.local"
+	ts := httptest.NewUnstartedServer(buildDispatcherForTest(t))
+	ts.TLS = newDispatcherServer("", ts.Config.Handler, cfg).TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		serverName string
+		ok         bool
+	}{
+		{serverName: "mock.openstack.local", ok: true},
+		{serverName: "MOCK.openstack.local", ok: true},
+		{serverName: "other.openstack.local"},
+		// Clients connecting by IP address send no SNI.
+		{serverName: ""},
+	} {
+		// The test certificate is not issued for the names.
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{ServerName: tc.serverName, InsecureSkipVerify: true}}}
+		resp, err := c.Get(ts.URL + "/servers")
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("SNI %q: expected success %v, got error %v", tc.serverName, tc.ok, err)
+		}
+	}
+}
+
+func TestNotFoundBody(t *testing.T) {
+	page := "<html><body><h1>404 Not Found</h1>nginx</body></html>\n"
+	path := filepath.Join(t.TempDir(), "404.html")
+	if err := os.WriteFile(path, []byte(page), 0o600); err != nil {
+		t.Fatalf("writing 404 page failed: %v", err)
+	}
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.NotFoundBody = path }))
+	defer ts.Close()
+
+	resp, body := doRequest(t, http.MethodGet, ts.URL+"/does/not/exist", nil)
+	if resp.StatusCode != http.StatusNotFound || body != page {
+		t.Errorf("expected 404 with the custom page, got %d %q", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("expected the default content type for the custom page, got %q", ct)
+	}
+}
+
+func TestQuotaSetRouting(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t))
+	defer ts.Close()
+
+	for path, want := range map[string]string{
+		"/os-quota-sets/p1":                            "compute: /os-quota-sets/p1",
+		"/os-quota-sets/p1?service=volume":             "blockstorage: /os-quota-sets/p1",
+		"/v3/mock-project-id/os-quota-sets/p1":         "blockstorage: /v3/mock-project-id/os-quota-sets/p1",
+		"/v3/mock-project-id/os-quota-sets/p1?usage=1": "blockstorage: /v3/mock-project-id/os-quota-sets/p1",
+	} {
+		if _, body := doRequest(t, http.MethodGet, ts.URL+path, nil); body != want {
+			t.Errorf("%s: expected %q, got %q", path, want, body)
+		}
+	}
+}
+
+func TestHostRouting(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) {
+		c.HostRouting = hostRoutes{"nova.example": "compute", "neutron.example": "networking"}
+	}))
+	defer ts.Close()
+
+	get := func(host, path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s for %s failed: %v", path, host, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	// Routed hosts reach their backend whatever the path, with or without port.
+	for host, want := range map[string]string{
+		"nova.example":         "compute: /v2.1/anything",
+		"NOVA.example:8080":    "compute: /v2.1/anything",
+		"neutron.example:9696": "networking: /v2.1/anything",
+	} {
+		if status, body := get(host, "/v2.1/anything"); status != http.StatusOK || body != want {
+			t.Errorf("%s: expected 200 %q, got %d %q", host, want, status, body)
+		}
+	}
+
+	// Other hosts fall back to path routing.
+	if _, body := get("other.example", "/ports"); body != "networking: /ports" {
+		t.Errorf("expected path routing for unknown host, got %q", body)
+	}
+	if status, _ := get("other.example", "/v2.1/anything"); status != http.StatusNotFound {
+		t.Errorf("expected 404 for unrouted path on unknown host, got %d", status)
+	}
+
+	// The dispatcher's own endpoints stay reachable on routed hosts.
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/v3/auth/tokens", strings.NewReader("{}"))
+	req.Host = "nova.example"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("token request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected 201 for token request on routed host, got %d", resp.StatusCode)
+	}
+}
+
+func TestHostRoutesFlag(t *testing.T) {
+	var m hostRoutes
+	if err := m.Set("Nova.example=compute,swift.example=objectstore"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m["nova.example"] != "compute" || m.String() != "nova.example=compute,swift.example=objectstore" {
+		t.Errorf("unexpected routes %v", m)
+	}
+	for _, v := range []string{"nova.example", "nova.example=unknown", "nova.example:80=compute"} {
+		if err := m.Set(v); err == nil {
+			t.Errorf("expected error for %q", v)
+		}
+	}
+}
+
+func TestRegionDown(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) {
+		_ = c.RegionURLs.Set("RegionTwo=http://127.0.0.1:1/RegionTwo")
+		_ = c.RegionDown.Set("RegionTwo")
+	}))
+	defer ts.Close()
+
+	get := func(path, region string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		if region != "" {
+			req.Header.Set(regionHeader, region)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	for _, tc := range []struct {
+		path, region string
+		want         int
+		body         string
+	}{
+		{path: "/servers", want: http.StatusOK, body: "compute: /servers"},
+		{path: "/RegionOne/servers", want: http.StatusOK, body: "compute: /servers"},
+		{path: "/servers", region: "RegionOne", want: http.StatusOK, body: "compute: /servers"},
+		{path: "/RegionTwo/servers", want: http.StatusServiceUnavailable},
+		{path: "/servers", region: "RegionTwo", want: http.StatusServiceUnavailable},
+	} {
+		status, body := get(tc.path, tc.region)
+		if status != tc.want || (tc.body != "" && body != tc.body) {
+			t.Errorf("%s (region %q): expected %d %q, got %d %q", tc.path, tc.region, tc.want, tc.body, status, body)
+		}
+	}
+}
+
+func TestFirstRequestDelay(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FirstRequestDelay = 300 * time.Millisecond
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newDispatcherServer("", buildDispatcherForTest(t), cfg)
+	ts.Start()
+	defer ts.Close()
+
+	client := ts.Client()
+	get := func() time.Duration {
+		start := time.Now()
+		resp, err := client.Get(ts.URL + "/flavors")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		//nolint:errcheck // Response body Close() call
+		_ = resp.Body.Close()
+		return time.Since(start)
+	}
+	if d := get(); d < cfg.FirstRequestDelay {
+		t.Errorf("expected the first request to take at least %s, took %s", cfg.FirstRequestDelay, d)
+	}
+	for i := 0; i < 3; i++ {
+		if d := get(); d >= cfg.FirstRequestDelay {
+			t.Errorf("expected request %d on the kept-alive connection to be fast, took %s", i+2, d)
+		}
+	}
+
+	// A new connection is delayed again.
+	client.CloseIdleConnections()
+	if d := get(); d < cfg.FirstRequestDelay {
+		t.Errorf("expected the first request on a new connection to take at least %s, took %s", cfg.FirstRequestDelay, d)
+	}
+}
+
+func TestAcceptDelay(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	ts := httptest.NewUnstartedServer(buildDispatcherForTest(t))
+	ts.Listener = &delayedListener{Listener: ts.Listener, delay: delay}
+	ts.StartTLS()
+	defer ts.Close()
+
+	client := ts.Client()
+	// get returns the time until the connection is established, including
+	// the TLS handshake, and whether it was reused.
+	get := func() (time.Duration, bool) {
+		var start time.Time
+		var established time.Duration
+		reused := false
+		trace := &httptrace.ClientTrace{
+			ConnectStart:     func(string, string) { start = time.Now() },
+			TLSHandshakeDone: func(tls.ConnectionState, error) { established = time.Since(start) },
+			GotConn:          func(info httptrace.GotConnInfo) { reused = info.Reused },
+		}
+		req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, ts.URL+"/flavors", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		//nolint:errcheck // Response body Close() call
+		_ = resp.Body.Close()
+		return established, reused
+	}
+	if established, _ := get(); established < delay {
+		t.Errorf("expected establishing the connection to take at least %s, took %s", delay, established)
+	}
+	start := time.Now()
+	if _, reused := get(); !reused || time.Since(start) >= delay {
+		t.Errorf("expected a fast request on the established connection, reused %v, took %s", reused, time.Since(start))
+	}
+}
+
+func TestWithRoutes(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, WithRoutes(
+		Route{Prefix: "/v2.0/trunks", Service: "networking"},
+		// Longer than the built-in /servers/, so it wins.
+		Route{Prefix: "/servers/images", Service: "image"},
+	)))
+	defer ts.Close()
+
+	for path, want := range map[string]string{
+		"/v2.0/trunks":      "networking",
+		"/v2.0/trunks/1":    "networking",
+		"/servers/images/1": "image",
+		"/servers/1":        "compute",
+	} {
+		resp, body := doRequest(t, http.MethodGet, ts.URL+path, nil)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Backend") != want {
+			t.Errorf("%s: expected %s, got %d from %q: %s", path, want, resp.StatusCode, resp.Header.Get("X-Backend"), body)
+		}
+	}
+}
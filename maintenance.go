@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-http-utils/headers"
+)
+
+// maintenanceWindow takes the backend of Service out of service from Start to
+// End, both relative to the start of the dispatcher.
+type maintenanceWindow struct {
+	Service string
+	Start   time.Duration
+	End     time.Duration
+}
+
+// maintenanceWindows is a flag.Value holding a comma-separated list of
+// service=start+duration entries, e.g. "compute=30s+2m".
+type maintenanceWindows []maintenanceWindow
+
+func (l *maintenanceWindows) String() string {
+	if l == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*l))
+	for _, w := range *l {
+		items = append(items, fmt.Sprintf("%s=%s+%s", w.Service, w.Start, w.End-w.Start))
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *maintenanceWindows) Set(v string) error {
+	var items stringList
+	_ = items.Set(v)
+	*l = nil
+	for _, item := range items {
+		svc, window, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("missing service in maintenance window %q (want service=start+duration)", item)
+		}
+		if !isBackendService(svc) {
+			return fmt.Errorf("unknown service %q in maintenance window %q (want one of %s)", svc, item, strings.Join(backendServices, ", "))
+		}
+		start, duration, ok := strings.Cut(window, "+")
+		if !ok {
+			return fmt.Errorf("invalid maintenance window %q (want service=start+duration)", item)
+		}
+		s, err := time.ParseDuration(start)
+		if err != nil || s < 0 {
+			return fmt.Errorf("invalid start in maintenance window %q", item)
+		}
+		d, err := time.ParseDuration(duration)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid duration in maintenance window %q", item)
+		}
+		*l = append(*l, maintenanceWindow{Service: svc, Start: s, End: s + d})
+	}
+	return nil
+}
+
+// maintenanceSchedule tells which services are in maintenance. A nil
+// schedule has no maintenance windows.
+type maintenanceSchedule struct {
+	start   time.Time
+	windows maintenanceWindows
+}
+
+// newMaintenanceSchedule returns the schedule of windows starting now, or
+// nil if there are none.
+func newMaintenanceSchedule(windows maintenanceWindows) *maintenanceSchedule {
+	if len(windows) == 0 {
+		return nil
+	}
+	return &maintenanceSchedule{start: time.Now(), windows: windows}
+}
+
+// active reports whether service is in maintenance and how long the
+// maintenance lasts.
+func (s *maintenanceSchedule) active(service string) (time.Duration, bool) {
+	if s == nil {
+		return 0, false
+	}
+	elapsed := time.Since(s.start)
+	for _, w := range s.windows {
+		if w.Service == service && elapsed >= w.Start && elapsed < w.End {
+			return w.End - elapsed, true
+		}
+	}
+	return 0, false
+}
+
+// maintenanceTransport answers requests with 503 while the service is in
+// maintenance instead of sending them to the backend.
+type maintenanceTransport struct {
+	next     http.RoundTripper
+	service  string
+	schedule *maintenanceSchedule
+	format   RetryAfterFormat
+}
+
+func (t *maintenanceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	remaining, ok := t.schedule.active(t.service)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"error": errorBody(http.StatusServiceUnavailable, fmt.Sprintf("service %s is in maintenance", t.service)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	h := http.Header{}
+	h.Set(headers.ContentType, "application/json")
+	setRetryAfter(h, t.format, remaining)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable)),
+		StatusCode:    http.StatusServiceUnavailable,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Request:       req,
+	}, nil
+}
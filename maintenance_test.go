@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// catalogTypes returns the service types in the catalog of a new token.
+func catalogTypes(t *testing.T, url string) map[string]bool {
+	t.Helper()
+	var doc tokenDocument
+	resp, err := http.Post(url+"/v3/auth/tokens", "application/json", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("decoding token failed: %v", err)
+	}
+	types := map[string]bool{}
+	for _, svc := range doc.Token.Catalog {
+		types[svc.Type] = true
+	}
+	return types
+}
+
+func TestMaintenanceHideCatalog(t *testing.T) {
+	const window = 300 * time.Millisecond
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) {
+		_ = c.Maintenance.Set("compute=0s+" + window.String())
+		c.MaintenanceHideCatalog = true
+	}))
+	defer ts.Close()
+	end := time.Now().Add(window)
+
+	types := catalogTypes(t, ts.URL)
+	if types["compute"] || !types["network"] {
+		t.Errorf("expected compute to be hidden during maintenance, got %v", types)
+	}
+	resp, _ := doRequest(t, http.MethodGet, ts.URL+"/servers", nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("expected 503 with Retry-After during maintenance, got %d", resp.StatusCode)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/networks", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected other services to be available, got %d", resp.StatusCode)
+	}
+
+	time.Sleep(time.Until(end) + 50*time.Millisecond)
+	if types := catalogTypes(t, ts.URL); !types["compute"] {
+		t.Errorf("expected compute to reappear after maintenance, got %v", types)
+	}
+	if resp, body := doRequest(t, http.MethodGet, ts.URL+"/servers", nil); resp.StatusCode != http.StatusOK || body != "compute: /servers" {
+		t.Errorf("expected the backend after maintenance, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestMaintenanceWithoutHideCatalog(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { _ = c.Maintenance.Set("compute=0s+1h") }))
+	defer ts.Close()
+
+	if types := catalogTypes(t, ts.URL); !types["compute"] {
+		t.Errorf("expected compute in the catalog, got %v", types)
+	}
+
+	var l maintenanceWindows
+	for _, v := range []string{"compute", "nova=0s+1m", "compute=1m", "compute=0s+0s", "compute=-1s+1m"} {
+		if err := l.Set(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
@@ -0,0 +1,902 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"k8s.io/klog/v2"
+)
+
+// imageFilePath matches the Glance image data upload path.
+var imageFilePath = regexp.MustCompile(`^/v2/images/[^/]+/file$`)
+
+// limitImageUploads rejects image data uploads (PUT /v2/images/{id}/file)
+// larger than max bytes with 413. Uploads without a Content-Length are
+// buffered up to the limit to determine their size.
+func limitImageUploads(next http.Handler, max int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || !imageFilePath.MatchString(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tooLarge := func() {
+			writeJSONError(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Image exceeds the maximum upload size of %d bytes", max))
+		}
+		if r.ContentLength > max {
+			tooLarge()
+			return
+		}
+		if r.ContentLength < 0 {
+			b, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("reading image data failed: %v", err))
+				return
+			}
+			if int64(len(b)) > max {
+				tooLarge()
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(b))
+			r.ContentLength = int64(len(b))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MockCloseHeader is the request header that asks the dispatcher to close the
+// connection after the response.
+const MockCloseHeader = "X-Mock-Close"
+
+// closeConnections sets "Connection: close" on responses to requests carrying
+// MockCloseHeader, or on all responses if always is set, so that clients have
+// to establish a new connection for their next request.
+func closeConnections(next http.Handler, always bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if always || r.Header.Get(MockCloseHeader) != "" {
+			w.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// resetConnections aborts the connection of the given fraction of requests
+// without any response, simulating network failures. The connection is closed
+// with an RST instead of an orderly shutdown where possible. The requests to
+// reset are chosen by a random number generator seeded with seed.
+func resetConnections(next http.Handler, rate float64, seed int64) http.Handler {
+	var mu sync.Mutex
+	rng := rand.New(rand.NewSource(seed))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		reset := rng.Float64() < rate
+		mu.Unlock()
+		if !reset {
+			next.ServeHTTP(w, r)
+			return
+		}
+		klog.V(2).Infof("resetting connection for %s %s", r.Method, r.URL.Path)
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			panic(http.ErrAbortHandler)
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			_ = tc.SetLinger(0)
+		}
+		_ = conn.Close()
+	})
+}
+
+// shedRetryAfter is the delay suggested to clients whose request was shed.
+const shedRetryAfter = time.Second
+
+// limitConcurrency answers requests with 503 while max requests are in
+// flight, instead of queuing them. Liveness checks at PingPath are exempt.
+func limitConcurrency(next http.Handler, max int64, format RetryAfterFormat) http.Handler {
+	var active atomic.Int64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == PingPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer active.Add(-1)
+		if n := active.Add(1); n > max {
+			setRetryAfter(w.Header(), format, shedRetryAfter)
+			writeJSONError(w, http.StatusServiceUnavailable,
+				fmt.Sprintf("too many concurrent requests (limit %d)", max))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setServerHeader sets the Server header of all responses to server, like
+// the web server in front of a real OpenStack service would.
+func setServerHeader(next http.Handler, server string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", server)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// regionHeader selects the region of requests without region path prefix.
+const regionHeader = "X-Mock-Region"
+
+// routeRegions strips a leading /<region> of the given regions from request
+// paths, so that regional catalog URLs like http://<dispatcher>/RegionTwo
+// reach the dispatcher's routes, and answers the requests for the regions in
+// down with 503. The region of a request is taken from the path prefix or
+// the X-Mock-Region header.
+func routeRegions(next http.Handler, regions, down []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		region := r.Header.Get(regionHeader)
+		for _, name := range regions {
+			if rest, ok := strings.CutPrefix(r.URL.Path, "/"+name); ok && (rest == "" || rest[0] == '/') {
+				region = name
+				r = r.Clone(r.Context())
+				r.URL.Path = rest
+				r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, "/"+name)
+				if r.URL.Path == "" {
+					r.URL.Path = "/"
+				}
+				break
+			}
+		}
+		if region != "" && slices.Contains(down, region) {
+			writeJSONError(w, http.StatusServiceUnavailable, fmt.Sprintf("region %s is unavailable", region))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireUserAgent answers requests without User-Agent header with 400, as
+// they usually come from misconfigured clients.
+func requireUserAgent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") == "" {
+			writeJSONError(w, http.StatusBadRequest, "missing User-Agent header")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logRequests writes an access log line per request with the client address,
+// method, URI, status, duration and User-Agent.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+		klog.Infof("%s %s %s %d %v %q", r.RemoteAddr, r.Method, r.RequestURI, sw.status, time.Since(start).Round(time.Microsecond), r.UserAgent())
+	})
+}
+
+// routeLogKey is the context key of the routeLog of a request.
+type routeLogKey struct{}
+
+// routeLog is where the dispatcher sent a request: the matched route and the
+// backend service that answered it, if any.
+type routeLog struct {
+	route   string
+	backend string
+}
+
+// noteRoute records the route the dispatcher matched for r, if logRoutes logs
+// r.
+func noteRoute(r *http.Request, route string) {
+	if l, ok := r.Context().Value(routeLogKey{}).(*routeLog); ok {
+		l.route = route
+	}
+}
+
+// noteBackend records the backend service r is proxied to, if logRoutes logs
+// r. The proxy's Director calls it with the outgoing request, which shares the
+// context of the incoming one.
+func noteBackend(r *http.Request, backend string) {
+	if l, ok := r.Context().Value(routeLogKey{}).(*routeLog); ok {
+		l.backend = backend
+	}
+}
+
+// logRoutes logs every request with method, path, the route the dispatcher
+// matched ("token", "identity", "admin", "host", a route prefix or "404"),
+// the backend service, status and duration. The lines are logged at
+// verbosity 0, as the flag already opts into them. Requests answered before
+// they reach the dispatcher, e.g. by the cache, log "-" for route and
+// backend.
+func logRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := &routeLog{route: "-", backend: "-"}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), routeLogKey{}, l)))
+		klog.V(0).Infof("%s %s route=%s backend=%s status=%d latency=%v", r.Method, r.URL.Path, l.route, l.backend, sw.status, time.Since(start).Round(time.Microsecond))
+	})
+}
+
+// statusWriter captures the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// limitURILength answers requests whose request URI, i.e. path and query, is
+// longer than max bytes with 414, like gateways in front of OpenStack APIs.
+func limitURILength(next http.Handler, max int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := len(r.RequestURI); n > max {
+			writeJSONError(w, http.StatusRequestURITooLong,
+				fmt.Sprintf("request URI of %d bytes exceeds the limit of %d bytes", n, max))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowClients answers requests from clients outside the allowed networks
+// with 403. The client address is taken from the connection's remote address.
+func allowClients(next http.Handler, allowed []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			for _, n := range allowed {
+				if n.Contains(ip) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		writeJSONError(w, http.StatusForbidden, fmt.Sprintf("client %s is not allowed", host))
+	})
+}
+
+// proxyRetryAfter is the delay suggested to clients after a failed backend
+// request.
+const proxyRetryAfter = time.Second
+
+// setRetryAfter sets the Retry-After header to d in the given format.
+func setRetryAfter(h http.Header, format RetryAfterFormat, d time.Duration) {
+	if format == RetryAfterDate {
+		h.Set("Retry-After", time.Now().Add(d).UTC().Format(http.TimeFormat))
+		return
+	}
+	h.Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// truncateResponses sends only the first bytes of the responses to requests
+// whose path matches one of rules and then aborts the connection, simulating
+// a backend crashing mid-response. Clients see a short read, e.g. an
+// unexpected EOF or a JSON parse error.
+func truncateResponses(next http.Handler, rules truncateRules) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := rules.lookup(r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tw := &truncatingWriter{ResponseWriter: w, remaining: limit}
+		next.ServeHTTP(tw, r)
+		if tw.truncated {
+			klog.V(2).Infof("truncated response to %s %s after %d bytes", r.Method, r.URL.Path, limit)
+			_ = http.NewResponseController(w).Flush()
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// truncatingWriter passes the first remaining bytes of the body on and drops
+// the rest.
+type truncatingWriter struct {
+	http.ResponseWriter
+	remaining int64
+	truncated bool
+}
+
+func (w *truncatingWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > w.remaining {
+		w.truncated = true
+		n, err := w.ResponseWriter.Write(b[:w.remaining])
+		w.remaining -= int64(n)
+		if err != nil {
+			return n, err
+		}
+		// Pretend success, so that the handler finishes normally.
+		return len(b), nil
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.remaining -= int64(n)
+	return n, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *truncatingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// forceChunked sends all responses without Content-Length, splitting each
+// body write in two and flushing after each part, so that the server has to
+// use chunked transfer encoding even for small bodies.
+func forceChunked(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&chunkingWriter{ResponseWriter: w}, r)
+	})
+}
+
+// chunkingWriter drops the Content-Length header and flushes every write.
+type chunkingWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *chunkingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Del("Content-Length")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *chunkingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	written := 0
+	for _, part := range [][]byte{b[:len(b)/2], b[len(b)/2:]} {
+		if len(part) == 0 {
+			continue
+		}
+		n, err := w.ResponseWriter.Write(part)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		_ = http.NewResponseController(w.ResponseWriter).Flush()
+	}
+	return written, nil
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *chunkingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// noContentBody is the body bodyOn204 sends with 204 responses.
+const noContentBody = `{"message": "No Content"}`
+
+// bodyOn204 sends noContentBody with 204 responses, which HTTP forbids and
+// Go's server refuses to do. The response is written to the hijacked
+// connection, which is closed afterwards.
+func bodyOn204(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&noContentBodyWriter{ResponseWriter: w}, r)
+	})
+}
+
+// noContentBodyWriter takes over the connection on WriteHeader(204).
+type noContentBodyWriter struct {
+	http.ResponseWriter
+	hijacked bool
+}
+
+func (w *noContentBodyWriter) WriteHeader(status int) {
+	if status != http.StatusNoContent || w.hijacked {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		klog.V(2).Infof("cannot send a body with 204: %v", err)
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.hijacked = true
+	defer conn.Close()
+	h := w.Header().Clone()
+	h.Set("Content-Type", "application/json")
+	h.Set("Content-Length", strconv.Itoa(len(noContentBody)))
+	h.Set("Connection", "close")
+	h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	_, _ = fmt.Fprintf(rw, "HTTP/1.1 204 %s\r\n", http.StatusText(http.StatusNoContent))
+	_ = h.Write(rw)
+	_, _ = rw.WriteString("\r\n" + noContentBody)
+	_ = rw.Flush()
+}
+
+func (w *noContentBodyWriter) Write(b []byte) (int, error) {
+	if w.hijacked {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *noContentBodyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// throttleChunksPerSecond is the number of chunks per second throttled
+// response bodies are split into.
+const throttleChunksPerSecond = 10
+
+// throttleBodies sends response bodies at rate bytes per second, in flushed
+// chunks. Sending stops when the request context is canceled.
+func throttleBodies(next http.Handler, rate int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&throttledWriter{ResponseWriter: w, ctx: r.Context(), rate: rate}, r)
+	})
+}
+
+// throttledWriter delays each chunk until the rate allows sending it.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	if w.start.IsZero() {
+		w.start = time.Now()
+	}
+	chunk := max(w.rate/throttleChunksPerSecond, 1)
+	n := 0
+	for n < len(b) {
+		end := min(n+int(chunk), len(b))
+		// A chunk is due once the rate allows for it completely.
+		sent := w.written + int64(end-n)
+		due := w.start.Add(time.Duration(float64(sent) / float64(w.rate) * float64(time.Second)))
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-timer.C:
+		case <-w.ctx.Done():
+			timer.Stop()
+			return n, w.ctx.Err()
+		}
+		m, err := w.ResponseWriter.Write(b[n:end])
+		n += m
+		w.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+		_ = http.NewResponseController(w.ResponseWriter).Flush()
+	}
+	return n, nil
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// lowercaseHeaders sends the response header names in lowercase. Go's server
+// writes header map keys as they are, but only recognizes the canonical keys
+// of the headers it handles itself: the framing headers are left alone, and
+// Content-Type and Date keep an empty canonical entry so that the server does
+// not add them a second time.
+func lowercaseHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&lowercaseHeaderWriter{ResponseWriter: w}, r)
+	})
+}
+
+// lowercaseHeaderWriter rewrites the header names on WriteHeader.
+type lowercaseHeaderWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *lowercaseHeaderWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		if _, ok := h["Date"]; !ok {
+			h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		}
+		for k, v := range h {
+			switch lower := strings.ToLower(k); {
+			case lower == k || v == nil:
+			case k == "Content-Length" || k == "Transfer-Encoding" || k == "Connection":
+			case k == "Content-Type" || k == "Date":
+				h[lower] = v
+				h[k] = nil
+			default:
+				h[lower] = v
+				delete(h, k)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *lowercaseHeaderWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *lowercaseHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requireHeaders answers requests without a token in header with 400, as
+// well as POST and PUT requests with a body that is not JSON if jsonBodies is
+// set. Image data uploads may have any content type.
+func requireHeaders(next http.Handler, header string, jsonBodies bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(header) == "" {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("missing %s header", header))
+			return
+		}
+		if jsonBodies && (r.Method == http.MethodPost || r.Method == http.MethodPut) &&
+			r.ContentLength != 0 && !imageFilePath.MatchString(r.URL.Path) {
+			ct := r.Header.Get("Content-Type")
+			if mt, _, err := mime.ParseMediaType(ct); err != nil || mt != "application/json" {
+				writeJSONError(w, http.StatusBadRequest,
+					fmt.Sprintf("request body must have Content-Type application/json, got %q", ct))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectEmptyBodies answers POST and PUT requests with an empty body with 400,
+// as some services do. Bodies of unknown length are peeked at to determine
+// whether they are empty.
+func rejectEmptyBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut || r.ContentLength > 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength < 0 {
+			var b [1]byte
+			n, err := io.ReadFull(r.Body, b[:])
+			if n > 0 {
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(b[:n]), r.Body), r.Body}
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err != io.EOF {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("reading request body failed: %v", err))
+				return
+			}
+		}
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%s %s requires a request body", r.Method, r.URL.Path))
+	})
+}
+
+// overrideStatus answers the requests matching a rule with the rule's status
+// and an error envelope, without passing them on.
+func overrideStatus(next http.Handler, rules statusOverrides) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status, ok := rules.lookup(r.URL.Path); ok {
+			writeJSONError(w, status, fmt.Sprintf("status of %s overridden to %d", r.URL.Path, status))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// nthFailer answers exactly the Nth request matching each of its rules with
+// 500, for testing that clients retry idempotently.
+type nthFailer struct {
+	rules  failRules
+	counts []atomic.Int64
+}
+
+func newNthFailer(rules failRules) *nthFailer {
+	return &nthFailer{rules: rules, counts: make([]atomic.Int64, len(rules))}
+}
+
+// wrap counts the requests per rule; requests matching several rules count
+// for the one with the longest prefix.
+func (f *nthFailer) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i, ok := f.rules.lookup(r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rule := f.rules[i]
+		if n := f.counts[i].Add(1); n == rule.N {
+			writeJSONError(w, http.StatusInternalServerError,
+				fmt.Sprintf("injected failure of request %d to %s", n, rule.Prefix))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reset restarts counting for all rules.
+func (f *nthFailer) reset() {
+	for i := range f.counts {
+		f.counts[i].Store(0)
+	}
+}
+
+// requestIDHeader is the header OpenStack services return the ID of each
+// request in, and clients pass it back in to correlate requests.
+const requestIDHeader = "X-Openstack-Request-Id"
+
+// maxSessionRequestIDs is the number of most recent IDs per session that
+// requestIDEcho accepts.
+const maxSessionRequestIDs = 32
+
+// requestIDEcho issues a request ID with every response and requires the
+// follow-up requests of a session to carry one of the IDs issued in it.
+// A session is identified by the client's token, or by its IP address for
+// requests without a token; the first request of a session needs no ID.
+// Only the most recent maxSessionRequestIDs IDs of a session are accepted,
+// and sessions idle for longer than tokenLifetime are forgotten.
+type requestIDEcho struct {
+	header string
+	mu     sync.Mutex
+	// sessions holds the IDs issued per session.
+	sessions map[string]*requestIDSession
+}
+
+// requestIDSession is the IDs issued in a session, oldest first, and the time
+// of its last request.
+type requestIDSession struct {
+	ids      []string
+	lastSeen time.Time
+}
+
+func newRequestIDEcho(tokenHeader string) *requestIDEcho {
+	return &requestIDEcho{header: tokenHeader, sessions: map[string]*requestIDSession{}}
+}
+
+// session returns the session key of a request.
+func (e *requestIDEcho) session(r *http.Request) string {
+	if tok := r.Header.Get(e.header); tok != "" {
+		return "token:" + tok
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "client:" + host
+}
+
+// wrap answers follow-up requests without an ID issued in their session
+// with 400. The dispatcher's own endpoints below AdminPathPrefix and
+// HealthzPath are exempt, so that probes and test harnesses need not echo IDs.
+func (e *requestIDEcho) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, AdminPathPrefix) || r.URL.Path == HealthzPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		session := e.session(r)
+		id := "req-" + uuid.New().String()
+		now := time.Now()
+		e.mu.Lock()
+		issued, known := e.sessions[session]
+		echoed := false
+		if !known {
+			// Drop the idle sessions when a new one starts.
+			for other, s := range e.sessions {
+				if now.Sub(s.lastSeen) > tokenLifetime {
+					delete(e.sessions, other)
+				}
+			}
+			issued = &requestIDSession{}
+			e.sessions[session] = issued
+		} else {
+			echoed = slices.Contains(issued.ids, r.Header.Get(requestIDHeader))
+		}
+		issued.ids = append(issued.ids, id)
+		if len(issued.ids) > maxSessionRequestIDs {
+			issued.ids = issued.ids[len(issued.ids)-maxSessionRequestIDs:]
+		}
+		issued.lastSeen = now
+		e.mu.Unlock()
+
+		// The backends' own request IDs are replaced by the issued one.
+		w = &requestIDWriter{ResponseWriter: w, id: id}
+		if known && !echoed {
+			writeJSONError(w, http.StatusBadRequest,
+				fmt.Sprintf("missing or unknown %s header, echo an ID issued in this session", requestIDHeader))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reset forgets all sessions.
+func (e *requestIDEcho) reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sessions = map[string]*requestIDSession{}
+}
+
+// requestIDWriter sets the request ID header on WriteHeader.
+type requestIDWriter struct {
+	http.ResponseWriter
+	id          string
+	wroteHeader bool
+}
+
+func (w *requestIDWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set(requestIDHeader, w.id)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *requestIDWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *requestIDWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// htmlErrors replaces the JSON error envelopes of the dispatcher's 502, 503
+// and 504 responses with HTML pages, as some gateways send them. Responses
+// of these statuses are buffered to tell the envelopes, with a code matching
+// the status, from other bodies, which are passed on unchanged.
+func htmlErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := &htmlErrorWriter{ResponseWriter: w}
+		next.ServeHTTP(hw, r)
+		hw.finish()
+	})
+}
+
+// htmlErrorWriter buffers the JSON bodies of gateway error responses.
+type htmlErrorWriter struct {
+	http.ResponseWriter
+	status int
+	buf    *bytes.Buffer
+}
+
+func (w *htmlErrorWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			w.buf = &bytes.Buffer{}
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *htmlErrorWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buf != nil {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish sends a buffered response, as HTML page if it is an error envelope.
+func (w *htmlErrorWriter) finish() {
+	if w.buf == nil {
+		return
+	}
+	b := w.buf.Bytes()
+	var envelope struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(b, &envelope) == nil && envelope.Error.Code == w.status {
+		title := fmt.Sprintf("%d %s", w.status, http.StatusText(w.status))
+		b = []byte("<html>\r\n<head><title>" + title + "</title></head>\r\n<body>\r\n<center><h1>" + title +
+			"</h1></center>\r\n<p>" + html.EscapeString(envelope.Error.Message) + "</p>\r\n</body>\r\n</html>\r\n")
+		w.Header().Set("Content-Type", "text/html")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.ResponseWriter.WriteHeader(w.status)
+	_, _ = w.ResponseWriter.Write(b)
+}
+
+// FlushError ignores flushes while the response is buffered, as flushing the
+// underlying writer would send an implicit 200 before finish sends the
+// status. It is used by http.ResponseController in preference to Unwrap.
+func (w *htmlErrorWriter) FlushError() error {
+	if w.buf != nil {
+		return nil
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *htmlErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// connStateKey is the context key of the per-connection state.
+type connStateKey struct{}
+
+// connState is the state of a client connection shared by its requests.
+type connState struct {
+	served atomic.Bool
+}
+
+// withConnState is an http.Server ConnContext adding a fresh connState to
+// the context of each connection.
+func withConnState(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connStateKey{}, &connState{})
+}
+
+// delayFirstRequests delays the first request on each connection by delay,
+// simulating connection setup cost; later requests on a kept-alive
+// connection are answered without delay. It requires withConnState.
+func delayFirstRequests(next http.Handler, delay time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if state, ok := r.Context().Value(connStateKey{}).(*connState); ok && state.served.CompareAndSwap(false, true) {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
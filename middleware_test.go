@@ -0,0 +1,853 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// doRequest sends a request with the given method and body to url and returns
+// the response with its body read.
+func doRequest(t *testing.T, method, url string, body io.Reader) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, body)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func TestImageUploadLimit(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.MaxImageBytes = 16 }))
+	defer ts.Close()
+
+	// Oversized uploads are rejected, with and without Content-Length.
+	resp, body := doRequest(t, http.MethodPut, ts.URL+"/v2/images/img-1/file", strings.NewReader(strings.Repeat("x", 17)))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || !strings.Contains(body, `"code":413`) {
+		t.Errorf("expected 413 envelope for oversized upload, got %d: %s", resp.StatusCode, body)
+	}
+	resp, _ = doRequest(t, http.MethodPut, ts.URL+"/v2/images/img-1/file", io.MultiReader(strings.NewReader(strings.Repeat("x", 17))))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for oversized chunked upload, got %d", resp.StatusCode)
+	}
+
+	// Uploads within the limit and other requests reach the backend.
+	resp, _ = doRequest(t, http.MethodPut, ts.URL+"/v2/images/img-1/file", io.MultiReader(strings.NewReader("small")))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 for small upload, got %d", resp.StatusCode)
+	}
+	resp, _ = doRequest(t, http.MethodPost, ts.URL+"/v2/images", strings.NewReader(strings.Repeat("x", 17)))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected image create to be unaffected by the upload limit, got %d", resp.StatusCode)
+	}
+}
+
+// connReused issues GET requests to url over a single client and reports for
+// each whether it reused a previous connection.
+func connReused(t *testing.T, url string, header http.Header, n int) []bool {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+	var reused []bool
+	for i := 0; i < n; i++ {
+		var info httptrace.GotConnInfo
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header = header.Clone()
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: func(i httptrace.GotConnInfo) { info = i },
+		}))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		//nolint:errcheck // Response body Close() call
+		_ = resp.Body.Close()
+		reused = append(reused, info.Reused)
+	}
+	return reused
+}
+
+func TestForceClose(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t))
+	defer ts.Close()
+	if got := connReused(t, ts.URL+"/flavors", http.Header{}, 2); !got[1] {
+		t.Errorf("expected keep-alive connection reuse by default")
+	}
+	if got := connReused(t, ts.URL+"/flavors", http.Header{MockCloseHeader: {"1"}}, 2); got[1] {
+		t.Errorf("expected a new connection after X-Mock-Close")
+	}
+
+	forced := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.ForceClose = true }))
+	defer forced.Close()
+	resp, _ := doRequest(t, http.MethodGet, forced.URL+"/flavors", nil)
+	if !resp.Close {
+		t.Errorf("expected Connection: close on the response")
+	}
+	if got := connReused(t, forced.URL+"/flavors", http.Header{}, 2); got[1] {
+		t.Errorf("expected a new connection with -force-close")
+	}
+}
+
+func TestAllowIPs(t *testing.T) {
+	var allowed cidrList
+	if err := allowed.Set("10.0.0.0/8, 192.168.1.5, ::1"); err != nil {
+		t.Fatalf("parsing allowlist failed: %v", err)
+	}
+	handler := buildDispatcherForTest(t, func(c *Config) { c.AllowIPs = allowed })
+
+	tests := []struct {
+		remoteAddr string
+		want       int
+	}{
+		{remoteAddr: "10.1.2.3:4711", want: http.StatusOK},
+		{remoteAddr: "192.168.1.5:4711", want: http.StatusOK},
+		{remoteAddr: "[::1]:4711", want: http.StatusOK},
+		{remoteAddr: "192.168.1.6:4711", want: http.StatusForbidden},
+		{remoteAddr: "172.16.0.1:4711", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/flavors", nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("client %s: expected %d, got %d", tt.remoteAddr, tt.want, rec.Code)
+		}
+	}
+
+	if err := allowed.Set("10.0.0.0/33"); err == nil {
+		t.Errorf("expected an error for an invalid CIDR")
+	}
+}
+
+func TestRetryAfterFormat(t *testing.T) {
+	// A closed backend makes every proxied request fail with 502.
+	backend := httptest.NewServer(http.NotFoundHandler())
+	backend.Close()
+
+	tests := []struct {
+		format RetryAfterFormat
+		check  func(string) error
+	}{
+		{format: RetryAfterSeconds, check: func(v string) error {
+			if v != "1" {
+				return fmt.Errorf("expected 1 second, got %q", v)
+			}
+			return nil
+		}},
+		{format: RetryAfterDate, check: func(v string) error {
+			at, err := http.ParseTime(v)
+			if err != nil {
+				return err
+			}
+			if d := time.Until(at); d < -time.Second || d > 2*time.Second {
+				return fmt.Errorf("expected a date about 1s ahead, got %v", at)
+			}
+			return nil
+		}},
+	}
+	for _, tt := range tests {
+		ts := httptest.NewServer(NewDispatcher(Endpoints{Compute: backend.URL}, func(c *Config) { c.RetryAfterFormat = tt.format }))
+		resp, body := doRequest(t, http.MethodGet, ts.URL+"/flavors", nil)
+		ts.Close()
+		if resp.StatusCode != http.StatusBadGateway || !strings.Contains(body, `"code":502`) {
+			t.Errorf("expected a 502 envelope, got %d: %s", resp.StatusCode, body)
+		}
+		if err := tt.check(resp.Header.Get("Retry-After")); err != nil {
+			t.Errorf("%s format: %v", tt.format, err)
+		}
+	}
+
+	var f RetryAfterFormat
+	if err := f.Set("minutes"); err == nil {
+		t.Errorf("expected an error for an unsupported format")
+	}
+}
+
+func TestTruncateResponses(t *testing.T) {
+	body := `{"servers": [{"id": "1", "name": "vm-1"}]}`
+	backend := newJSONBackend(t, map[string]string{"/servers/detail": body, "/flavors": body})
+	opt := func(c *Config) { _ = c.Truncate.Set("/servers:10") }
+	ts := httptest.NewServer(NewDispatcher(Endpoints{Compute: backend.URL}, opt))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/servers/detail")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	//nolint:errcheck // Response body Close() call
+	_ = resp.Body.Close()
+	if err == nil {
+		t.Errorf("expected a read error for the truncated body, got %q", b)
+	}
+	if string(b) != body[:10] {
+		t.Errorf("expected the first 10 bytes %q, got %q", body[:10], b)
+	}
+
+	// Other paths are not affected.
+	if _, got := doRequest(t, http.MethodGet, ts.URL+"/flavors", nil); got != body {
+		t.Errorf("expected the full body for /flavors, got %q", got)
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	for _, tc := range []struct {
+		opts []Option
+		want string
+	}{
+		{want: "openstack-mock"},
+		{opts: []Option{func(c *Config) { c.ServerHeader = "nginx/openstack" }}, want: "nginx/openstack"},
+		{opts: []Option{func(c *Config) { c.ServerHeader = "" }}, want: ""},
+	} {
+		ts := httptest.NewServer(buildDispatcherForTest(t, tc.opts...))
+		for _, path := range []string{"/v3/auth/tokens", "/flavors", "/unknown"} {
+			resp, _ := doRequest(t, http.MethodGet, ts.URL+path, nil)
+			if got := resp.Header.Get("Server"); got != tc.want {
+				t.Errorf("%s: expected Server %q, got %q", path, tc.want, got)
+			}
+		}
+		ts.Close()
+	}
+}
+
+func TestResetConnections(t *testing.T) {
+	opt := func(c *Config) {
+		c.ResetRate = 0.5
+		c.ResetSeed = 1
+	}
+	ts := httptest.NewServer(buildDispatcherForTest(t, opt))
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	const n = 40
+	var failed int
+	for i := 0; i < n; i++ {
+		resp, err := client.Get(ts.URL + "/flavors")
+		if err != nil {
+			failed++
+			continue
+		}
+		//nolint:errcheck // Response body Close() call
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected 200 or a connection error, got %d", resp.StatusCode)
+		}
+	}
+	if failed == 0 || failed == n {
+		t.Errorf("expected some of %d requests to fail with a connection error, %d did", n, failed)
+	}
+
+	var p probability
+	if err := p.Set("1.5"); err == nil {
+		t.Errorf("expected an error for a rate above 1")
+	}
+}
+
+func TestFailOnNth(t *testing.T) {
+	var resets int
+	opts := []Option{
+		func(c *Config) {
+			c.EnableAdmin = true
+			_ = c.FailOnNth.Set("/servers:3")
+		},
+		WithResetHook(func() { resets++ }),
+	}
+	ts := httptest.NewServer(buildDispatcherForTest(t, opts...))
+	defer ts.Close()
+
+	statuses := func(n int) []int {
+		var got []int
+		for i := 0; i < n; i++ {
+			resp, _ := doRequest(t, http.MethodGet, ts.URL+"/servers/detail", nil)
+			got = append(got, resp.StatusCode)
+		}
+		return got
+	}
+	want := []int{200, 200, 500, 200, 200}
+	if got := statuses(5); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected statuses %v, got %v", want, got)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/flavors", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected other paths not to fail, got %d", resp.StatusCode)
+	}
+
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/mock/reset", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 from /mock/reset, got %d", resp.StatusCode)
+	}
+	if resets != 1 {
+		t.Errorf("expected the reset hook to be called once, got %d", resets)
+	}
+	if got := statuses(3); !reflect.DeepEqual(got, want[:3]) {
+		t.Errorf("expected the counter to restart after reset, got %v", got)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	arrived := make(chan struct{}, 10)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer backend.Close()
+	ts := httptest.NewServer(NewDispatcher(Endpoints{Compute: backend.URL}, func(c *Config) { c.MaxConcurrent = 2 }))
+	defer ts.Close()
+
+	// Occupy both slots with requests blocked in the backend.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(ts.URL + "/servers")
+			if err != nil {
+				t.Errorf("request failed: %v", err)
+				return
+			}
+			//nolint:errcheck // Response body Close() call
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected 200 for an admitted request, got %d", resp.StatusCode)
+			}
+		}()
+		<-arrived
+	}
+
+	shed := 0
+	for i := 0; i < 5; i++ {
+		resp, _ := doRequest(t, http.MethodGet, ts.URL+"/flavors", nil)
+		if resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") == "1" {
+			shed++
+		}
+	}
+	if shed != 5 {
+		t.Errorf("expected all 5 requests beyond the limit to get 503 with Retry-After, %d did", shed)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+PingPath, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected ping to be exempt, got %d", resp.StatusCode)
+	}
+
+	close(release)
+	wg.Wait()
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/servers", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 once the slots are free, got %d", resp.StatusCode)
+	}
+}
+
+func TestForceChunked(t *testing.T) {
+	for _, force := range []bool{false, true} {
+		ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.ForceChunked = force }))
+		resp, body := doRequest(t, http.MethodGet, ts.URL+"/servers", nil)
+		ts.Close()
+
+		chunked := len(resp.TransferEncoding) == 1 && resp.TransferEncoding[0] == "chunked"
+		if chunked != force || (resp.ContentLength == -1) != force {
+			t.Errorf("force %v: got Transfer-Encoding %v and Content-Length %d", force, resp.TransferEncoding, resp.ContentLength)
+		}
+		if body != "compute: /servers" {
+			t.Errorf("force %v: expected the complete body, got %q", force, body)
+		}
+	}
+}
+
+func TestStrictHeaders(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.StrictHeaders = true }))
+	defer ts.Close()
+
+	token := http.Header{"X-Auth-Token": {"tok"}}
+	jsonToken := http.Header{"X-Auth-Token": {"tok"}, "Content-Type": {"application/json; charset=utf-8"}}
+	form := http.Header{"X-Auth-Token": {"tok"}, "Content-Type": {"application/x-www-form-urlencoded"}}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header http.Header
+		body   string
+		want   int
+	}{
+		{name: "missing token", method: http.MethodGet, path: "/servers", want: http.StatusBadRequest},
+		{name: "token", method: http.MethodGet, path: "/servers", header: token, want: http.StatusOK},
+		{name: "missing content type", method: http.MethodPost, path: "/servers", header: token, body: "{}", want: http.StatusBadRequest},
+		{name: "wrong content type", method: http.MethodPut, path: "/servers/1", header: form, body: "a=b", want: http.StatusBadRequest},
+		{name: "json", method: http.MethodPost, path: "/servers", header: jsonToken, body: "{}", want: http.StatusOK},
+		{name: "no body", method: http.MethodPost, path: "/servers/1/action", header: token, want: http.StatusOK},
+		{name: "image data", method: http.MethodPut, path: "/v2/images/1/file", header: token, body: "data", want: http.StatusOK},
+		{name: "dispatcher endpoint", method: http.MethodGet, path: PingPath, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", tt.name, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestBodyOn204(t *testing.T) {
+	for _, body := range []bool{false, true} {
+		ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) {
+			c.EnableAdmin = true
+			c.BodyOn204 = body
+		}))
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = conn.Write([]byte("POST /mock/reset HTTP/1.1\r\nHost: mock\r\nConnection: close\r\n\r\n"))
+		raw, err := io.ReadAll(conn)
+		_ = conn.Close()
+		ts.Close()
+		if err != nil {
+			t.Fatalf("reading response failed: %v", err)
+		}
+		if !strings.HasPrefix(string(raw), "HTTP/1.1 204 ") {
+			t.Fatalf("expected a 204 response, got %q", raw)
+		}
+		if got := strings.HasSuffix(string(raw), "\r\n\r\n"+noContentBody); got != body {
+			t.Errorf("body-on-204 %v: unexpected response %q", body, raw)
+		}
+	}
+}
+
+// rawGet sends a GET request for path over a new connection to ts and returns
+// the raw response.
+func rawGet(t *testing.T, ts *httptest.Server, path string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: mock\r\nConnection: close\r\n\r\n", path)
+	raw, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("reading response failed: %v", err)
+	}
+	return string(raw)
+}
+
+func TestHeaderCase(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.HeaderCase = HeaderLower }))
+	defer ts.Close()
+
+	head, _, _ := strings.Cut(rawGet(t, ts, "/servers"), "\r\n\r\n")
+	lines := strings.Split(head, "\r\n")[1:]
+	names := map[string]int{}
+	for _, line := range lines {
+		name, _, _ := strings.Cut(line, ":")
+		names[name]++
+	}
+	for _, want := range []string{"x-backend", "content-type", "date", "Content-Length"} {
+		if names[want] != 1 {
+			t.Errorf("expected header %s once, got %q", want, lines)
+		}
+	}
+	for _, unwanted := range []string{"X-Backend", "Content-Type", "Date"} {
+		if names[unwanted] != 0 {
+			t.Errorf("expected no header %s, got %q", unwanted, lines)
+		}
+	}
+
+	// The dispatcher's own endpoints are not affected.
+	if raw := rawGet(t, ts, PingPath); !strings.Contains(raw, "\r\nContent-Type: ") {
+		t.Errorf("expected canonical headers for the ping, got %q", raw)
+	}
+
+	var c HeaderCase
+	if err := c.Set("upper"); err == nil {
+		t.Errorf("expected an error for an unsupported casing")
+	}
+}
+
+func TestBodyRate(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, body)
+	}))
+	defer backend.Close()
+
+	for _, rate := range []int64{0, 4000} {
+		ts := httptest.NewServer(NewDispatcher(Endpoints{Compute: backend.URL}, func(c *Config) { c.BodyRate = rate }))
+		start := time.Now()
+		_, got := doRequest(t, http.MethodGet, ts.URL+"/servers", nil)
+		elapsed := time.Since(start)
+		ts.Close()
+
+		if got != body {
+			t.Errorf("rate %d: expected the complete body, got %d bytes", rate, len(got))
+		}
+		// 1000 bytes at 4000 bytes/s take 250ms.
+		if rate > 0 && (elapsed < 225*time.Millisecond || elapsed > 2*time.Second) {
+			t.Errorf("rate %d: expected a transfer time of about 250ms, got %v", rate, elapsed)
+		}
+		if rate == 0 && elapsed > 200*time.Millisecond {
+			t.Errorf("expected no throttling by default, took %v", elapsed)
+		}
+	}
+}
+
+func TestRequireRequestIDEcho(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.RequireRequestIDEcho = true }))
+	defer ts.Close()
+
+	get := func(token, id string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/servers", nil)
+		if token != "" {
+			req.Header.Set("X-Auth-Token", token)
+		}
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	// The first request of a session needs no ID.
+	resp := get("tok-1", "")
+	first := resp.Header.Get(requestIDHeader)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(first, "req-") {
+		t.Fatalf("expected 200 with a request ID, got %d %q", resp.StatusCode, first)
+	}
+
+	// A compliant client echoes an issued ID, old ones stay valid.
+	resp = get("tok-1", first)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(requestIDHeader) == first {
+		t.Errorf("expected 200 with a new request ID, got %d %q", resp.StatusCode, resp.Header.Get(requestIDHeader))
+	}
+	if resp = get("tok-1", first); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 for an earlier ID, got %d", resp.StatusCode)
+	}
+
+	// Non-compliant clients omit the ID or send one from another session.
+	if resp = get("tok-1", ""); resp.StatusCode != http.StatusBadRequest || resp.Header.Get(requestIDHeader) == "" {
+		t.Errorf("expected 400 with a request ID without echo, got %d", resp.StatusCode)
+	}
+	other := get("tok-2", "").Header.Get(requestIDHeader)
+	if resp = get("tok-1", other); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an ID of another session, got %d", resp.StatusCode)
+	}
+
+	// Requests without token form a session per client address.
+	id := get("", "").Header.Get(requestIDHeader)
+	if resp = get("", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an anonymous follow-up without ID, got %d", resp.StatusCode)
+	}
+	if resp = get("", id); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 for an anonymous follow-up echoing the ID, got %d", resp.StatusCode)
+	}
+}
+
+func TestRequireRequestIDEchoExemptsOwnEndpoints(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) {
+		c.RequireRequestIDEcho = true
+		c.EnableAdmin = true
+	}))
+	defer ts.Close()
+
+	// Probes and harnesses share the anonymous session of their host.
+	for i := 0; i < 3; i++ {
+		for _, path := range []string{PingPath, HealthzPath, StatusPath} {
+			if resp, _ := doRequest(t, http.MethodGet, ts.URL+path, nil); resp.StatusCode != http.StatusOK {
+				t.Errorf("%s #%d: expected 200 without ID, got %d", path, i+1, resp.StatusCode)
+			}
+		}
+	}
+	doRequest(t, http.MethodGet, ts.URL+"/servers", nil)
+	for i := 0; i < 2; i++ {
+		if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/mock/reset", nil); resp.StatusCode != http.StatusNoContent {
+			t.Errorf("reset #%d: expected 204 without ID, got %d", i+1, resp.StatusCode)
+		}
+	}
+	// The reset ended the session, so the next request starts a new one.
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/servers", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 for the first request after the reset, got %d", resp.StatusCode)
+	}
+}
+
+func TestRequireRequestIDEchoKeepsRecentIDs(t *testing.T) {
+	e := newRequestIDEcho("X-Auth-Token")
+	h := e.wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	var ids []string
+	for i := 0; i < maxSessionRequestIDs+1; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/servers", nil)
+		if len(ids) > 0 {
+			req.Header.Set(requestIDHeader, ids[len(ids)-1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		ids = append(ids, rec.Header().Get(requestIDHeader))
+	}
+	if n := len(e.sessions[e.session(httptest.NewRequest(http.MethodGet, "/", nil))].ids); n != maxSessionRequestIDs {
+		t.Errorf("expected %d IDs kept, got %d", maxSessionRequestIDs, n)
+	}
+	// Each request drops the oldest ID, so the oldest kept one goes first.
+	for _, tc := range []struct {
+		id   string
+		want int
+	}{{ids[1], http.StatusOK}, {ids[0], http.StatusBadRequest}} {
+		req := httptest.NewRequest(http.MethodGet, "/servers", nil)
+		req.Header.Set(requestIDHeader, tc.id)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("ID %s: expected %d, got %d", tc.id, tc.want, rec.Code)
+		}
+	}
+}
+
+func TestMaxURILength(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.MaxURILength = 64 }))
+	defer ts.Close()
+
+	// "/servers?name=" is 14 bytes.
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/servers?name="+strings.Repeat("a", 50), nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 for a URI at the limit, got %d", resp.StatusCode)
+	}
+	resp, body := doRequest(t, http.MethodGet, ts.URL+"/servers?name="+strings.Repeat("a", 51), nil)
+	if resp.StatusCode != http.StatusRequestURITooLong || !strings.Contains(body, `"code":414`) {
+		t.Errorf("expected 414 envelope for an overlong URI, got %d: %s", resp.StatusCode, body)
+	}
+
+	unlimited := httptest.NewServer(buildDispatcherForTest(t))
+	defer unlimited.Close()
+	if resp, _ := doRequest(t, http.MethodGet, unlimited.URL+"/servers?name="+strings.Repeat("a", 4000), nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected no limit by default, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTMLErrors(t *testing.T) {
+	// The compute backend is down, the networking backend fails itself.
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, `{"NeutronError": {"message": "busy"}}`)
+	}))
+	defer failing.Close()
+
+	for _, enabled := range []bool{false, true} {
+		ts := httptest.NewServer(NewDispatcher(Endpoints{Compute: down.URL, Networking: failing.URL}, func(c *Config) { c.HTMLErrors = enabled }))
+		resp, body := doRequest(t, http.MethodGet, ts.URL+"/servers", nil)
+		ct := resp.Header.Get("Content-Type")
+		switch {
+		case resp.StatusCode != http.StatusBadGateway:
+			t.Errorf("html %v: expected 502, got %d", enabled, resp.StatusCode)
+		case enabled && (ct != "text/html" || !strings.Contains(body, "<title>502 Bad Gateway</title>")):
+			t.Errorf("expected an HTML page, got %s: %s", ct, body)
+		case !enabled && !strings.Contains(body, `"code":502`):
+			t.Errorf("expected a JSON envelope by default, got %s: %s", ct, body)
+		}
+
+		resp, body = doRequest(t, http.MethodGet, ts.URL+"/ports", nil)
+		if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Content-Type") != "application/json" || !strings.Contains(body, "NeutronError") {
+			t.Errorf("html %v: expected the backend error unchanged, got %d %s", enabled, resp.StatusCode, body)
+		}
+		ts.Close()
+	}
+}
+
+func TestHTMLErrorsFlushed(t *testing.T) {
+	// Chunking and throttling flush the response as it is written, which must
+	// not send the buffered error with an implicit 200.
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	for name, opt := range map[string]Option{
+		"force-chunked": func(c *Config) { c.ForceChunked = true },
+		"body-rate":     func(c *Config) { c.BodyRate = 1 << 20 },
+	} {
+		ts := httptest.NewServer(NewDispatcher(Endpoints{Compute: down.URL}, func(c *Config) { c.HTMLErrors = true }, opt))
+		resp, body := doRequest(t, http.MethodGet, ts.URL+"/servers", nil)
+		if resp.StatusCode != http.StatusBadGateway || !strings.Contains(body, "<title>502 Bad Gateway</title>") {
+			t.Errorf("%s: expected a 502 HTML page, got %d: %s", name, resp.StatusCode, body)
+		}
+		ts.Close()
+	}
+}
+
+func TestStatusOverride(t *testing.T) {
+	var rules statusOverrides
+	for _, v := range []string{"/flavors:500", "/flavors/detail:503,/servers/:404"} {
+		if err := rules.Set(v); err != nil {
+			t.Fatalf("%q: unexpected error %v", v, err)
+		}
+	}
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.StatusOverrides = rules }))
+	defer ts.Close()
+
+	for path, want := range map[string]int{
+		"/flavors":        http.StatusInternalServerError,
+		"/flavors/1":      http.StatusInternalServerError,
+		"/flavors/detail": http.StatusServiceUnavailable,
+		"/servers/1":      http.StatusNotFound,
+		"/servers":        http.StatusOK,
+	} {
+		resp, body := doRequest(t, http.MethodGet, ts.URL+path, nil)
+		if resp.StatusCode != want {
+			t.Errorf("%s: expected %d, got %d", path, want, resp.StatusCode)
+		}
+		if want != http.StatusOK && !strings.Contains(body, fmt.Sprintf(`"code":%d`, want)) {
+			t.Errorf("%s: expected an error envelope, got %s", path, body)
+		}
+	}
+
+	for _, v := range []string{"/flavors", "flavors:500", "/flavors:200", "/flavors:x"} {
+		if err := rules.Set(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
+
+func TestRequireUserAgent(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) {
+		c.RequireUserAgent = true
+		c.AccessLog = true
+	}))
+	defer ts.Close()
+
+	for ua, want := range map[string]int{
+		"gophercloud/2.0": http.StatusOK,
+		// An empty value makes Go's client omit the header.
+		"": http.StatusBadRequest,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/servers", nil)
+		req.Header.Set("User-Agent", ua)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("User-Agent %q: expected %d, got %d: %s", ua, want, resp.StatusCode, b)
+		}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use, for capturing the
+// log lines of the server goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *lockedBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func TestLogRequests(t *testing.T) {
+	var buf lockedBuffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&buf)
+	defer func() {
+		klog.SetOutput(io.Discard)
+		klog.LogToStderr(true)
+	}()
+
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.LogRequests = true }))
+	defer ts.Close()
+
+	for path, want := range map[string]string{
+		"/servers":        "GET /servers route=/servers backend=compute status=200 latency=",
+		"/v3/auth/tokens": "GET /v3/auth/tokens route=token backend=- status=",
+		"/mock/ping":      "GET /mock/ping route=admin backend=- status=200 latency=",
+		"/nowhere":        "GET /nowhere route=404 backend=- status=404 latency=",
+	} {
+		buf.Reset()
+		doRequest(t, http.MethodGet, ts.URL+path, nil)
+		klog.Flush()
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("%s: expected a log line containing %q, got %q", path, want, buf.String())
+		}
+	}
+}
+
+func TestRejectEmptyPost(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.RejectEmptyPost = true }))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		method, path string
+		body         io.Reader
+		want         int
+	}{
+		{http.MethodPost, "/servers", nil, http.StatusBadRequest},
+		{http.MethodPut, "/servers/abc", strings.NewReader(""), http.StatusBadRequest},
+		// Without a Content-Length, the body is sent chunked.
+		{http.MethodPost, "/servers", io.MultiReader(strings.NewReader("")), http.StatusBadRequest},
+		{http.MethodPost, "/servers", strings.NewReader(`{"server":{}}`), http.StatusOK},
+		{http.MethodPost, "/servers", io.MultiReader(strings.NewReader(`{"server":{}}`)), http.StatusOK},
+		{http.MethodGet, "/servers", nil, http.StatusOK},
+		{http.MethodDelete, "/servers/abc", nil, http.StatusOK},
+	} {
+		resp, body := doRequest(t, tc.method, ts.URL+tc.path, tc.body)
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s %s: expected %d, got %d: %s", tc.method, tc.path, tc.want, resp.StatusCode, body)
+		}
+		if tc.want == http.StatusBadRequest && !strings.Contains(body, `"code":400`) {
+			t.Errorf("%s %s: expected an error envelope, got %s", tc.method, tc.path, body)
+		}
+	}
+}
+
+func TestRejectEmptyPostBodyForwarded(t *testing.T) {
+	var got string
+	h := rejectEmptyBodies(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got = string(b)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/servers", io.MultiReader(strings.NewReader(`{"server":{}}`)))
+	req.ContentLength = -1
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got != `{"server":{}}` {
+		t.Errorf("expected the peeked body to be forwarded in full, got %q", got)
+	}
+}
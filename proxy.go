@@ -0,0 +1,397 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"k8s.io/klog/v2"
+)
+
+// backendServices lists the names of the backend services, as used by the
+// -<service>-port flags and in per-service flag values.
+var backendServices = []string{"compute", "networking", "loadbalancer", "blockstorage", "dns", "image", "objectstore", "keymanager", "orchestration"}
+
+func isBackendService(name string) bool {
+	for _, svc := range backendServices {
+		if svc == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newBackendTransport returns the transport of the reverse proxy for the
+// named backend service. Each service gets its own connection pool, limited
+// as configured, so that heavy traffic to one backend cannot starve the
+// others.
+func newBackendTransport(service string, cfg Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if n, ok := cfg.MaxIdleConnsPerHost.lookup(service); ok {
+		t.MaxIdleConnsPerHost = n
+		if t.MaxIdleConns != 0 && t.MaxIdleConns < n {
+			t.MaxIdleConns = n
+		}
+	}
+	if n, ok := cfg.MaxConnsPerHost.lookup(service); ok {
+		t.MaxConnsPerHost = n
+	}
+	// Keep the prewarmed connections.
+	if cfg.Prewarm > t.MaxIdleConnsPerHost {
+		t.MaxIdleConnsPerHost = cfg.Prewarm
+		if t.MaxIdleConns != 0 && t.MaxIdleConns < cfg.Prewarm*len(backendServices) {
+			t.MaxIdleConns = cfg.Prewarm * len(backendServices)
+		}
+	}
+	return t
+}
+
+// prewarmConnections opens n connections to each of the backend URLs with t
+// by sending concurrent HEAD requests, which leave them idle in t's pool. It
+// returns the number of connections opened.
+func prewarmConnections(t http.RoundTripper, urls []*url.URL, n int) int {
+	var opened atomic.Int64
+	var wg sync.WaitGroup
+	for _, u := range urls {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+					if !info.Reused {
+						opened.Add(1)
+					}
+				}}
+				req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodHead, u.String(), nil)
+				if err != nil {
+					return
+				}
+				resp, err := t.RoundTrip(req)
+				if err != nil {
+					klog.V(2).Infof("prewarming %s failed: %v", u, err)
+					return
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+			}()
+		}
+	}
+	wg.Wait()
+	return int(opened.Load())
+}
+
+// backendInstanceHeader names the backend instance that served a proxied
+// response.
+const backendInstanceHeader = "X-Mock-Backend-Instance"
+
+// backendPool balances the requests to a backend service round-robin across
+// its instances: the built-in backend, with the ID <service>-0, and the
+// instances of Config.BackendInstances.
+type backendPool struct {
+	ids   []string
+	urls  []*url.URL
+	count atomic.Uint64
+}
+
+func newBackendPool(service string, primary *url.URL, instances backendInstances) (*backendPool, error) {
+	p := &backendPool{ids: []string{service + "-0"}, urls: []*url.URL{primary}}
+	for _, inst := range instances {
+		if inst.Service != service {
+			continue
+		}
+		u, err := url.Parse(inst.URL)
+		if err != nil {
+			return nil, err
+		}
+		p.ids = append(p.ids, inst.ID)
+		p.urls = append(p.urls, u)
+	}
+	return p, nil
+}
+
+// pick returns the index of the instance serving the next request.
+func (p *backendPool) pick() int {
+	return int((p.count.Add(1) - 1) % uint64(len(p.urls)))
+}
+
+// instanceTransport sets backendInstanceHeader on the responses of the
+// instances of pool, which it tells apart by their host.
+type instanceTransport struct {
+	next http.RoundTripper
+	pool *backendPool
+}
+
+func (t *instanceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	for i, u := range t.pool.urls {
+		if u.Host == req.URL.Host {
+			resp.Header.Set(backendInstanceHeader, t.pool.ids[i])
+			break
+		}
+	}
+	return resp, nil
+}
+
+// normalizeSlash adds or strips the trailing slash of u's path as selected by
+// mode. The root path is left alone.
+func normalizeSlash(u *url.URL, mode SlashMode) {
+	switch mode {
+	case SlashAdd:
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+			if u.RawPath != "" {
+				u.RawPath += "/"
+			}
+		}
+	case SlashStrip:
+		if len(u.Path) > 1 && strings.HasSuffix(u.Path, "/") {
+			u.Path = strings.TrimRight(u.Path, "/")
+			if u.Path == "" {
+				u.Path = "/"
+			}
+			if u.RawPath != "" {
+				u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+			}
+		}
+	}
+}
+
+// stripPathPrefix removes prefix from the request path before passing the
+// request to next; the prefix itself becomes the root path.
+func stripPathPrefix(prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+		r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+		if r2.URL.Path == "" {
+			r2.URL.Path = "/"
+		}
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// allowedMethods lists the methods the API defines for a collection and for
+// the single resources in it.
+type allowedMethods struct {
+	Collection []string
+	Item       []string
+}
+
+var (
+	readWriteMethods = allowedMethods{
+		Collection: []string{http.MethodGet, http.MethodHead, http.MethodPost},
+		Item:       []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodDelete},
+	}
+	readOnlyMethods = allowedMethods{
+		Collection: []string{http.MethodGet, http.MethodHead},
+		Item:       []string{http.MethodGet, http.MethodHead},
+	}
+)
+
+// routeMethods maps the collection paths of the routing table to their
+// allowed methods. Routes not listed accept all methods.
+var routeMethods = map[string]allowedMethods{
+	"/servers":                        readWriteMethods,
+	"/os-keypairs":                    readWriteMethods,
+	"/flavors":                        readWriteMethods,
+	"/os-services":                    readOnlyMethods,
+	"/os-floating-ip-pools":           readOnlyMethods,
+	"/os-floating-ips":                readWriteMethods,
+	"/v2/images":                      readWriteMethods,
+	"/images":                         readWriteMethods,
+	"/volumes":                        readWriteMethods,
+	"/types":                          readWriteMethods,
+	"/os-availability-zone":           readOnlyMethods,
+	"/zones":                          readWriteMethods,
+	"/v2.0/networks":                  readWriteMethods,
+	"/networks":                       readWriteMethods,
+	"/ports":                          readWriteMethods,
+	"/routers":                        readWriteMethods,
+	"/security-groups":                readWriteMethods,
+	"/security-group-rules":           readWriteMethods,
+	"/subnets":                        readWriteMethods,
+	"/v2.0/floatingips":               readWriteMethods,
+	"/floatingips":                    readWriteMethods,
+	"/v2.0/network-ip-availabilities": readOnlyMethods,
+	"/v2.0/address-scopes":            readWriteMethods,
+	"/v2.0/subnetpools":               readWriteMethods,
+	"/lbaas/listeners":                readWriteMethods,
+	"/lbaas/loadbalancers":            readWriteMethods,
+	"/lbaas/pools":                    readWriteMethods,
+	"/lbaas/quotas":                   readWriteMethods,
+	"/lbaas/flavors":                  readWriteMethods,
+}
+
+// rejectUnknownMethods answers requests to collection, or to a single
+// resource directly below it, with 405 if methods does not allow their
+// method. Deeper paths are passed on unchecked.
+func rejectUnknownMethods(next http.Handler, collection string, methods allowedMethods) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, collection)
+		if !ok || (rest != "" && rest[0] != '/') {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var allowed []string
+		switch rest = strings.Trim(rest, "/"); {
+		case rest == "":
+			allowed = methods.Collection
+		case !strings.Contains(rest, "/"):
+			allowed = methods.Item
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !slices.Contains(allowed, r.Method) {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeJSONError(w, http.StatusMethodNotAllowed,
+				fmt.Sprintf("method %s is not allowed for %s", r.Method, r.URL.Path))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeQuotaSets passes requests for /os-quota-sets with the hint
+// ?service=volume to volume and all others to compute.
+func routeQuotaSets(compute, volume http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("service") == "volume" {
+			volume.ServeHTTP(w, r)
+			return
+		}
+		compute.ServeHTTP(w, r)
+	})
+}
+
+// chainResponseModifiers returns a ReverseProxy.ModifyResponse function
+// applying the given modifiers in order; nil modifiers are skipped.
+func chainResponseModifiers(modifiers ...func(*http.Response) error) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		for _, modify := range modifiers {
+			if modify == nil {
+				continue
+			}
+			if err := modify(resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// forceContentType returns a ReverseProxy.ModifyResponse function replacing
+// the Content-Type of proxied responses according to overrides, simulating a
+// backend that sends e.g. text/html instead of JSON.
+func forceContentType(overrides contentTypeOverrides) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if ct, ok := overrides.lookup(resp.Request.URL.Path); ok {
+			resp.Header.Set(headers.ContentType, ct)
+		}
+		return nil
+	}
+}
+
+// lookup returns the content type of the override with the longest prefix of
+// path.
+func (o contentTypeOverrides) lookup(path string) (string, bool) {
+	best := -1
+	for i, override := range o {
+		if strings.HasPrefix(path, override.Prefix) && (best < 0 || len(override.Prefix) > len(o[best].Prefix)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+	return o[best].ContentType, true
+}
+
+// responseCorrupter corrupts the bodies of a fraction of the proxied JSON
+// responses so that they are no longer valid JSON, simulating data corruption
+// on the wire. It is safe for concurrent use.
+type responseCorrupter struct {
+	rate float64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newResponseCorrupter(rate float64, seed int64) *responseCorrupter {
+	return &responseCorrupter{rate: rate, rng: rand.New(rand.NewSource(seed))}
+}
+
+// modifyResponse is a ReverseProxy.ModifyResponse function corrupting the
+// chosen JSON responses: it drops up to three bytes at the end of the
+// document, cutting off its closing bracket, and flips a byte before them.
+func (c *responseCorrupter) modifyResponse(resp *http.Response) error {
+	if !strings.Contains(resp.Header.Get(headers.ContentType), "json") {
+		return nil
+	}
+	c.mu.Lock()
+	corrupt := c.rng.Float64() < c.rate
+	drop, flip := 1+c.rng.Intn(3), c.rng.Int()
+	c.mu.Unlock()
+	if !corrupt {
+		return nil
+	}
+	b, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	b = bytes.TrimRight(b, " \t\r\n")
+	if len(b) > 0 {
+		b = b[:max(len(b)-drop, 0)]
+		if len(b) > 0 {
+			b[flip%len(b)] ^= 0x20
+		}
+		klog.Infof("Corrupting the response to %s %s", resp.Request.Method, resp.Request.URL.Path)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	resp.Header.Set(headers.ContentLength, strconv.Itoa(len(b)))
+	return nil
+}
+
+// serverTimingHeader reports the durations of the proxied requests to clients
+// such as browser dev tools.
+const serverTimingHeader = "Server-Timing"
+
+// addServerTiming adds the metric with duration d to the Server-Timing header
+// of h, e.g. "backend;dur=12.3" with the duration in milliseconds.
+func addServerTiming(h http.Header, metric string, d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	h.Add(serverTimingHeader, metric+";dur="+strconv.FormatFloat(ms, 'f', 1, 64))
+}
+
+// serverTimingTransport adds the duration of the backend request as
+// Server-Timing metric "backend" to its response.
+type serverTimingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *serverTimingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err == nil {
+		addServerTiming(resp.Header, "backend", time.Since(start))
+	}
+	return resp, err
+}
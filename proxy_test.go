@@ -0,0 +1,330 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestForceContentType(t *testing.T) {
+	opt := func(c *Config) {
+		_ = c.ForceContentType.Set("text/html,/servers:application/xml")
+	}
+	ts := httptest.NewServer(buildDispatcherForTest(t, opt))
+	defer ts.Close()
+
+	for path, want := range map[string]string{
+		"/flavors":     "text/html",
+		"/servers/123": "application/xml",
+	} {
+		resp, _ := doRequest(t, http.MethodGet, ts.URL+path, nil)
+		if got := resp.Header.Get("Content-Type"); got != want {
+			t.Errorf("%s: expected Content-Type %q, got %q", path, want, got)
+		}
+	}
+
+	// Without the option, the Content-Type the test backend sniffed passes
+	// through.
+	plain := httptest.NewServer(buildDispatcherForTest(t))
+	defer plain.Close()
+	resp, _ := doRequest(t, http.MethodGet, plain.URL+"/flavors", nil)
+	if got := resp.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("expected the backend's Content-Type, got %q", got)
+	}
+}
+
+func TestNewBackendTransport(t *testing.T) {
+	cfg := DefaultConfig()
+	if err := cfg.MaxIdleConnsPerHost.Set("8,image=200"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cfg.MaxConnsPerHost.Set("image=16"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	compute, image := newBackendTransport("compute", cfg), newBackendTransport("image", cfg)
+	if compute == image {
+		t.Fatalf("expected independent transports per service")
+	}
+	if compute.MaxIdleConnsPerHost != 8 || compute.MaxConnsPerHost != 0 {
+		t.Errorf("compute: expected 8 idle and unlimited connections, got %d and %d", compute.MaxIdleConnsPerHost, compute.MaxConnsPerHost)
+	}
+	if image.MaxIdleConnsPerHost != 200 || image.MaxConnsPerHost != 16 || image.MaxIdleConns < 200 {
+		t.Errorf("image: expected 200 idle and 16 connections, got %d (total %d) and %d", image.MaxIdleConnsPerHost, image.MaxIdleConns, image.MaxConnsPerHost)
+	}
+	if dflt := newBackendTransport("dns", DefaultConfig()); dflt.MaxIdleConnsPerHost != 0 || dflt.MaxConnsPerHost != 0 {
+		t.Errorf("expected Go's defaults without limits, got %d and %d", dflt.MaxIdleConnsPerHost, dflt.MaxConnsPerHost)
+	}
+	for _, v := range []string{"swift=1", "image=-1", "many"} {
+		if err := cfg.MaxConnsPerHost.Set(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
+
+// BenchmarkConcurrentServices sends concurrent requests spread across the
+// backend services through the dispatcher.
+func BenchmarkConcurrentServices(b *testing.B) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+	e := Endpoints{
+		Compute:      backend.URL,
+		Networking:   backend.URL,
+		LoadBalancer: backend.URL,
+		BlockStorage: backend.URL,
+		DNS:          backend.URL,
+		Image:        backend.URL,
+	}
+	ts := httptest.NewServer(NewDispatcher(e, func(c *Config) { _ = c.MaxIdleConnsPerHost.Set("64") }))
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}
+	paths := []string{"/servers", "/networks", "/lbaas/loadbalancers", "/volumes", "/zones", "/v2/images"}
+	var next atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := client.Get(ts.URL + paths[next.Add(1)%int64(len(paths))])
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			//nolint:errcheck // Response body Close() call
+			_ = resp.Body.Close()
+		}
+	})
+}
+
+func TestNormalizeSlash(t *testing.T) {
+	tests := []struct {
+		mode SlashMode
+		want map[string]string
+	}{
+		{mode: SlashNone, want: map[string]string{"/servers": "/servers", "/servers/": "/servers/"}},
+		{mode: SlashAdd, want: map[string]string{"/servers": "/servers/", "/servers/": "/servers/"}},
+		{mode: SlashStrip, want: map[string]string{"/servers": "/servers", "/servers/": "/servers", "/servers//": "/servers"}},
+	}
+	for _, tt := range tests {
+		ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.NormalizeSlash = tt.mode }))
+		for path, want := range tt.want {
+			if _, body := doRequest(t, http.MethodGet, ts.URL+path, nil); body != "compute: "+want {
+				t.Errorf("%s: %s: expected the backend to see %s, got %q", tt.mode, path, want, body)
+			}
+		}
+		ts.Close()
+	}
+
+	var m SlashMode
+	if err := m.Set("double"); err == nil {
+		t.Errorf("expected an error for an unsupported mode")
+	}
+}
+
+func TestSynthesizeHead(t *testing.T) {
+	// A backend without HEAD support, like some of the mocks.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Openstack-Request-Id", "req-1")
+		_, _ = w.Write([]byte(`{"flavors": []}`))
+	}))
+	defer backend.Close()
+
+	for _, synthesize := range []bool{false, true} {
+		ts := httptest.NewServer(NewDispatcher(Endpoints{Compute: backend.URL}, func(c *Config) { c.SynthesizeHead = synthesize }))
+		get, _ := doRequest(t, http.MethodGet, ts.URL+"/flavors", nil)
+		head, body := doRequest(t, http.MethodHead, ts.URL+"/flavors", nil)
+		ts.Close()
+
+		if !synthesize {
+			if head.StatusCode != http.StatusMethodNotAllowed {
+				t.Errorf("expected HEAD to pass through by default, got %d", head.StatusCode)
+			}
+			continue
+		}
+		if head.StatusCode != get.StatusCode || body != "" {
+			t.Errorf("expected HEAD to answer %d without body, got %d %q", get.StatusCode, head.StatusCode, body)
+		}
+		for _, h := range []string{"Content-Type", "Content-Length", "X-Openstack-Request-Id"} {
+			if head.Header.Get(h) != get.Header.Get(h) {
+				t.Errorf("%s: expected HEAD to match GET %q, got %q", h, get.Header.Get(h), head.Header.Get(h))
+			}
+		}
+	}
+}
+
+func TestRejectUnknownMethods(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.RejectUnknownMethods = reject }))
+		for _, tt := range []struct {
+			method, path string
+			allowed      bool
+		}{
+			{method: http.MethodPost, path: "/flavors", allowed: true},
+			{method: http.MethodDelete, path: "/flavors/1", allowed: true},
+			{method: http.MethodPost, path: "/servers/1/action", allowed: true},
+			{method: http.MethodDelete, path: "/flavors"},
+			{method: http.MethodPost, path: "/os-availability-zone"},
+		} {
+			resp, _ := doRequest(t, tt.method, ts.URL+tt.path, nil)
+			if !reject || tt.allowed {
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("reject %v: %s %s: expected the request to be proxied, got %d", reject, tt.method, tt.path, resp.StatusCode)
+				}
+				continue
+			}
+			if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") == "" {
+				t.Errorf("%s %s: expected 405 with an Allow header, got %d %q", tt.method, tt.path, resp.StatusCode, resp.Header.Get("Allow"))
+			}
+		}
+		ts.Close()
+	}
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.RejectUnknownMethods = true }))
+	defer ts.Close()
+	if resp, _ := doRequest(t, http.MethodDelete, ts.URL+"/flavors/", nil); resp.Header.Get("Allow") != "GET, HEAD, POST" {
+		t.Errorf("expected Allow: GET, HEAD, POST, got %q", resp.Header.Get("Allow"))
+	}
+}
+
+func TestBackendInstances(t *testing.T) {
+	mkBackend := func(name string) *httptest.Server {
+		hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name)
+		}))
+		t.Cleanup(hs.Close)
+		return hs
+	}
+	primary, second, third := mkBackend("primary"), mkBackend("second"), mkBackend("third")
+
+	ts := httptest.NewServer(NewDispatcher(Endpoints{Compute: primary.URL}, func(c *Config) {
+		_ = c.BackendInstances.Set("compute=" + second.URL + ",compute=c@" + third.URL)
+	}))
+	defer ts.Close()
+
+	var got []string
+	for i := 0; i < 6; i++ {
+		resp, body := doRequest(t, http.MethodGet, ts.URL+"/servers", nil)
+		got = append(got, resp.Header.Get(backendInstanceHeader)+"="+body)
+	}
+	want := "compute-0=primary,compute-1=second,c=third,compute-0=primary,compute-1=second,c=third"
+	if strings.Join(got, ",") != want {
+		t.Errorf("expected round-robin %s, got %v", want, got)
+	}
+
+	var l backendInstances
+	for _, v := range []string{"compute", "unknown=http://a", "compute=ftp://a", "compute=@http://a", "compute=compute-0@http://a", "compute=a@http://a,compute=a@http://b"} {
+		if err := l.Set(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	var conns atomic.Int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	ts := httptest.NewServer(NewDispatcher(Endpoints{Compute: backend.URL}, func(c *Config) { c.Prewarm = 3 }))
+	defer ts.Close()
+	if n := conns.Load(); n != 3 {
+		t.Fatalf("expected 3 prewarmed connections, got %d", n)
+	}
+
+	// The first requests reuse the prewarmed connections.
+	for i := 0; i < 3; i++ {
+		if _, body := doRequest(t, http.MethodGet, ts.URL+"/servers", nil); body != "ok" {
+			t.Fatalf("unexpected response %q", body)
+		}
+	}
+	if n := conns.Load(); n != 3 {
+		t.Errorf("expected no new connections, got %d", n-3)
+	}
+}
+
+func TestCorruptRate(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"servers": [{"id": "1", "name": "a"}]}` + "\n"))
+	}))
+	defer backend.Close()
+
+	corrupted := func(rate float64) int {
+		ts := httptest.NewServer(NewDispatcher(Endpoints{Compute: backend.URL}, func(c *Config) {
+			c.CorruptRate = probability(rate)
+			c.CorruptSeed = 1
+		}))
+		defer ts.Close()
+		n := 0
+		for i := 0; i < 50; i++ {
+			resp, body := doRequest(t, http.MethodGet, ts.URL+"/servers", nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d", resp.StatusCode)
+			}
+			if !json.Valid([]byte(body)) {
+				n++
+			}
+		}
+		return n
+	}
+	if n := corrupted(0.9); n < 35 {
+		t.Errorf("expected most responses to be invalid JSON at rate 0.9, got %d of 50", n)
+	}
+	if n := corrupted(0); n != 0 {
+		t.Errorf("expected no corruption by default, got %d of 50", n)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) {
+		c.ServerTiming = true
+		_ = c.Latency.Set("compute=20ms")
+	}))
+	defer ts.Close()
+
+	metric := regexp.MustCompile(`^(backend|latency);dur=\d+\.\d$`)
+	timings := func(path string) map[string]float64 {
+		resp, _ := doRequest(t, http.MethodGet, ts.URL+path, nil)
+		got := map[string]float64{}
+		for _, v := range resp.Header.Values("Server-Timing") {
+			for _, m := range strings.Split(v, ",") {
+				m = strings.TrimSpace(m)
+				if !metric.MatchString(m) {
+					t.Errorf("%s: malformed metric %q", path, m)
+					continue
+				}
+				name, dur, _ := strings.Cut(m, ";dur=")
+				got[name], _ = strconv.ParseFloat(dur, 64)
+			}
+		}
+		return got
+	}
+	if got := timings("/flavors"); len(got) != 2 || got["latency"] < 20 {
+		t.Errorf("expected backend and latency metrics with 20ms latency, got %v", got)
+	}
+	if got := timings("/networks"); len(got) != 1 || got["latency"] != 0 {
+		t.Errorf("expected a backend metric only, got %v", got)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/mock/ping", nil); resp.Header.Get("Server-Timing") != "" {
+		t.Errorf("expected no Server-Timing for the dispatcher's own endpoints")
+	}
+}
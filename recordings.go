@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRecordedBody limits the request and response body bytes kept per
+// recording.
+const maxRecordedBody = 64 << 10
+
+// recording is a request/response exchange captured by recordTraffic.
+type recording struct {
+	Time         time.Time   `json:"time"`
+	Method       string      `json:"method"`
+	Path         string      `json:"path"`
+	Query        string      `json:"query,omitempty"`
+	Header       http.Header `json:"header"`
+	RequestBody  string      `json:"request_body,omitempty"`
+	Status       int         `json:"status"`
+	ResponseBody string      `json:"response_body,omitempty"`
+	DurationMS   float64     `json:"duration_ms"`
+	// Truncated reports that a body exceeded maxRecordedBody.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// recordingBuffer is a ring buffer keeping the most recent recordings.
+type recordingBuffer struct {
+	mu      sync.Mutex
+	entries []recording
+	next    int
+	full    bool
+}
+
+func newRecordingBuffer(size int) *recordingBuffer {
+	return &recordingBuffer{entries: make([]recording, size)}
+}
+
+// add stores rec, dropping the oldest recording if the buffer is full.
+func (b *recordingBuffer) add(rec recording) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[b.next] = rec
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// list returns the recordings, oldest first.
+func (b *recordingBuffer) list() []recording {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		return append([]recording{}, b.entries[:b.next]...)
+	}
+	return append(append([]recording{}, b.entries[b.next:]...), b.entries[:b.next]...)
+}
+
+// clear drops all recordings.
+func (b *recordingBuffer) clear() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries = make([]recording, len(b.entries))
+	b.next, b.full = 0, false
+}
+
+// recordTraffic stores every exchange except those with the administration
+// endpoints in buf.
+func recordTraffic(next http.Handler, buf *recordingBuffer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, AdminPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		reqBody := &cappedBuffer{max: maxRecordedBody}
+		if r.Body != nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, reqBody), r.Body}
+		}
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK, body: cappedBuffer{max: maxRecordedBody}}
+		start := time.Now()
+		next.ServeHTTP(rw, r)
+		buf.add(recording{
+			Time:         start.UTC(),
+			Method:       r.Method,
+			Path:         r.URL.Path,
+			Query:        r.URL.RawQuery,
+			Header:       r.Header.Clone(),
+			RequestBody:  reqBody.String(),
+			Status:       rw.status,
+			ResponseBody: rw.body.String(),
+			DurationMS:   float64(time.Since(start)) / float64(time.Millisecond),
+			Truncated:    reqBody.truncated || rw.body.truncated,
+		})
+	})
+}
+
+// recordingWriter captures the status and the beginning of the body of a
+// response.
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        cappedBuffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	_, _ = w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// cappedBuffer keeps the first max bytes written to it.
+type cappedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); len(p) > room {
+		b.truncated = true
+		_, _ = b.Buffer.Write(p[:room])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecordingBufferRing(t *testing.T) {
+	buf := newRecordingBuffer(3)
+	for _, path := range []string{"/a", "/b", "/c", "/d"} {
+		buf.add(recording{Path: path})
+	}
+	var paths []string
+	for _, rec := range buf.list() {
+		paths = append(paths, rec.Path)
+	}
+	if got := strings.Join(paths, ","); got != "/b,/c,/d" {
+		t.Errorf("expected the three most recent recordings, oldest first, got %s", got)
+	}
+	buf.clear()
+	if n := len(buf.list()); n != 0 {
+		t.Errorf("expected no recordings after clear, got %d", n)
+	}
+}
+
+func TestRecordingsEndpoint(t *testing.T) {
+	opt := func(c *Config) {
+		c.EnableAdmin = true
+		c.Recordings = 10
+	}
+	ts := httptest.NewServer(buildDispatcherForTest(t, opt))
+	defer ts.Close()
+
+	doRequest(t, http.MethodPost, ts.URL+"/servers?reservation_id=r1", strings.NewReader(`{"server": {"name": "vm-1"}}`))
+	doRequest(t, http.MethodGet, ts.URL+"/unknown", nil)
+
+	var got struct {
+		Recordings []recording `json:"recordings"`
+	}
+	getJSON(t, ts.URL+"/mock/recordings", http.StatusOK, &got)
+	if len(got.Recordings) != 2 {
+		t.Fatalf("expected 2 recordings without the admin requests, got %+v", got.Recordings)
+	}
+	first := got.Recordings[0]
+	if first.Method != http.MethodPost || first.Path != "/servers" || first.Query != "reservation_id=r1" ||
+		first.RequestBody != `{"server": {"name": "vm-1"}}` || first.Status != http.StatusOK || first.ResponseBody != "compute: /servers" {
+		t.Errorf("unexpected recording %+v", first)
+	}
+	if got.Recordings[1].Status != http.StatusNotFound {
+		t.Errorf("expected the 404 to be recorded, got %+v", got.Recordings[1])
+	}
+
+	if resp, _ := doRequest(t, http.MethodDelete, ts.URL+"/mock/recordings", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 for DELETE, got %d", resp.StatusCode)
+	}
+	getJSON(t, ts.URL+"/mock/recordings", http.StatusOK, &got)
+	if len(got.Recordings) != 0 {
+		t.Errorf("expected no recordings after DELETE, got %d", len(got.Recordings))
+	}
+
+	// Without -recordings the endpoint is not available.
+	plain := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.EnableAdmin = true }))
+	defer plain.Close()
+	if resp, _ := doRequest(t, http.MethodGet, plain.URL+"/mock/recordings", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 without -recordings, got %d", resp.StatusCode)
+	}
+}
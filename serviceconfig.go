@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// serviceConfig is the -config file, a JSON document like
+//
+//	{"services": ["compute", "networking", "image"],
+//	 "routes": [{"prefix": "/os-simple-tenant-usage", "service": "compute"}]}
+//
+// Services lists the backend services to enable; nil enables all of them.
+// Routes adds prefix routes to the enabled services.
+type serviceConfig struct {
+	Services []string `json:"services"`
+	Routes   []Route  `json:"routes"`
+}
+
+// loadServiceConfig reads and validates the -config file at path.
+func loadServiceConfig(path string) (serviceConfig, error) {
+	var sc serviceConfig
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return sc, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&sc); err != nil {
+		return sc, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if err := sc.validate(); err != nil {
+		return sc, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return sc, nil
+}
+
+// validate reports unknown service names, duplicate services or prefixes and
+// routes to services that are not enabled.
+func (sc serviceConfig) validate() error {
+	seen := map[string]bool{}
+	for _, svc := range sc.Services {
+		if !isBackendService(svc) {
+			return fmt.Errorf("unknown service %q (want one of %s)", svc, strings.Join(backendServices, ", "))
+		}
+		if seen[svc] {
+			return fmt.Errorf("duplicate service %q", svc)
+		}
+		seen[svc] = true
+	}
+	prefixes := map[string]bool{}
+	for _, r := range sc.Routes {
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return fmt.Errorf("invalid prefix %q of route to %s (want a path starting with /)", r.Prefix, r.Service)
+		}
+		if prefixes[r.Prefix] {
+			return fmt.Errorf("duplicate prefix %q", r.Prefix)
+		}
+		prefixes[r.Prefix] = true
+		if !isBackendService(r.Service) {
+			return fmt.Errorf("unknown service %q of route %s (want one of %s)", r.Service, r.Prefix, strings.Join(backendServices, ", "))
+		}
+		if !sc.enabled(r.Service) {
+			return fmt.Errorf("route %s to %s, which is not enabled", r.Prefix, r.Service)
+		}
+	}
+	return nil
+}
+
+// enabled reports whether the backend service is enabled.
+func (sc serviceConfig) enabled(service string) bool {
+	if sc.Services == nil {
+		return true
+	}
+	for _, svc := range sc.Services {
+		if svc == service {
+			return true
+		}
+	}
+	return false
+}
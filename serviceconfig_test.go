@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadServiceConfig(t *testing.T) {
+	write := func(doc string) string {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	sc, err := loadServiceConfig(write(`{"services": ["compute", "networking"], "routes": [{"prefix": "/custom", "service": "networking"}]}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !sc.enabled("compute") || sc.enabled("image") || len(sc.Routes) != 1 {
+		t.Errorf("unexpected config %+v", sc)
+	}
+	if sc, err := loadServiceConfig(write(`{}`)); err != nil || !sc.enabled("image") {
+		t.Errorf("expected all services without a list, got %+v, %v", sc, err)
+	}
+
+	for doc, want := range map[string]string{
+		`{"services": ["compute", "swift"]}`:                                                       `unknown service "swift"`,
+		`{"services": ["compute", "compute"]}`:                                                     `duplicate service "compute"`,
+		`{"routes": [{"prefix": "/a", "service": "nova"}]}`:                                        `unknown service "nova"`,
+		`{"routes": [{"prefix": "a", "service": "compute"}]}`:                                      `invalid prefix "a"`,
+		`{"services": ["dns"], "routes": [{"prefix": "/a", "service": "compute"}]}`:                "not enabled",
+		`{"routes": [{"prefix": "/a", "service": "compute"}, {"prefix": "/a", "service": "dns"}]}`: `duplicate prefix "/a"`,
+		`{"service": ["compute"]}`:                                                                 "unknown field",
+	} {
+		if _, err := loadServiceConfig(write(doc)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", doc, want, err)
+		}
+	}
+}
+
+func TestCustomRoutesAndDisabledServices(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("networking: " + r.URL.Path))
+	}))
+	defer backend.Close()
+	ts := httptest.NewServer(NewDispatcher(Endpoints{Networking: backend.URL}, WithRoutes(Route{Prefix: "/v2.0/trunks", Service: "networking"})))
+	defer ts.Close()
+
+	if resp, body := doRequest(t, http.MethodGet, ts.URL+"/v2.0/trunks/1", nil); resp.StatusCode != http.StatusOK || body != "networking: /v2.0/trunks/1" {
+		t.Errorf("expected the custom route to reach networking, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/servers", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a service without backend, got %d", resp.StatusCode)
+	}
+	_, body := doRequest(t, http.MethodPost, ts.URL+"/v3/auth/tokens", nil)
+	if strings.Contains(body, `"type":"compute"`) || !strings.Contains(body, `"type":"network"`) {
+		t.Errorf("expected only the enabled services in the catalog, got %s", body)
+	}
+
+	// Quota routes and stubs belong to their service and are not routed
+	// without its backend either.
+	stubs := func(c *Config) {
+		c.NovaServices = true
+		c.Aggregates = true
+		c.ImageSchema = true
+		c.IPAvailability = true
+		c.AutoTopology = true
+		c.NeutronAgents = true
+	}
+	for _, tc := range []struct {
+		e     Endpoints
+		paths []string
+	}{
+		{Endpoints{Networking: backend.URL}, []string{
+			"/os-quota-sets/p", "/os-quota-sets/p?service=volume", "/v3/mock-project-id/os-quota-sets/p",
+			"/os-services", "/os-aggregates", "/v2/schemas/image",
+		}},
+		{Endpoints{Compute: backend.URL}, []string{
+			"/os-quota-sets/p?service=volume", "/v3/mock-project-id/os-quota-sets/p",
+			"/v2.0/network-ip-availabilities", "/v2.0/auto-allocated-topology/p", "/v2.0/agents",
+		}},
+	} {
+		for _, quotaStub := range []bool{false, true} {
+			ts := httptest.NewServer(NewDispatcher(tc.e, stubs, func(c *Config) { c.QuotaSets = quotaStub }))
+			for _, path := range tc.paths {
+				if resp, body := doRequest(t, http.MethodGet, ts.URL+path, nil); resp.StatusCode != http.StatusNotFound || !strings.HasPrefix(body, "no route for path") {
+					t.Errorf("quota stub %v: expected the 404 of unmatched paths for %s, got %d: %s", quotaStub, path, resp.StatusCode, body)
+				}
+			}
+			ts.Close()
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// StatusPath is the endpoint reporting uptime and request totals. Like
+// PingPath it is served regardless of Config.EnableAdmin.
+const StatusPath = AdminPathPrefix + "status"
+
+// processStart is the time the process started, for the reported uptime.
+var processStart = time.Now()
+
+// requestCounter counts the requests served by the dispatcher in total and
+// the requests forwarded to each backend service.
+type requestCounter struct {
+	total    atomic.Int64
+	services map[string]*atomic.Int64
+}
+
+func newRequestCounter() *requestCounter {
+	c := &requestCounter{services: map[string]*atomic.Int64{}}
+	for _, s := range backendServices {
+		c.services[s] = new(atomic.Int64)
+	}
+	return c
+}
+
+// wrap counts every request passed to next.
+func (c *requestCounter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.total.Add(1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwarded counts a request forwarded to the backend of service.
+func (c *requestCounter) forwarded(service string) {
+	if n, ok := c.services[service]; ok {
+		n.Add(1)
+	}
+}
+
+// reset restarts counting; the uptime is not affected.
+func (c *requestCounter) reset() {
+	c.total.Store(0)
+	for _, n := range c.services {
+		n.Store(0)
+	}
+}
+
+// serveStatus answers with the process uptime and the request totals.
+func (c *requestCounter) serveStatus(w http.ResponseWriter, r *http.Request, pretty bool) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	services := make(map[string]int64, len(c.services))
+	for s, n := range c.services {
+		services[s] = n.Load()
+	}
+	writeJSONFormatted(w, http.StatusOK, map[string]interface{}{
+		"started_at":     processStart.UTC().Format(time.RFC3339),
+		"uptime_seconds": time.Since(processStart).Seconds(),
+		"requests_total": c.total.Load(),
+		"requests":       services,
+	}, pretty)
+}
@@ -0,0 +1,558 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-http-utils/headers"
+)
+
+// stubClient queries the backends for the data synthetic responses are
+// derived from.
+var stubClient = &http.Client{Timeout: 10 * time.Second}
+
+// fetchJSON GETs path from the backend at base and decodes the JSON response
+// into v.
+func fetchJSON(base, path string, v interface{}) error {
+	resp, err := stubClient.Get(strings.TrimSuffix(base, "/") + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: backend returned %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// newIPAvailabilityStub serves the Neutron network IP availability API
+// (/v2.0/network-ip-availabilities[/{network_id}]), which the mock networking
+// backend does not implement. Availabilities are computed from the backend's
+// networks, subnets and ports: a subnet's total_ips is the size of its CIDR
+// minus the network, broadcast and gateway addresses, used_ips counts the
+// port fixed IPs allocated in it.
+func newIPAvailabilityStub(networkingBase string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var networks struct {
+			Networks []struct {
+				ID        string `json:"id"`
+				Name      string `json:"name"`
+				ProjectID string `json:"project_id"`
+				TenantID  string `json:"tenant_id"`
+			} `json:"networks"`
+		}
+		var subnets struct {
+			Subnets []struct {
+				ID        string `json:"id"`
+				Name      string `json:"name"`
+				NetworkID string `json:"network_id"`
+				CIDR      string `json:"cidr"`
+				IPVersion int    `json:"ip_version"`
+			} `json:"subnets"`
+		}
+		var ports struct {
+			Ports []struct {
+				FixedIPs []struct {
+					SubnetID string `json:"subnet_id"`
+				} `json:"fixed_ips"`
+			} `json:"ports"`
+		}
+		for path, v := range map[string]interface{}{"/v2.0/networks": &networks, "/subnets": &subnets, "/ports": &ports} {
+			if err := fetchJSON(networkingBase, path, v); err != nil {
+				writeJSONError(w, http.StatusBadGateway, err.Error())
+				return
+			}
+		}
+		used := map[string]int64{}
+		for _, port := range ports.Ports {
+			for _, ip := range port.FixedIPs {
+				used[ip.SubnetID]++
+			}
+		}
+
+		availabilities := make([]map[string]interface{}, 0, len(networks.Networks))
+		for _, n := range networks.Networks {
+			projectID := n.ProjectID
+			if projectID == "" {
+				projectID = n.TenantID
+			}
+			var total, usedTotal int64
+			subnetAvailabilities := []map[string]interface{}{}
+			for _, s := range subnets.Subnets {
+				if s.NetworkID != n.ID {
+					continue
+				}
+				subnetTotal := usableIPs(s.CIDR)
+				total += subnetTotal
+				usedTotal += used[s.ID]
+				subnetAvailabilities = append(subnetAvailabilities, map[string]interface{}{
+					"subnet_id":   s.ID,
+					"subnet_name": s.Name,
+					"cidr":        s.CIDR,
+					"ip_version":  s.IPVersion,
+					"total_ips":   subnetTotal,
+					"used_ips":    used[s.ID],
+				})
+			}
+			availabilities = append(availabilities, map[string]interface{}{
+				"network_id":             n.ID,
+				"network_name":           n.Name,
+				"project_id":             projectID,
+				"tenant_id":              projectID,
+				"total_ips":              total,
+				"used_ips":               usedTotal,
+				"subnet_ip_availability": subnetAvailabilities,
+			})
+		}
+
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v2.0/network-ip-availabilities"), "/")
+		if id == "" {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"network_ip_availabilities": availabilities})
+			return
+		}
+		for _, a := range availabilities {
+			if a["network_id"] == id {
+				writeJSON(w, http.StatusOK, map[string]interface{}{"network_ip_availability": a})
+				return
+			}
+		}
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("network %s could not be found", id))
+	})
+}
+
+// newAutoTopologyStub serves the Neutron auto-allocated topology API
+// (/v2.0/auto-allocated-topology/{project_id}), which the mock networking
+// backend does not implement. The topology is a network of the backend,
+// preferably one with a subnet; GET answers with 404 if there is none.
+func newAutoTopologyStub(networkingBase string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		project := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v2.0/auto-allocated-topology"), "/")
+		if project == "" || strings.Contains(project, "/") {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no auto-allocated topology at %s", r.URL.Path))
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var networks struct {
+			Networks []struct {
+				ID string `json:"id"`
+			} `json:"networks"`
+		}
+		var subnets struct {
+			Subnets []struct {
+				NetworkID string `json:"network_id"`
+			} `json:"subnets"`
+		}
+		for path, v := range map[string]interface{}{"/v2.0/networks": &networks, "/subnets": &subnets} {
+			if err := fetchJSON(networkingBase, path, v); err != nil {
+				writeJSONError(w, http.StatusBadGateway, err.Error())
+				return
+			}
+		}
+		if len(networks.Networks) == 0 {
+			writeJSONError(w, http.StatusNotFound, "no network available for the auto-allocated topology")
+			return
+		}
+		withSubnet := map[string]bool{}
+		for _, s := range subnets.Subnets {
+			withSubnet[s.NetworkID] = true
+		}
+		id := networks.Networks[0].ID
+		for _, n := range networks.Networks {
+			if withSubnet[n.ID] {
+				id = n.ID
+				break
+			}
+		}
+		topology := map[string]interface{}{"id": id, "project_id": project, "tenant_id": project}
+		if r.URL.Query().Get("fields") == "dry-run" {
+			topology = map[string]interface{}{"dry-run": "pass"}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"auto_allocated_topology": topology})
+	})
+}
+
+// usableIPs returns the number of addresses of cidr available for
+// allocation, i.e. without the network, broadcast and gateway addresses.
+func usableIPs(cidr string) int64 {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 0
+	}
+	ones, bits := ipNet.Mask.Size()
+	hostBits := bits - ones
+	if hostBits >= 63 {
+		return math.MaxInt64
+	}
+	if n := int64(1)<<hostBits - 3; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// newNovaServicesStub serves GET /os-services, which the mock compute backend
+// does not implement, with a fixed set of Nova services that are all enabled
+// and up: conductor and scheduler on a controller host and one nova-compute
+// agent.
+func newNovaServicesStub() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		updated := time.Now().UTC().Format("2006-01-02T15:04:05.000000")
+		services := []map[string]interface{}{}
+		for i, svc := range []struct{ binary, host, zone string }{
+			{"nova-conductor", "mock-controller", "internal"},
+			{"nova-scheduler", "mock-controller", "internal"},
+			{"nova-compute", "mock-compute-1", "nova"},
+		} {
+			services = append(services, map[string]interface{}{
+				"id":              i + 1,
+				"binary":          svc.binary,
+				"host":            svc.host,
+				"zone":            svc.zone,
+				"status":          "enabled",
+				"state":           "up",
+				"updated_at":      updated,
+				"disabled_reason": nil,
+				"forced_down":     false,
+			})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"services": services})
+	})
+}
+
+// mockNeutronAgents are the agents of the Neutron agents stub, on the hosts
+// of the Nova services stub.
+var mockNeutronAgents = []struct {
+	agentType, binary, host, topic string
+}{
+	{"Open vSwitch agent", "neutron-openvswitch-agent", "mock-compute-1", "N/A"},
+	{"Open vSwitch agent", "neutron-openvswitch-agent", "mock-controller", "N/A"},
+	{"DHCP agent", "neutron-dhcp-agent", "mock-controller", "dhcp_agent"},
+	{"L3 agent", "neutron-l3-agent", "mock-controller", "l3_agent"},
+	{"Metadata agent", "neutron-metadata-agent", "mock-controller", "N/A"},
+}
+
+// newNeutronAgentsStub serves GET /v2.0/agents and /v2.0/agents/{id}, which
+// the mock networking backend does not implement, with mockNeutronAgents, all
+// alive. The list can be filtered by agent_type, binary and host.
+func newNeutronAgentsStub() http.Handler {
+	started := time.Now().UTC().Format("2006-01-02 15:04:05")
+	agents := make([]map[string]interface{}, 0, len(mockNeutronAgents))
+	for _, a := range mockNeutronAgents {
+		agents = append(agents, map[string]interface{}{
+			"id":                  newID(true, "agent", a.binary, a.host),
+			"agent_type":          a.agentType,
+			"binary":              a.binary,
+			"host":                a.host,
+			"topic":               a.topic,
+			"alive":               true,
+			"admin_state_up":      true,
+			"availability_zone":   nil,
+			"configurations":      map[string]interface{}{},
+			"description":         nil,
+			"created_at":          started,
+			"started_at":          started,
+			"heartbeat_timestamp": started,
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v2.0/agents"), "/")
+		if id == "" {
+			q := r.URL.Query()
+			list := []map[string]interface{}{}
+			for _, a := range agents {
+				if matchesFilters(a, q, "agent_type", "binary", "host") {
+					list = append(list, a)
+				}
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"agents": list})
+			return
+		}
+		for _, a := range agents {
+			if a["id"] == id {
+				writeJSON(w, http.StatusOK, map[string]interface{}{"agent": a})
+				return
+			}
+		}
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Agent %s could not be found.", id))
+	})
+}
+
+// matchesFilters reports whether the string fields of item match the query
+// parameters of the given names that are set.
+func matchesFilters(item map[string]interface{}, q url.Values, names ...string) bool {
+	for _, name := range names {
+		if v := q.Get(name); v != "" && item[name] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// mockAggregates are the host aggregates of the aggregates stub, grouping the
+// hosts of the Nova services stub.
+var mockAggregates = []struct {
+	name, zone string
+	hosts      []string
+}{
+	{"mock-compute", "nova", []string{"mock-compute-1"}},
+	{"mock-controller", "internal", []string{"mock-controller"}},
+}
+
+// newAggregatesStub serves GET /os-aggregates and /os-aggregates/{id}, which
+// the mock compute backend does not implement, with mockAggregates.
+func newAggregatesStub() http.Handler {
+	created := time.Now().UTC().Format("2006-01-02T15:04:05.000000")
+	aggregates := make([]map[string]interface{}, 0, len(mockAggregates))
+	for i, a := range mockAggregates {
+		aggregates = append(aggregates, map[string]interface{}{
+			"id":                i + 1,
+			"uuid":              newID(true, "aggregate", a.name),
+			"name":              a.name,
+			"availability_zone": a.zone,
+			"hosts":             a.hosts,
+			"metadata":          map[string]string{"availability_zone": a.zone},
+			"created_at":        created,
+			"updated_at":        nil,
+			"deleted":           false,
+			"deleted_at":        nil,
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/os-aggregates"), "/")
+		if id == "" {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"aggregates": aggregates})
+			return
+		}
+		for _, a := range aggregates {
+			if fmt.Sprint(a["id"]) == id {
+				writeJSON(w, http.StatusOK, map[string]interface{}{"aggregate": a})
+				return
+			}
+		}
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Aggregate %s could not be found.", id))
+	})
+}
+
+// imageSchema is a minimal Glance image schema, covering the properties
+// clients commonly validate.
+var imageSchema = map[string]interface{}{
+	"name": "image",
+	"properties": map[string]interface{}{
+		"id":               map[string]interface{}{"type": "string", "pattern": "^([0-9a-fA-F]){8}-([0-9a-fA-F]){4}-([0-9a-fA-F]){4}-([0-9a-fA-F]){4}-([0-9a-fA-F]){12}$"},
+		"name":             map[string]interface{}{"type": []interface{}{"null", "string"}, "maxLength": 255},
+		"status":           map[string]interface{}{"type": "string", "readOnly": true, "enum": []string{"queued", "saving", "active", "killed", "deleted", "uploading", "importing", "pending_delete", "deactivated"}},
+		"visibility":       map[string]interface{}{"type": "string", "enum": []string{"community", "public", "private", "shared"}},
+		"container_format": map[string]interface{}{"type": []interface{}{"null", "string"}, "enum": []interface{}{nil, "ami", "ari", "aki", "bare", "ovf", "ova", "docker", "compressed"}},
+		"disk_format":      map[string]interface{}{"type": []interface{}{"null", "string"}, "enum": []interface{}{nil, "ami", "ari", "aki", "vhd", "vhdx", "vmdk", "raw", "qcow2", "vdi", "iso", "ploop"}},
+		"size":             map[string]interface{}{"type": []interface{}{"null", "integer"}, "readOnly": true},
+		"checksum":         map[string]interface{}{"type": []interface{}{"null", "string"}, "readOnly": true, "maxLength": 32},
+		"min_disk":         map[string]interface{}{"type": "integer", "minimum": 0},
+		"min_ram":          map[string]interface{}{"type": "integer", "minimum": 0},
+		"protected":        map[string]interface{}{"type": "boolean"},
+		"tags":             map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string", "maxLength": 255}},
+		"created_at":       map[string]interface{}{"type": "string", "readOnly": true},
+		"updated_at":       map[string]interface{}{"type": "string", "readOnly": true},
+		"self":             map[string]interface{}{"type": "string", "readOnly": true},
+		"file":             map[string]interface{}{"type": "string", "readOnly": true},
+		"schema":           map[string]interface{}{"type": "string", "readOnly": true},
+	},
+	"additionalProperties": map[string]interface{}{"type": "string"},
+	"links": []map[string]string{
+		{"rel": "self", "href": "{self}"},
+		{"rel": "enclosure", "href": "{file}"},
+		{"rel": "describedby", "href": "{schema}"},
+	},
+}
+
+// newImageSchemaStub serves GET /v2/schemas/image, which the mock image
+// backend does not implement, with imageSchema. Other paths sharing the
+// prefix, like /v2/schemas/images, are passed to next.
+func newImageSchemaStub(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.TrimSuffix(r.URL.Path, "/") != "/v2/schemas/image" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, imageSchema)
+	})
+}
+
+// computeQuotaLimits are the limits of the Nova quota set stub.
+var computeQuotaLimits = map[string]int{
+	"instances":            10,
+	"cores":                20,
+	"ram":                  51200,
+	"key_pairs":            100,
+	"metadata_items":       128,
+	"server_groups":        10,
+	"server_group_members": 10,
+}
+
+// volumeQuotaLimits are the limits of the Cinder quota set stub.
+var volumeQuotaLimits = map[string]int{
+	"volumes":              10,
+	"gigabytes":            1000,
+	"snapshots":            10,
+	"backups":              10,
+	"backup_gigabytes":     1000,
+	"per_volume_gigabytes": -1,
+	"groups":               10,
+}
+
+// newQuotaSetsStub serves GET .../os-quota-sets/{project_id}[/defaults] with
+// the given limits for any project. .../os-quota-sets/{project_id}/detail
+// (Nova) and ?usage=true (Cinder) report each limit with zero usage.
+func newQuotaSetsStub(limits map[string]int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		_, rest, _ := strings.Cut(r.URL.Path, "/os-quota-sets")
+		project, view, _ := strings.Cut(strings.Trim(rest, "/"), "/")
+		if project == "" || (view != "" && view != "defaults" && view != "detail") {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no quota set at %s", r.URL.Path))
+			return
+		}
+		detail := view == "detail" || r.URL.Query().Get("usage") == "true"
+		quotaSet := map[string]interface{}{"id": project}
+		for k, v := range limits {
+			if detail {
+				quotaSet[k] = map[string]int{"limit": v, "in_use": 0, "reserved": 0}
+			} else {
+				quotaSet[k] = v
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"quota_set": quotaSet})
+	})
+}
+
+// serveFixedResponses answers GET requests for the paths in responses with
+// the given JSON documents instead of passing them to next. "{{base}}" in a
+// document is replaced by the dispatcher's base URL, so that links point back
+// to it. Other methods and paths are passed on.
+func serveFixedResponses(next http.Handler, responses map[string][]byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc, ok := responses[r.URL.Path]
+		if !ok || r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set(headers.ContentType, "application/json")
+		_, _ = w.Write(bytes.ReplaceAll(doc, []byte("{{base}}"), []byte(requestBase(r))))
+	})
+}
+
+// isListDocument reports whether b is a JSON object with a list member, like
+// {"images": [...]}.
+func isListDocument(b []byte) bool {
+	var doc map[string]json.RawMessage
+	if json.Unmarshal(b, &doc) != nil {
+		return false
+	}
+	for _, v := range doc {
+		if bytes.HasPrefix(bytes.TrimSpace(v), []byte("[")) {
+			return true
+		}
+	}
+	return false
+}
+
+// syntheticListFlushItems is the number of items of a synthetic list written
+// between flushes.
+const syntheticListFlushItems = 100
+
+// serveSyntheticLists answers GET requests for the paths of rules with a
+// list of generated items, named after the path's last segment. The list is
+// encoded and flushed incrementally, so that it is never held in memory and
+// slow clients exert backpressure. Other methods and paths are passed on.
+func serveSyntheticLists(next http.Handler, rules syntheticListRules) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := slices.IndexFunc(rules, func(rule syntheticListRule) bool { return rule.Path == r.URL.Path })
+		if i < 0 || r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rule := rules[i]
+		name := path.Base(rule.Path)
+		w.Header().Set(headers.ContentType, "application/json")
+		rc := http.NewResponseController(w)
+		enc := json.NewEncoder(w)
+		if _, err := fmt.Fprintf(w, "{%q: [", name); err != nil {
+			return
+		}
+		for n := 1; n <= rule.Count; n++ {
+			if n > 1 {
+				if _, err := w.Write([]byte(",")); err != nil {
+					return
+				}
+			}
+			item := map[string]string{
+				"id":   newID(true, rule.Path, strconv.Itoa(n)),
+				"name": fmt.Sprintf("%s-%d", name, n),
+			}
+			if err := enc.Encode(item); err != nil {
+				return
+			}
+			if n%syntheticListFlushItems == 0 {
+				_ = rc.Flush()
+			}
+		}
+		_, _ = w.Write([]byte("]}"))
+	})
+}
+
+// newOrchestrationStub returns a minimal Heat backend, as kops' cloudmock has
+// none: GET /stacks returns an empty list and every stack is unknown.
+func newOrchestrationStub() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s is not supported by the orchestration stub", r.Method))
+			return
+		}
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/stacks"), "/")
+		if name == "" {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"stacks": []interface{}{}})
+			return
+		}
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("The Stack (%s) could not be found.", name))
+	})
+}
@@ -0,0 +1,441 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newJSONBackend serves the given JSON documents keyed by request path.
+func newJSONBackend(t *testing.T, docs map[string]string) *httptest.Server {
+	t.Helper()
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc, ok := docs[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(doc))
+	}))
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+// getJSON GETs url, checks the status and decodes the response into v.
+func getJSON(t *testing.T, url string, wantStatus int, v interface{}) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != wantStatus {
+		t.Fatalf("GET %s: expected %d, got %d", url, wantStatus, resp.StatusCode)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("decoding %s failed: %v", url, err)
+		}
+	}
+}
+
+func TestIPAvailabilityStub(t *testing.T) {
+	networking := newJSONBackend(t, map[string]string{
+		"/v2.0/networks": `{"networks": [{"id": "net-1", "name": "private", "tenant_id": "p-1"}]}`,
+		"/subnets":       `{"subnets": [{"id": "sub-1", "network_id": "net-1", "cidr": "10.0.0.0/24", "ip_version": 4}]}`,
+		"/ports":         `{"ports": [{"fixed_ips": [{"subnet_id": "sub-1"}]}, {"fixed_ips": [{"subnet_id": "sub-1"}]}]}`,
+	})
+	ts := httptest.NewServer(NewDispatcher(Endpoints{Networking: networking.URL}, func(c *Config) { c.IPAvailability = true }))
+	defer ts.Close()
+
+	type availability struct {
+		NetworkID string `json:"network_id"`
+		ProjectID string `json:"project_id"`
+		TotalIPs  int64  `json:"total_ips"`
+		UsedIPs   int64  `json:"used_ips"`
+		Subnets   []struct {
+			SubnetID string `json:"subnet_id"`
+			TotalIPs int64  `json:"total_ips"`
+		} `json:"subnet_ip_availability"`
+	}
+	var list struct {
+		Availabilities []availability `json:"network_ip_availabilities"`
+	}
+	getJSON(t, ts.URL+"/v2.0/network-ip-availabilities", http.StatusOK, &list)
+	if len(list.Availabilities) != 1 {
+		t.Fatalf("expected one availability, got %+v", list.Availabilities)
+	}
+	a := list.Availabilities[0]
+	if a.NetworkID != "net-1" || a.ProjectID != "p-1" || a.TotalIPs != 253 || a.UsedIPs != 2 || len(a.Subnets) != 1 || a.Subnets[0].TotalIPs != 253 {
+		t.Errorf("unexpected availability: %+v", a)
+	}
+
+	var single struct {
+		Availability availability `json:"network_ip_availability"`
+	}
+	getJSON(t, ts.URL+"/v2.0/network-ip-availabilities/net-1", http.StatusOK, &single)
+	if single.Availability.NetworkID != "net-1" {
+		t.Errorf("unexpected availability: %+v", single.Availability)
+	}
+	getJSON(t, ts.URL+"/v2.0/network-ip-availabilities/net-2", http.StatusNotFound, nil)
+}
+
+func TestAutoTopologyStub(t *testing.T) {
+	networking := newJSONBackend(t, map[string]string{
+		"/v2.0/networks": `{"networks": [{"id": "net-1"}, {"id": "net-2"}]}`,
+		"/subnets":       `{"subnets": [{"id": "sub-1", "network_id": "net-2"}]}`,
+	})
+	ts := httptest.NewServer(NewDispatcher(Endpoints{Networking: networking.URL}, func(c *Config) { c.AutoTopology = true }))
+	defer ts.Close()
+
+	var topology struct {
+		Topology map[string]string `json:"auto_allocated_topology"`
+	}
+	getJSON(t, ts.URL+"/v2.0/auto-allocated-topology/p-1", http.StatusOK, &topology)
+	if topology.Topology["id"] != "net-2" || topology.Topology["project_id"] != "p-1" {
+		t.Errorf("expected the network with a subnet for project p-1, got %v", topology.Topology)
+	}
+	getJSON(t, ts.URL+"/v2.0/auto-allocated-topology/p-1?fields=dry-run", http.StatusOK, &topology)
+	if topology.Topology["dry-run"] != "pass" {
+		t.Errorf("expected a passed dry run, got %v", topology.Topology)
+	}
+	if resp, _ := doRequest(t, http.MethodDelete, ts.URL+"/v2.0/auto-allocated-topology/p-1", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected 204 for DELETE, got %d", resp.StatusCode)
+	}
+
+	empty := newJSONBackend(t, map[string]string{
+		"/v2.0/networks": `{"networks": []}`,
+		"/subnets":       `{"subnets": []}`,
+	})
+	ts2 := httptest.NewServer(NewDispatcher(Endpoints{Networking: empty.URL}, func(c *Config) { c.AutoTopology = true }))
+	defer ts2.Close()
+	getJSON(t, ts2.URL+"/v2.0/auto-allocated-topology/p-1", http.StatusNotFound, nil)
+}
+
+func TestNovaServicesStub(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.NovaServices = true }))
+	defer ts.Close()
+
+	var list struct {
+		Services []struct {
+			Binary string `json:"binary"`
+			Host   string `json:"host"`
+			State  string `json:"state"`
+		} `json:"services"`
+	}
+	getJSON(t, ts.URL+"/os-services", http.StatusOK, &list)
+	var computes int
+	for _, svc := range list.Services {
+		if svc.Host == "" || svc.State != "up" {
+			t.Errorf("unexpected service: %+v", svc)
+		}
+		if svc.Binary == "nova-compute" {
+			computes++
+		}
+	}
+	if computes != 1 {
+		t.Errorf("expected one nova-compute agent, got %+v", list.Services)
+	}
+}
+
+func TestAggregatesStub(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.Aggregates = true }))
+	defer ts.Close()
+
+	type aggregate struct {
+		ID               int      `json:"id"`
+		Name             string   `json:"name"`
+		AvailabilityZone string   `json:"availability_zone"`
+		Hosts            []string `json:"hosts"`
+	}
+	var list struct {
+		Aggregates []aggregate `json:"aggregates"`
+	}
+	getJSON(t, ts.URL+"/os-aggregates", http.StatusOK, &list)
+	if len(list.Aggregates) != 2 {
+		t.Fatalf("expected two aggregates, got %+v", list.Aggregates)
+	}
+	for _, a := range list.Aggregates {
+		if a.Name == "" || a.AvailabilityZone == "" || len(a.Hosts) == 0 {
+			t.Errorf("unexpected aggregate: %+v", a)
+		}
+	}
+
+	var single struct {
+		Aggregate aggregate `json:"aggregate"`
+	}
+	getJSON(t, ts.URL+"/os-aggregates/2", http.StatusOK, &single)
+	if single.Aggregate.ID != 2 || single.Aggregate.Name != list.Aggregates[1].Name {
+		t.Errorf("expected %+v, got %+v", list.Aggregates[1], single.Aggregate)
+	}
+	getJSON(t, ts.URL+"/os-aggregates/3", http.StatusNotFound, nil)
+}
+
+func TestImageSchemaStub(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.ImageSchema = true }))
+	defer ts.Close()
+
+	var schema struct {
+		Name       string                            `json:"name"`
+		Properties map[string]map[string]interface{} `json:"properties"`
+	}
+	getJSON(t, ts.URL+"/v2/schemas/image", http.StatusOK, &schema)
+	if schema.Name != "image" {
+		t.Errorf("expected the image schema, got %q", schema.Name)
+	}
+	for _, prop := range []string{"id", "name", "status", "disk_format", "container_format", "visibility"} {
+		if _, ok := schema.Properties[prop]; !ok {
+			t.Errorf("expected property %s in %v", prop, schema.Properties)
+		}
+	}
+
+	// Other schemas are still proxied.
+	if _, body := doRequest(t, http.MethodGet, ts.URL+"/v2/schemas/images", nil); body != "image: /v2/schemas/images" {
+		t.Errorf("expected the images schema to be proxied, got %q", body)
+	}
+}
+
+func TestNeutronAgentsStub(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.NeutronAgents = true }))
+	defer ts.Close()
+
+	type agent struct {
+		ID        string `json:"id"`
+		AgentType string `json:"agent_type"`
+		Host      string `json:"host"`
+		Alive     bool   `json:"alive"`
+	}
+	var list struct {
+		Agents []agent `json:"agents"`
+	}
+	getJSON(t, ts.URL+"/v2.0/agents", http.StatusOK, &list)
+	if len(list.Agents) != 5 {
+		t.Fatalf("expected five agents, got %+v", list.Agents)
+	}
+	for _, a := range list.Agents {
+		if a.AgentType == "" || a.Host == "" || !a.Alive {
+			t.Errorf("unexpected agent: %+v", a)
+		}
+	}
+
+	list.Agents = nil
+	getJSON(t, ts.URL+"/v2.0/agents?agent_type=L3+agent", http.StatusOK, &list)
+	if len(list.Agents) != 1 || list.Agents[0].Host != "mock-controller" {
+		t.Fatalf("expected the L3 agent, got %+v", list.Agents)
+	}
+	var single struct {
+		Agent agent `json:"agent"`
+	}
+	getJSON(t, ts.URL+"/v2.0/agents/"+list.Agents[0].ID, http.StatusOK, &single)
+	if single.Agent != list.Agents[0] {
+		t.Errorf("expected %+v, got %+v", list.Agents[0], single.Agent)
+	}
+	getJSON(t, ts.URL+"/v2.0/agents/unknown", http.StatusNotFound, nil)
+}
+
+func TestQuotaSetsStub(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.QuotaSets = true }))
+	defer ts.Close()
+
+	var quotas struct {
+		QuotaSet map[string]interface{} `json:"quota_set"`
+	}
+	for path, want := range map[string]string{
+		"/os-quota-sets/p1":                    "instances",
+		"/os-quota-sets/p1/defaults":           "instances",
+		"/os-quota-sets/p1?service=volume":     "volumes",
+		"/v3/mock-project-id/os-quota-sets/p1": "volumes",
+	} {
+		quotas.QuotaSet = nil
+		getJSON(t, ts.URL+path, http.StatusOK, &quotas)
+		if quotas.QuotaSet["id"] != "p1" || quotas.QuotaSet[want] != float64(10) {
+			t.Errorf("%s: expected quota set of p1 with %s, got %v", path, want, quotas.QuotaSet)
+		}
+	}
+
+	// Detailed views report the usage along with the limit.
+	for path, key := range map[string]string{
+		"/os-quota-sets/p1/detail":                        "cores",
+		"/v3/mock-project-id/os-quota-sets/p1?usage=true": "gigabytes",
+	} {
+		quotas.QuotaSet = nil
+		getJSON(t, ts.URL+path, http.StatusOK, &quotas)
+		if q, ok := quotas.QuotaSet[key].(map[string]interface{}); !ok || q["in_use"] != float64(0) || q["limit"] == nil {
+			t.Errorf("%s: expected %s with limit and usage, got %v", path, key, quotas.QuotaSet[key])
+		}
+	}
+	getJSON(t, ts.URL+"/os-quota-sets/", http.StatusNotFound, nil)
+}
+
+func TestForceList(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "image-list.json")
+	doc := `{"images": [{"id": "img-1", "name": "cirros"}]}`
+	if err := os.WriteFile(file, []byte(doc), 0o600); err != nil {
+		t.Fatalf("writing list failed: %v", err)
+	}
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { _ = c.ForceList.Set("/v2/images:" + file) }))
+	defer ts.Close()
+
+	for _, path := range []string{"/v2/images", "/v2/images?name=cirros"} {
+		if _, body := doRequest(t, http.MethodGet, ts.URL+path, nil); body != doc {
+			t.Errorf("%s: expected the forced list, got %s", path, body)
+		}
+	}
+	if _, body := doRequest(t, http.MethodPost, ts.URL+"/v2/images", nil); body != "image: /v2/images" {
+		t.Errorf("expected POST to be proxied, got %q", body)
+	}
+
+	for b, want := range map[string]bool{doc: true, `{"image": {"id": "img-1"}}`: false, `[]`: false} {
+		if got := isListDocument([]byte(b)); got != want {
+			t.Errorf("%s: expected list document %v, got %v", b, want, got)
+		}
+	}
+}
+
+func TestFixedResponses(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "flavors.json")
+	doc := `{"flavors": [{"id": "1", "links": [{"rel": "self", "href": "{{base}}/flavors/1"}]}]}`
+	if err := os.WriteFile(file, []byte(doc), 0o600); err != nil {
+		t.Fatalf("writing response failed: %v", err)
+	}
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { _ = c.Respond.Set("/flavors:" + file) }))
+	defer ts.Close()
+
+	resp, body := doRequest(t, http.MethodGet, ts.URL+"/flavors", nil)
+	if want := strings.ReplaceAll(doc, "{{base}}", ts.URL); body != want {
+		t.Errorf("expected the templated file %s, got %s", want, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json, got %q", ct)
+	}
+	// Other methods and paths are proxied.
+	if _, body = doRequest(t, http.MethodPost, ts.URL+"/flavors", nil); body != "compute: /flavors" {
+		t.Errorf("expected POST to be proxied, got %q", body)
+	}
+	if _, body = doRequest(t, http.MethodGet, ts.URL+"/flavors/1", nil); body != "compute: /flavors/1" {
+		t.Errorf("expected other paths to be proxied, got %q", body)
+	}
+}
+
+func TestSyntheticList(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { _ = c.SyntheticLists.Set("/servers:10000,/v2.0/networks:0") }))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/servers")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("expected a streamed response, got Transfer-Encoding %v", resp.TransferEncoding)
+	}
+	var list struct {
+		Servers []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"servers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("decoding list failed: %v", err)
+	}
+	if len(list.Servers) != 10000 || list.Servers[9999].Name != "servers-10000" || list.Servers[0].ID == list.Servers[1].ID {
+		t.Errorf("expected 10000 distinct servers, got %d", len(list.Servers))
+	}
+
+	var empty map[string][]interface{}
+	getJSON(t, ts.URL+"/v2.0/networks", http.StatusOK, &empty)
+	if l, ok := empty["networks"]; !ok || len(l) != 0 {
+		t.Errorf("expected an empty network list, got %v", empty)
+	}
+	// Other paths and methods are proxied.
+	if _, body := doRequest(t, http.MethodGet, ts.URL+"/servers/1", nil); body != "compute: /servers/1" {
+		t.Errorf("expected item requests to be proxied, got %q", body)
+	}
+	if _, body := doRequest(t, http.MethodPost, ts.URL+"/servers", nil); body != "compute: /servers" {
+		t.Errorf("expected POST to be proxied, got %q", body)
+	}
+}
+
+func TestKeyManager(t *testing.T) {
+	backend := httptest.NewServer(newKeyManager())
+	defer backend.Close()
+	ts := httptest.NewServer(NewDispatcher(Endpoints{KeyManager: backend.URL}))
+	defer ts.Close()
+
+	resp, body := doRequest(t, http.MethodPost, ts.URL+"/v1/secrets", strings.NewReader(`{"name": "db-key", "payload": "s3cr3t"}`))
+	var created struct {
+		SecretRef string `json:"secret_ref"`
+	}
+	if resp.StatusCode != http.StatusCreated || json.Unmarshal([]byte(body), &created) != nil {
+		t.Fatalf("expected 201 with a secret ref, got %d: %s", resp.StatusCode, body)
+	}
+	// The ref points at the dispatcher, not the backend.
+	if !strings.HasPrefix(created.SecretRef, ts.URL+"/v1/secrets/") {
+		t.Errorf("expected a ref below %s/v1/secrets/, got %s", ts.URL, created.SecretRef)
+	}
+	if resp, body := doRequest(t, http.MethodGet, created.SecretRef+"/payload", nil); resp.StatusCode != http.StatusOK || body != "s3cr3t" {
+		t.Errorf("expected the payload, got %d: %s", resp.StatusCode, body)
+	}
+	resp, body = doRequest(t, http.MethodPost, ts.URL+"/v1/containers", strings.NewReader(`{"name": "tls", "secret_refs": [{"name": "key", "secret_ref": "`+created.SecretRef+`"}]}`))
+	if resp.StatusCode != http.StatusCreated || !strings.Contains(body, `"container_ref":"`+ts.URL+"/v1/containers/") {
+		t.Errorf("expected 201 with a container ref, got %d: %s", resp.StatusCode, body)
+	}
+	for _, p := range []string{"/v1/secrets", "/v1/secrets/", "/v1/containers", "/v1/containers/"} {
+		if resp, body := doRequest(t, http.MethodGet, ts.URL+p, nil); resp.StatusCode != http.StatusOK || !strings.Contains(body, `"total":1`) {
+			t.Errorf("GET %s: expected a list of one, got %d: %s", p, resp.StatusCode, body)
+		}
+	}
+	if resp, _ := doRequest(t, http.MethodDelete, created.SecretRef, nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected 204 for DELETE, got %d", resp.StatusCode)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, created.SecretRef, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a deleted secret, got %d", resp.StatusCode)
+	}
+
+	// The catalog advertises Barbican only with a key manager backend.
+	found := false
+	for _, svc := range issueToken(t).Token.Catalog {
+		found = found || svc.Type == "key-manager"
+	}
+	if found {
+		t.Errorf("expected no key-manager service without backend")
+	}
+	resp, body = doRequest(t, http.MethodPost, ts.URL+"/v3/auth/tokens", nil)
+	if resp.StatusCode != http.StatusCreated || !strings.Contains(body, `"type":"key-manager"`) || !strings.Contains(body, `"name":"barbican"`) {
+		t.Errorf("expected a key-manager catalog entry, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestOrchestrationStub(t *testing.T) {
+	backend := httptest.NewServer(newOrchestrationStub())
+	defer backend.Close()
+	ts := httptest.NewServer(NewDispatcher(Endpoints{Orchestration: backend.URL}))
+	defer ts.Close()
+
+	for _, p := range []string{"/stacks", "/stacks/"} {
+		if resp, body := doRequest(t, http.MethodGet, ts.URL+p, nil); resp.StatusCode != http.StatusOK || body != `{"stacks":[]}` {
+			t.Errorf("GET %s: expected an empty stack list, got %d: %s", p, resp.StatusCode, body)
+		}
+	}
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/stacks/web/1", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a stack, got %d", resp.StatusCode)
+	}
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/stacks", strings.NewReader(`{}`)); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for POST, got %d", resp.StatusCode)
+	}
+	_, body := doRequest(t, http.MethodPost, ts.URL+"/v3/auth/tokens", nil)
+	if !strings.Contains(body, `"type":"orchestration"`) || !strings.Contains(body, `"name":"heat"`) {
+		t.Errorf("expected an orchestration catalog entry, got %s", body)
+	}
+	for _, svc := range issueToken(t).Token.Catalog {
+		if svc.Type == "orchestration" {
+			t.Errorf("expected no orchestration service without backend")
+		}
+	}
+}
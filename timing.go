@@ -0,0 +1,188 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// timingRecorder accumulates per-route latency statistics for the -timing-dump
+// report. Percentiles are estimated with the P² algorithm, so memory stays
+// constant regardless of the number of requests.
+type timingRecorder struct {
+	mu     sync.Mutex
+	routes map[string]*routeTimings
+}
+
+// routeTimings holds the latency statistics of one route.
+type routeTimings struct {
+	count         int
+	max           time.Duration
+	p50, p90, p99 *p2Quantile
+}
+
+func newTimingRecorder() *timingRecorder {
+	return &timingRecorder{routes: map[string]*routeTimings{}}
+}
+
+// observe records that a request to route took d.
+func (t *timingRecorder) observe(route string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rt, ok := t.routes[route]
+	if !ok {
+		rt = &routeTimings{p50: newP2Quantile(0.5), p90: newP2Quantile(0.9), p99: newP2Quantile(0.99)}
+		t.routes[route] = rt
+	}
+	rt.count++
+	if d > rt.max {
+		rt.max = d
+	}
+	for _, q := range []*p2Quantile{rt.p50, rt.p90, rt.p99} {
+		q.add(float64(d))
+	}
+}
+
+// wrap returns next, recording the time it takes to serve each request under
+// route. A nil recorder returns next unchanged.
+func (t *timingRecorder) wrap(route string, next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		t.observe(route, time.Since(start))
+	})
+}
+
+// timingReport is the -timing-dump document. Latencies are in milliseconds.
+type timingReport struct {
+	Routes map[string]routeReport `json:"routes"`
+}
+
+type routeReport struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+// report returns the statistics recorded so far.
+func (t *timingRecorder) report() timingReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ms := func(ns float64) float64 { return ns / float64(time.Millisecond) }
+	report := timingReport{Routes: map[string]routeReport{}}
+	for route, rt := range t.routes {
+		report.Routes[route] = routeReport{
+			Count: rt.count,
+			P50:   ms(rt.p50.value()),
+			P90:   ms(rt.p90.value()),
+			P99:   ms(rt.p99.value()),
+			Max:   ms(float64(rt.max)),
+		}
+	}
+	return report
+}
+
+// dump writes the report to the file at path.
+func (t *timingRecorder) dump(path string) error {
+	b, err := json.MarshalIndent(t.report(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// p2Quantile estimates the p-quantile of a stream of observations with the P²
+// algorithm by Jain and Chlamtac, keeping just five markers.
+type p2Quantile struct {
+	p float64
+	n int
+	// q holds the marker heights, pos their actual and des their desired
+	// positions, inc the increments of the desired positions.
+	q, pos, des, inc [5]float64
+}
+
+func newP2Quantile(p float64) *p2Quantile {
+	return &p2Quantile{p: p, inc: [5]float64{0, p / 2, p, (1 + p) / 2, 1}}
+}
+
+// add adds an observation.
+func (e *p2Quantile) add(x float64) {
+	if e.n < 5 {
+		e.q[e.n] = x
+		e.n++
+		if e.n == 5 {
+			sort.Float64s(e.q[:])
+			e.pos = [5]float64{1, 2, 3, 4, 5}
+			e.des = [5]float64{1, 1 + 2*e.p, 1 + 4*e.p, 3 + 2*e.p, 5}
+		}
+		return
+	}
+	e.n++
+
+	// Find the cell k with q[k] <= x < q[k+1], extending the extremes.
+	var k int
+	switch {
+	case x < e.q[0]:
+		e.q[0] = x
+	case x >= e.q[4]:
+		e.q[4] = x
+		k = 3
+	default:
+		for x >= e.q[k+1] {
+			k++
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		e.pos[i]++
+	}
+	for i := range e.des {
+		e.des[i] += e.inc[i]
+	}
+
+	// Adjust the inner markers that are off their desired position.
+	for i := 1; i <= 3; i++ {
+		d := e.des[i] - e.pos[i]
+		if (d >= 1 && e.pos[i+1]-e.pos[i] > 1) || (d <= -1 && e.pos[i-1]-e.pos[i] < -1) {
+			s := math.Copysign(1, d)
+			if q := e.parabolic(i, s); e.q[i-1] < q && q < e.q[i+1] {
+				e.q[i] = q
+			} else {
+				j := i + int(s)
+				e.q[i] += s * (e.q[j] - e.q[i]) / (e.pos[j] - e.pos[i])
+			}
+			e.pos[i] += s
+		}
+	}
+}
+
+// parabolic returns the piecewise-parabolic prediction of marker i's height
+// when moving it by s.
+func (e *p2Quantile) parabolic(i int, s float64) float64 {
+	return e.q[i] + s/(e.pos[i+1]-e.pos[i-1])*
+		((e.pos[i]-e.pos[i-1]+s)*(e.q[i+1]-e.q[i])/(e.pos[i+1]-e.pos[i])+
+			(e.pos[i+1]-e.pos[i]-s)*(e.q[i]-e.q[i-1])/(e.pos[i]-e.pos[i-1]))
+}
+
+// value returns the current estimate; it is exact for up to five
+// observations.
+func (e *p2Quantile) value() float64 {
+	if e.n == 0 {
+		return 0
+	}
+	if e.n < 5 {
+		sorted := append([]float64(nil), e.q[:e.n]...)
+		sort.Float64s(sorted)
+		return sorted[int(math.Round(e.p*float64(e.n-1)))]
+	}
+	return e.q[2]
+}
@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestP2Quantile(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	estimators := map[float64]*p2Quantile{0.5: newP2Quantile(0.5), 0.9: newP2Quantile(0.9), 0.99: newP2Quantile(0.99)}
+	for i := 0; i < 100000; i++ {
+		x := rng.Float64() * 1000
+		for _, e := range estimators {
+			e.add(x)
+		}
+	}
+	// Uniformly distributed on [0, 1000): the p-quantile is 1000p.
+	for p, e := range estimators {
+		if got := e.value(); math.Abs(got-1000*p) > 10 {
+			t.Errorf("p%v: expected about %v, got %v", p*100, 1000*p, got)
+		}
+	}
+
+	// Few observations are exact.
+	e := newP2Quantile(0.5)
+	for _, x := range []float64{3, 1, 2} {
+		e.add(x)
+	}
+	if got := e.value(); got != 2 {
+		t.Errorf("expected the median 2 of three observations, got %v", got)
+	}
+}
+
+func TestTimingDump(t *testing.T) {
+	timings := newTimingRecorder()
+	ts := httptest.NewServer(buildDispatcherForTest(t, WithTimings(timings)))
+	defer ts.Close()
+
+	for i := 0; i < 10; i++ {
+		doRequest(t, http.MethodGet, ts.URL+"/servers/detail", nil)
+	}
+	doRequest(t, http.MethodPost, ts.URL+"/v3/auth/tokens", nil)
+
+	path := filepath.Join(t.TempDir(), "timings.json")
+	if err := timings.dump(path); err != nil {
+		t.Fatalf("dump failed: %v", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading dump failed: %v", err)
+	}
+	var report timingReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatalf("invalid dump %s: %v", b, err)
+	}
+	servers, ok := report.Routes["/servers/"]
+	if !ok || servers.Count != 10 {
+		t.Fatalf("expected 10 requests for /servers/, got %s", b)
+	}
+	if servers.P50 <= 0 || servers.P50 > servers.P99 || servers.P99 > servers.Max || servers.Max > float64(time.Minute/time.Millisecond) {
+		t.Errorf("implausible percentiles: %+v", servers)
+	}
+	if report.Routes["/v3/auth/tokens"].Count != 1 {
+		t.Errorf("expected 1 token request, got %s", b)
+	}
+}
@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSelfSignedCertificate(t *testing.T) {
+	cert, certPEM, err := selfSignedCertificate("127.0.0.1")
+	if err != nil {
+		t.Fatalf("generating certificate failed: %v", err)
+	}
+	ts := httptest.NewUnstartedServer(buildDispatcherForTest(t))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	// The client trusts the printed PEM as its only CA.
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(certPEM) {
+		t.Fatalf("invalid PEM: %s", certPEM)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	for _, base := range []string{ts.URL, strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)} {
+		resp, err := client.Post(base+"/v3/auth/tokens", "application/json", nil)
+		if err != nil {
+			t.Fatalf("request to %s failed: %v", base, err)
+		}
+		var doc tokenDocument
+		err = json.NewDecoder(resp.Body).Decode(&doc)
+		//nolint:errcheck // Response body Close() call
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("decoding token failed: %v", err)
+		}
+		// The catalog advertises the dispatcher's HTTPS URL, the backends stay HTTP.
+		for _, svc := range doc.Token.Catalog {
+			if url := svc.Endpoints[0]["url"].(string); !strings.HasPrefix(url, base) {
+				t.Errorf("%s: expected an endpoint below %s, got %s", svc.Type, base, url)
+			}
+		}
+		if resp, err := client.Get(base + "/flavors"); err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("expected the compute backend to be reachable over HTTPS, got %v, %v", resp, err)
+		} else {
+			//nolint:errcheck // Response body Close() call
+			_ = resp.Body.Close()
+		}
+	}
+
+	if _, _, err := selfSignedCertificate("mock.openstack.local"); err != nil {
+		t.Errorf("generating a certificate for a host name failed: %v", err)
+	}
+}
@@ -0,0 +1,441 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/google/uuid"
+)
+
+// catalogService describes a service advertised in the token catalog.
+type catalogService struct {
+	Type string
+	Name string
+	// Path is appended to the dispatcher base URL to form the endpoint URL.
+	Path string
+	// Backend selects the service's base URL from Endpoints; services
+	// without a backend URL are left out of the catalog. Nil for services
+	// the dispatcher serves itself.
+	Backend func(Endpoints) string
+	// Service is the backend service name, as used by -maintenance; empty
+	// for services the dispatcher serves itself.
+	Service string
+	// AllInterfaces advertises the public, internal and admin endpoints of
+	// the service regardless of Config.CatalogInterfaces, as Keystone does
+	// for itself.
+	AllInterfaces bool
+}
+
+// catalogServices lists the services advertised in the token catalog.
+var catalogServices = []catalogService{
+	{Type: "compute", Name: "nova", Service: "compute", Backend: func(e Endpoints) string { return e.Compute }},
+	{Type: "network", Name: "neutron", Service: "networking", Backend: func(e Endpoints) string { return e.Networking }},
+	{Type: "load-balancer", Name: "octavia", Service: "loadbalancer", Backend: func(e Endpoints) string { return e.LoadBalancer }},
+	{Type: "block-storage", Name: "cinder", Service: "blockstorage", Backend: func(e Endpoints) string { return e.BlockStorage }},
+	{Type: "dns", Name: "designate", Service: "dns", Backend: func(e Endpoints) string { return e.DNS }},
+	{Type: "image", Name: "glance", Service: "image", Backend: func(e Endpoints) string { return e.Image }},
+	{Type: "key-manager", Name: "barbican", Service: "keymanager", Backend: func(e Endpoints) string { return e.KeyManager }},
+	{Type: "orchestration", Name: "heat", Service: "orchestration", Backend: func(e Endpoints) string { return e.Orchestration }},
+	{Type: "identity", Name: "keystone", Path: IdentityVersionPath, AllInterfaces: true},
+}
+
+// newID returns a random UUID, or if stable is set, a UUID derived from the
+// given name parts that is the same for every token, like the IDs of real
+// Keystone catalog entries.
+func newID(stable bool, parts ...string) string {
+	if !stable {
+		return uuid.New().String()
+	}
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(strings.Join(parts, "/"))).String()
+}
+
+// objectStoreAccountPath returns the Swift account path of the project,
+// which the object-store catalog URL ends in.
+func objectStoreAccountPath(projectID string) string {
+	return "/v1/AUTH_" + projectID
+}
+
+// newAuditID returns a random audit ID in Keystone's format, 16 random bytes
+// in URL-safe base64 without padding.
+func newAuditID() string {
+	id := uuid.New()
+	return base64.RawURLEncoding.EncodeToString(id[:])
+}
+
+// allInterfaces returns the given interfaces followed by the missing ones of
+// public, internal and admin.
+func allInterfaces(interfaces interfaceList) []string {
+	all := append([]string{}, interfaces...)
+	for _, iface := range []string{"public", "internal", "admin"} {
+		if !slices.Contains(all, iface) {
+			all = append(all, iface)
+		}
+	}
+	return all
+}
+
+// catalogRegion is a region advertised in the service catalog.
+type catalogRegion struct {
+	Name string
+	ID   string
+	// Base is the URL the region's endpoints start with; empty for the
+	// dispatcher's own URL.
+	Base string
+}
+
+// catalogRegions returns cfg.Region followed by the other regions of
+// cfg.RegionURLs, in the order given.
+func catalogRegions(cfg Config) []catalogRegion {
+	id := cfg.RegionID
+	if id == "" {
+		id = cfg.Region
+	}
+	base, _ := cfg.RegionURLs.lookup(cfg.Region)
+	regions := []catalogRegion{{Name: cfg.Region, ID: id, Base: base}}
+	for _, r := range cfg.RegionURLs {
+		if r.Region != cfg.Region {
+			regions = append(regions, catalogRegion{Name: r.Region, ID: r.Region, Base: r.URL})
+		}
+	}
+	return regions
+}
+
+// unreachablePort is the port of catalog endpoints with
+// Config.BadCatalogEndpoints, tcpmux, which hardly any host serves.
+const unreachablePort = "1"
+
+// unreachableBase returns base with its port replaced by unreachablePort.
+func unreachableBase(base string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		return base
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), unreachablePort)
+	return u.String()
+}
+
+// endpointURL returns the catalog URL of svc in a region with the given base.
+func endpointURL(cfg Config, base string, svc catalogService) string {
+	if cfg.BadCatalogEndpoints && svc.Service != "" {
+		base = unreachableBase(base)
+	}
+	return base + svc.Path
+}
+
+// tokenTime formats a token timestamp as seen by a Keystone whose clock is
+// off by skew. The dispatcher itself keeps validating tokens against its own
+// clock.
+func tokenTime(t time.Time, skew time.Duration) string {
+	return t.Add(skew).UTC().Format(time.RFC3339)
+}
+
+// availableServices returns the services that are not in maintenance
+// according to hidden.
+func availableServices(services []catalogService, hidden *maintenanceSchedule) []catalogService {
+	if hidden == nil {
+		return services
+	}
+	available := make([]catalogService, 0, len(services))
+	for _, svc := range services {
+		if _, ok := hidden.active(svc.Service); !ok {
+			available = append(available, svc)
+		}
+	}
+	return available
+}
+
+// newTokenHandler returns a minimal Keystone v3 token issuance handler whose
+// catalog advertises the given services, except for those in maintenance
+// according to hidden. Issued tokens are added to store.
+//
+// GET and HEAD validate the token in the subject token header, as clients do
+// to re-check a token: with a valid token in the auth token header, they
+// answer with the document the token was issued with, or with 404 if it is
+// unknown or expired, as Keystone does.
+func newTokenHandler(cfg Config, services []catalogService, store *tokenStore, hidden *maintenanceSchedule) http.HandlerFunc {
+	regions := catalogRegions(cfg)
+	roles := make([]map[string]string, 0, len(cfg.Roles))
+	for _, name := range cfg.Roles {
+		// Role IDs are stable across tokens, like Keystone's.
+		roles = append(roles, map[string]string{
+			"id":   newID(true, "role", name),
+			"name": name,
+		})
+	}
+	project := map[string]interface{}{
+		"id":     cfg.ProjectID,
+		"name":   "mock",
+		"domain": map[string]string{"id": cfg.ProjectDomainID, "name": cfg.ProjectDomainName},
+	}
+	user := map[string]interface{}{"id": "mock-user-id", "name": "mock-user"}
+	if cfg.IdentityProvider != "" {
+		user["OS-FEDERATION"] = map[string]interface{}{
+			"identity_provider": map[string]string{"id": cfg.IdentityProvider},
+			"protocol":          map[string]string{"id": cfg.FederationProtocol},
+			"groups":            []map[string]string{},
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			validateToken(w, r, cfg, store)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// An ?interface=... hint restricts the catalog to that interface.
+		var hint interfaceList
+		if v := r.URL.Query().Get("interface"); v != "" {
+			if err := hint.Set(v); err != nil || len(hint) != 1 {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid interface %q (want public, internal or admin)", v))
+				return
+			}
+		}
+		system := systemScoped(r)
+		w.Header().Set(headers.ContentType, "application/json")
+		// Generate a token and return it in a header as Keystone does.
+		tok := uuid.New().String()
+		issuedAt := store.clock.now()
+		expiresAt := issuedAt.Add(tokenLifetime)
+		w.Header().Set(cfg.SubjectTokenHeader, tok)
+		// Build a minimal token document with a service catalog
+		dispatcherBase := requestBase(r)
+		available := availableServices(services, hidden)
+		catalog := make([]map[string]interface{}, 0, len(available))
+		for _, svc := range available {
+			interfaces := cfg.CatalogInterfaces
+			switch {
+			case hint != nil:
+				interfaces = hint
+			case svc.AllInterfaces:
+				interfaces = allInterfaces(interfaces)
+			}
+			endpoints := make([]map[string]interface{}, 0, len(regions)*len(interfaces))
+			for _, region := range regions {
+				base := region.Base
+				if base == "" {
+					base = dispatcherBase
+				}
+				for _, iface := range interfaces {
+					base := base
+					if region.Base == "" {
+						if u, ok := cfg.InterfaceURLs.lookup(svc.Type, iface); ok {
+							base = u
+						}
+					}
+					endpoints = append(endpoints, map[string]interface{}{
+						"id":        newID(cfg.StableEndpointIDs, "endpoint", svc.Type, iface, region.Name),
+						"interface": iface,
+						"region":    region.Name,
+						"region_id": region.ID,
+						"url":       endpointURL(cfg, base, svc),
+					})
+				}
+			}
+			catalog = append(catalog, map[string]interface{}{
+				"id":        newID(cfg.StableEndpointIDs, "service", svc.Type),
+				"type":      svc.Type,
+				"name":      svc.Name,
+				"endpoints": endpoints,
+			})
+		}
+		// A token obtained by rescoping also carries the audit ID of the token
+		// it was obtained with.
+		auditIDs := make([]string, 0, cfg.AuditIDs)
+		for i := 0; i < cfg.AuditIDs; i++ {
+			auditIDs = append(auditIDs, newAuditID())
+		}
+		token := map[string]interface{}{
+			"audit_ids":  auditIDs,
+			"issued_at":  tokenTime(issuedAt, cfg.TokenSkew),
+			"expires_at": tokenTime(expiresAt, cfg.TokenSkew),
+			"user":       user,
+			"roles":      roles,
+			"catalog":    catalog,
+		}
+		if system {
+			token["system"] = map[string]bool{"all": true}
+		} else {
+			token["project"] = project
+		}
+		// Keystone returns the token in the header only.
+		if cfg.TokenInBody {
+			token["id"] = tok
+		}
+		resp := map[string]interface{}{"token": token}
+		b := marshalJSON(restyleFields(resp, cfg.TokenFieldStyle), cfg.PrettyJSON)
+		if system {
+			store.add(tok, issuedToken{System: true, ExpiresAt: expiresAt, Document: b})
+		} else {
+			store.add(tok, issuedToken{ProjectID: cfg.ProjectID, ExpiresAt: expiresAt, Document: b})
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(b)
+	}
+}
+
+// validateToken answers a GET or HEAD request validating the token in the
+// subject token header with the document it was issued with. Requests without
+// a valid token in the auth token header are answered with 401.
+func validateToken(w http.ResponseWriter, r *http.Request, cfg Config, store *tokenStore) {
+	if _, ok := store.lookup(r.Header.Get(authTokenHeader(cfg))); !ok {
+		w.Header().Set("WWW-Authenticate", `Keystone uri="`+requestBase(r)+`/v3"`)
+		writeJSONError(w, http.StatusUnauthorized, "The request you have made requires authentication.")
+		return
+	}
+	subject := r.Header.Get(cfg.SubjectTokenHeader)
+	tok, ok := store.lookup(subject)
+	if !ok || tok.Document == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Could not find token: %s.", subject))
+		return
+	}
+	w.Header().Set(headers.ContentType, "application/json")
+	w.Header().Set(cfg.SubjectTokenHeader, subject)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(tok.Document)
+}
+
+// systemScoped reports whether the auth request body asks for a token scoped
+// to the whole system ("scope": {"system": {"all": true}}) instead of a
+// project. Bodies that are missing or not JSON request the default scope.
+func systemScoped(r *http.Request) bool {
+	if r.Body == nil {
+		return false
+	}
+	var body struct {
+		Auth struct {
+			Scope struct {
+				System struct {
+					All bool `json:"all"`
+				} `json:"system"`
+			} `json:"scope"`
+		} `json:"auth"`
+	}
+	if json.NewDecoder(r.Body).Decode(&body) != nil {
+		return false
+	}
+	return body.Auth.Scope.System.All
+}
+
+// V2TokensPath is the token endpoint of the Keystone v2.0 API, which was
+// removed from Keystone but is still used by some legacy clients.
+const V2TokensPath = "/v2.0/tokens"
+
+// deprecationWarning is the Warning header of responses of the v2.0 API with
+// Config.WarnDeprecated.
+const deprecationWarning = `299 - "v2.0 API is deprecated"`
+
+// newV2TokenHandler returns a minimal Keystone v2.0 token issuance handler,
+// answering with an access document whose service catalog lists the given
+// services, except for those in maintenance according to hidden. Issued tokens
+// are added to store.
+func newV2TokenHandler(cfg Config, services []catalogService, store *tokenStore, hidden *maintenanceSchedule) http.HandlerFunc {
+	regions := catalogRegions(cfg)
+	roles := make([]map[string]string, 0, len(cfg.Roles))
+	for _, name := range cfg.Roles {
+		roles = append(roles, map[string]string{"name": name})
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.WarnDeprecated {
+			w.Header().Set("Warning", deprecationWarning)
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		tok := uuid.New().String()
+		issuedAt := store.clock.now()
+		expiresAt := issuedAt.Add(tokenLifetime)
+		store.add(tok, issuedToken{ProjectID: cfg.ProjectID, ExpiresAt: expiresAt})
+		dispatcherBase := requestBase(r)
+		available := availableServices(services, hidden)
+		catalog := make([]map[string]interface{}, 0, len(available))
+		for _, svc := range available {
+			endpoints := make([]map[string]string, 0, len(regions))
+			for _, region := range regions {
+				base := region.Base
+				if base == "" {
+					base = dispatcherBase
+					if u, ok := cfg.InterfaceURLs.lookup(svc.Type, "public"); ok {
+						base = u
+					}
+				}
+				endpoints = append(endpoints, map[string]string{"region": region.Name, "publicURL": endpointURL(cfg, base, svc)})
+			}
+			catalog = append(catalog, map[string]interface{}{
+				"type":      svc.Type,
+				"name":      svc.Name,
+				"endpoints": endpoints,
+			})
+		}
+		writeJSONFormatted(w, http.StatusOK, restyleFields(map[string]interface{}{
+			"access": map[string]interface{}{
+				"token": map[string]interface{}{
+					"id":        tok,
+					"issued_at": tokenTime(issuedAt, cfg.TokenSkew),
+					"expires":   tokenTime(expiresAt, cfg.TokenSkew),
+					"tenant":    map[string]string{"id": cfg.ProjectID, "name": "mock"},
+				},
+				"serviceCatalog": catalog,
+				"user":           map[string]interface{}{"id": "mock-user-id", "name": "mock-user", "roles": roles},
+			},
+		}, cfg.TokenFieldStyle), cfg.PrettyJSON)
+	}
+}
+
+// fieldName returns the snake_case name in the given style. Names that are
+// not snake_case, like OS-FEDERATION, are left alone.
+func fieldName(name string, style FieldStyle) string {
+	if style == FieldSnake || style == "" || strings.ToLower(name) != name {
+		return name
+	}
+	parts := strings.Split(name, "_")
+	for i, p := range parts {
+		if p != "" && (i > 0 || style == FieldPascal) {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// restyleFields returns the JSON document v with the field names of all
+// nested objects in the given style.
+func restyleFields(v interface{}, style FieldStyle) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fieldName(k, style)] = restyleFields(item, style)
+		}
+		return m
+	case map[string]string:
+		m := make(map[string]string, len(v))
+		for k, item := range v {
+			m[fieldName(k, style)] = item
+		}
+		return m
+	case []map[string]interface{}:
+		l := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			l = append(l, restyleFields(item, style))
+		}
+		return l
+	case []map[string]string:
+		l := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			l = append(l, restyleFields(item, style))
+		}
+		return l
+	}
+	return v
+}
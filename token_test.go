@@ -0,0 +1,687 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenDocument is the part of the Keystone token response the tests inspect.
+type tokenDocument struct {
+	Token struct {
+		IssuedAt  time.Time `json:"issued_at"`
+		ExpiresAt time.Time `json:"expires_at"`
+		Project   struct {
+			ID     string `json:"id"`
+			Domain struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"domain"`
+		} `json:"project"`
+		User  map[string]interface{} `json:"user"`
+		Roles []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"roles"`
+		Catalog []struct {
+			ID        string                   `json:"id"`
+			Type      string                   `json:"type"`
+			Endpoints []map[string]interface{} `json:"endpoints"`
+		} `json:"catalog"`
+	} `json:"token"`
+}
+
+// issueToken POSTs to the token endpoint of a dispatcher built with opts and
+// returns the decoded response.
+func issueToken(t *testing.T, opts ...Option) tokenDocument {
+	t.Helper()
+	ts := httptest.NewServer(buildDispatcherForTest(t, opts...))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/v3/auth/tokens", "application/json", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 Created, got %d", resp.StatusCode)
+	}
+	var doc tokenDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("decoding token failed: %v", err)
+	}
+	return doc
+}
+
+func TestTokenCatalogRegion(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         []Option
+		wantRegion   string
+		wantRegionID string
+	}{
+		{name: "default", wantRegion: "RegionOne", wantRegionID: "RegionOne"},
+		{name: "region id defaults to region", opts: []Option{func(c *Config) { c.Region = "Frankfurt" }}, wantRegion: "Frankfurt", wantRegionID: "Frankfurt"},
+		{name: "distinct region id", opts: []Option{func(c *Config) { c.RegionID = "fra1" }}, wantRegion: "RegionOne", wantRegionID: "fra1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := issueToken(t, tt.opts...)
+			for _, svc := range doc.Token.Catalog {
+				for _, ep := range svc.Endpoints {
+					if ep["region"] != tt.wantRegion || ep["region_id"] != tt.wantRegionID {
+						t.Errorf("%s endpoint: expected region %q/region_id %q, got %v/%v",
+							svc.Type, tt.wantRegion, tt.wantRegionID, ep["region"], ep["region_id"])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTokenRoles(t *testing.T) {
+	doc := issueToken(t)
+	if len(doc.Token.Roles) != 1 || doc.Token.Roles[0].Name != "member" || doc.Token.Roles[0].ID == "" {
+		t.Errorf("expected the default member role, got %+v", doc.Token.Roles)
+	}
+
+	doc = issueToken(t, func(c *Config) { c.Roles = []string{"admin", "member"} })
+	if len(doc.Token.Roles) != 2 || doc.Token.Roles[0].Name != "admin" || doc.Token.Roles[1].Name != "member" {
+		t.Errorf("expected admin and member roles, got %+v", doc.Token.Roles)
+	}
+}
+
+func TestTokenStableEndpointIDs(t *testing.T) {
+	ids := func(doc tokenDocument) []string {
+		var ids []string
+		for _, svc := range doc.Token.Catalog {
+			ids = append(ids, svc.ID)
+			for _, ep := range svc.Endpoints {
+				ids = append(ids, ep["id"].(string))
+			}
+		}
+		return ids
+	}
+
+	stable := func(c *Config) { c.StableEndpointIDs = true }
+	first, second := ids(issueToken(t, stable)), ids(issueToken(t, stable))
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("expected identical IDs across tokens, got %v and %v", first, second)
+	}
+
+	if random := ids(issueToken(t)); reflect.DeepEqual(first, random) {
+		t.Errorf("expected random IDs without -stable-endpoint-ids")
+	}
+}
+
+func TestTokenFederation(t *testing.T) {
+	if doc := issueToken(t); doc.Token.User["OS-FEDERATION"] != nil {
+		t.Errorf("expected no federation block by default, got %v", doc.Token.User["OS-FEDERATION"])
+	}
+
+	doc := issueToken(t, func(c *Config) { c.IdentityProvider = "corp-idp" })
+	fed, ok := doc.Token.User["OS-FEDERATION"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a federation block, got user %v", doc.Token.User)
+	}
+	idp, _ := fed["identity_provider"].(map[string]interface{})
+	protocol, _ := fed["protocol"].(map[string]interface{})
+	if idp["id"] != "corp-idp" || protocol["id"] != "saml2" {
+		t.Errorf("unexpected federation block: %v", fed)
+	}
+}
+
+func TestTokenProjectDomain(t *testing.T) {
+	doc := issueToken(t)
+	if d := doc.Token.Project.Domain; d.ID != "default" || d.Name != "Default" {
+		t.Errorf("expected the default domain, got %+v", d)
+	}
+
+	doc = issueToken(t, func(c *Config) {
+		c.ProjectDomainID = "d-1"
+		c.ProjectDomainName = "Customers"
+	})
+	if d := doc.Token.Project.Domain; d.ID != "d-1" || d.Name != "Customers" {
+		t.Errorf("expected the configured domain, got %+v", d)
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.PrettyJSON = true }))
+	defer ts.Close()
+
+	resp, body := doRequest(t, http.MethodPost, ts.URL+"/v3/auth/tokens", nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	if !strings.HasPrefix(body, "{\n  \"token\": {\n    ") {
+		t.Errorf("expected an indented token, got %.40q", body)
+	}
+	if _, body = doRequest(t, http.MethodGet, ts.URL+IdentityPath, nil); !strings.HasPrefix(body, "{\n  \"identity\"") {
+		t.Errorf("expected an indented identity document, got %.40q", body)
+	}
+
+	// Compact by default.
+	plain := httptest.NewServer(buildDispatcherForTest(t))
+	defer plain.Close()
+	if _, body = doRequest(t, http.MethodPost, plain.URL+"/v3/auth/tokens", nil); strings.Contains(body, "\n") {
+		t.Errorf("expected a compact token, got %.40q", body)
+	}
+}
+
+func TestObjectStoreCatalogAndRouting(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	swift := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer swift.Close()
+	ts := httptest.NewServer(NewDispatcher(Endpoints{ObjectStore: swift.URL}, func(c *Config) { c.ProjectID = "p1" }))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/v3/auth/tokens", "application/json", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	var doc tokenDocument
+	err = json.NewDecoder(resp.Body).Decode(&doc)
+	//nolint:errcheck // Response body Close() call
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatalf("decoding token failed: %v", err)
+	}
+	var url string
+	for _, svc := range doc.Token.Catalog {
+		if svc.Type == "object-store" {
+			url, _ = svc.Endpoints[0]["url"].(string)
+		}
+	}
+	if want := ts.URL + "/v1/AUTH_p1"; url != want {
+		t.Fatalf("expected object-store URL %s, got %q", want, url)
+	}
+
+	for _, path := range []string{"/backups/db.tar", "/backups", ""} {
+		if resp, _ := doRequest(t, http.MethodGet, url+path, nil); resp.StatusCode != http.StatusNoContent {
+			t.Errorf("%s: expected 204 from the object store, got %d", path, resp.StatusCode)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(seen, ","); got != "/backups/db.tar,/backups,/" {
+		t.Errorf("expected the backend to see paths below the account, got %s", got)
+	}
+
+	// Without an object store, the service is neither advertised nor routed.
+	for _, svc := range issueToken(t).Token.Catalog {
+		if svc.Type == "object-store" {
+			t.Errorf("unexpected object-store service without backend")
+		}
+	}
+}
+
+func TestCatalogOmitsServicesWithoutBackend(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	defer backend.Close()
+	// DNS and load balancing are disabled.
+	ts := httptest.NewServer(NewDispatcher(Endpoints{
+		Compute:      backend.URL,
+		Networking:   backend.URL,
+		BlockStorage: backend.URL,
+		Image:        backend.URL,
+	}))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/v3/auth/tokens", "application/json", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var doc tokenDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("decoding token failed: %v", err)
+	}
+	var types []string
+	for _, svc := range doc.Token.Catalog {
+		types = append(types, svc.Type)
+	}
+	if want := "compute,network,block-storage,image,identity"; strings.Join(types, ",") != want {
+		t.Errorf("expected catalog services %s, got %v", want, types)
+	}
+}
+
+func TestTokenAuditIDs(t *testing.T) {
+	for _, n := range []int{1, 2} {
+		var doc struct {
+			Token struct {
+				AuditIDs []string `json:"audit_ids"`
+			} `json:"token"`
+		}
+		ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.AuditIDs = n }))
+		_, body := doRequest(t, http.MethodPost, ts.URL+"/v3/auth/tokens", nil)
+		ts.Close()
+		if err := json.Unmarshal([]byte(body), &doc); err != nil {
+			t.Fatalf("decoding token failed: %v", err)
+		}
+		if len(doc.Token.AuditIDs) != n {
+			t.Fatalf("expected %d audit IDs, got %v", n, doc.Token.AuditIDs)
+		}
+		for _, id := range doc.Token.AuditIDs {
+			if len(id) != 22 {
+				t.Errorf("expected a 22 character audit ID, got %q", id)
+			}
+		}
+	}
+}
+
+func TestV2TokenDeprecationWarning(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.WarnDeprecated = true }))
+	defer ts.Close()
+
+	resp, body := doRequest(t, http.MethodPost, ts.URL+V2TokensPath, strings.NewReader(`{"auth": {}}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Warning"); got != `299 - "v2.0 API is deprecated"` {
+		t.Errorf("expected the deprecation warning, got %q", got)
+	}
+	var doc struct {
+		Access struct {
+			Token struct {
+				ID string `json:"id"`
+			} `json:"token"`
+			ServiceCatalog []struct {
+				Type      string              `json:"type"`
+				Endpoints []map[string]string `json:"endpoints"`
+			} `json:"serviceCatalog"`
+		} `json:"access"`
+	}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatalf("decoding access document failed: %v", err)
+	}
+	if doc.Access.Token.ID == "" || len(doc.Access.ServiceCatalog) == 0 || doc.Access.ServiceCatalog[0].Endpoints[0]["publicURL"] != ts.URL {
+		t.Errorf("unexpected access document %s", body)
+	}
+
+	// Neither the v3 API nor, without the flag, the v2.0 API warn.
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/v3/auth/tokens", nil); resp.Header.Get("Warning") != "" {
+		t.Errorf("expected no warning for the v3 API")
+	}
+	plain := httptest.NewServer(buildDispatcherForTest(t))
+	defer plain.Close()
+	if resp, _ := doRequest(t, http.MethodPost, plain.URL+V2TokensPath, nil); resp.Header.Get("Warning") != "" {
+		t.Errorf("expected no warning without -warn-deprecated")
+	}
+}
+
+func TestCatalogInterfaceOrder(t *testing.T) {
+	opt := func(c *Config) { _ = c.CatalogInterfaces.Set("internal,public,admin") }
+	for _, svc := range issueToken(t, opt).Token.Catalog {
+		var got []string
+		for _, ep := range svc.Endpoints {
+			got = append(got, ep["interface"].(string))
+		}
+		if strings.Join(got, ",") != "internal,public,admin" {
+			t.Errorf("%s: expected endpoints internal,public,admin, got %v", svc.Type, got)
+		}
+	}
+	for _, svc := range issueToken(t).Token.Catalog {
+		// The identity service lists all interfaces, see
+		// TestIdentityCatalogEndpoint.
+		if svc.Type == "identity" {
+			continue
+		}
+		if len(svc.Endpoints) != 1 || svc.Endpoints[0]["interface"] != "public" {
+			t.Errorf("%s: expected a single public endpoint by default, got %v", svc.Type, svc.Endpoints)
+		}
+	}
+
+	var l interfaceList
+	for _, v := range []string{"", "public,private", "public,public"} {
+		if err := l.Set(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
+
+func TestRegionURLs(t *testing.T) {
+	opt := func(c *Config) {
+		_ = c.RegionURLs.Set("RegionTwo=https://rt.example/,RegionThree=http://r3.example:8080")
+	}
+	for _, svc := range issueToken(t, opt).Token.Catalog {
+		var got []string
+		for _, ep := range svc.Endpoints {
+			if ep["interface"] != "public" {
+				continue
+			}
+			got = append(got, ep["region"].(string)+"="+ep["url"].(string))
+		}
+		if len(got) != 3 || !strings.HasPrefix(got[0], "RegionOne=http://127.0.0.1:") ||
+			!hasBase(got[1], "RegionTwo=https://rt.example") || !hasBase(got[2], "RegionThree=http://r3.example:8080") {
+			t.Errorf("%s: unexpected regional endpoints %v", svc.Type, got)
+		}
+	}
+
+	// The default region can be moved away from the dispatcher as well.
+	opt = func(c *Config) { _ = c.RegionURLs.Set("RegionOne=https://r1.example") }
+	for _, svc := range issueToken(t, opt).Token.Catalog {
+		for _, ep := range svc.Endpoints {
+			if !hasBase(ep["url"].(string), "https://r1.example") {
+				t.Errorf("%s: expected endpoints at https://r1.example, got %v", svc.Type, svc.Endpoints)
+			}
+		}
+	}
+
+	var l regionURLs
+	for _, v := range []string{"RegionTwo", "=https://x", "RegionTwo=ftp://x", "R=http://a,R=http://b"} {
+		if err := l.Set(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
+
+// hasBase reports whether url is base or a path below it.
+func hasBase(url, base string) bool {
+	return url == base || strings.HasPrefix(url, base+"/")
+}
+
+func TestTokenSkew(t *testing.T) {
+	for _, skew := range []time.Duration{0, -5 * time.Minute, 10 * time.Minute} {
+		before := time.Now().Truncate(time.Second)
+		doc := issueToken(t, func(c *Config) { c.TokenSkew = skew })
+		after := time.Now()
+
+		issued := doc.Token.IssuedAt.Add(-skew)
+		if issued.Before(before) || issued.After(after) {
+			t.Errorf("skew %v: expected issued_at %v shifted by the skew, got %v", skew, before, doc.Token.IssuedAt)
+		}
+		if got := doc.Token.ExpiresAt.Sub(doc.Token.IssuedAt); got != tokenLifetime {
+			t.Errorf("skew %v: expected a lifetime of %v, got %v", skew, tokenLifetime, got)
+		}
+	}
+}
+
+func TestIdentityCatalogEndpoint(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { _ = c.CatalogInterfaces.Set("internal") }))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/v3/auth/tokens", "application/json", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	var doc tokenDocument
+	err = json.NewDecoder(resp.Body).Decode(&doc)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatalf("decoding token failed: %v", err)
+	}
+	for _, svc := range doc.Token.Catalog {
+		if svc.Type != "identity" {
+			if len(svc.Endpoints) != 1 {
+				t.Errorf("%s: expected only the configured interface, got %v", svc.Type, svc.Endpoints)
+			}
+			continue
+		}
+		var interfaces []string
+		for _, ep := range svc.Endpoints {
+			interfaces = append(interfaces, ep["interface"].(string))
+			if ep["url"] != ts.URL+"/v3" {
+				t.Errorf("%s: expected URL %s/v3, got %v", ep["interface"], ts.URL, ep["url"])
+			}
+		}
+		if strings.Join(interfaces, ",") != "internal,public,admin" {
+			t.Errorf("expected interfaces internal,public,admin, got %v", interfaces)
+		}
+	}
+
+	// Clients re-discovering identity find the version document there.
+	var version struct {
+		Version struct {
+			ID    string              `json:"id"`
+			Links []map[string]string `json:"links"`
+		} `json:"version"`
+	}
+	getJSON(t, ts.URL+"/v3", http.StatusOK, &version)
+	if !strings.HasPrefix(version.Version.ID, "v3") || len(version.Version.Links) != 1 || version.Version.Links[0]["href"] != ts.URL+"/v3/" {
+		t.Errorf("unexpected version document %+v", version)
+	}
+}
+
+func TestBadCatalogEndpoints(t *testing.T) {
+	opt := func(c *Config) {
+		c.BadCatalogEndpoints = true
+		_ = c.RegionURLs.Set("RegionTwo=https://rt.example:8443/base")
+	}
+	for _, svc := range issueToken(t, opt).Token.Catalog {
+		for _, ep := range svc.Endpoints {
+			u := ep["url"].(string)
+			switch {
+			case svc.Type == "identity":
+				if strings.Contains(u, ":"+unreachablePort+"/") {
+					t.Errorf("identity: expected a reachable endpoint, got %s", u)
+				}
+			case ep["region"] == "RegionTwo":
+				if !hasBase(u, "https://rt.example:1/base") {
+					t.Errorf("%s: expected the unreachable port in %s", svc.Type, u)
+				}
+			case !hasBase(u, "http://127.0.0.1:1"):
+				t.Errorf("%s: expected the unreachable port in %s", svc.Type, u)
+			}
+		}
+	}
+}
+
+func TestCatalogInterfaceHint(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/v3/auth/tokens?interface=internal", "application/json", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	var doc tokenDocument
+	err = json.NewDecoder(resp.Body).Decode(&doc)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatalf("decoding token failed: %v", err)
+	}
+	if len(doc.Token.Catalog) == 0 {
+		t.Fatalf("expected a catalog")
+	}
+	for _, svc := range doc.Token.Catalog {
+		if len(svc.Endpoints) != 1 || svc.Endpoints[0]["interface"] != "internal" {
+			t.Errorf("%s: expected a single internal endpoint, got %v", svc.Type, svc.Endpoints)
+		}
+	}
+
+	for _, v := range []string{"private", "internal,admin"} {
+		if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/v3/auth/tokens?interface="+v, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", v, resp.StatusCode)
+		}
+	}
+}
+
+func TestTokenFieldStyle(t *testing.T) {
+	for style, want := range map[FieldStyle][]string{
+		FieldSnake:  {"expires_at", "audit_ids", "region_id"},
+		FieldCamel:  {"expiresAt", "auditIds", "regionId"},
+		FieldPascal: {"ExpiresAt", "AuditIds", "RegionId"},
+	} {
+		t.Run(string(style), func(t *testing.T) {
+			ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.TokenFieldStyle = style }))
+			defer ts.Close()
+
+			_, body := doRequest(t, http.MethodPost, ts.URL+"/v3/auth/tokens", nil)
+			for _, name := range want {
+				if !strings.Contains(body, `"`+name+`"`) {
+					t.Errorf("expected field %s in %s", name, body)
+				}
+			}
+			if style != FieldSnake && (strings.Contains(body, `"expires_at"`) || strings.Contains(body, `"region_id"`)) {
+				t.Errorf("expected no snake_case fields, got %s", body)
+			}
+
+			_, body = doRequest(t, http.MethodPost, ts.URL+V2TokensPath, nil)
+			if !strings.Contains(body, `"publicURL"`) || !strings.Contains(body, `"`+fieldName("issued_at", style)+`"`) {
+				t.Errorf("expected v2.0 fields in style %s, got %s", style, body)
+			}
+		})
+	}
+
+	var s FieldStyle
+	if err := s.Set("kebab"); err == nil {
+		t.Errorf("expected an error for an unknown style")
+	}
+}
+
+func TestTokenInBody(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.TokenInBody = enabled }))
+		resp, body := doRequest(t, http.MethodPost, ts.URL+"/v3/auth/tokens", nil)
+		ts.Close()
+
+		var doc struct {
+			Token struct {
+				ID *string `json:"id"`
+			} `json:"token"`
+		}
+		if err := json.Unmarshal([]byte(body), &doc); err != nil {
+			t.Fatalf("decoding token failed: %v", err)
+		}
+		switch tok := resp.Header.Get("X-Subject-Token"); {
+		case tok == "":
+			t.Errorf("expected the token header")
+		case enabled && (doc.Token.ID == nil || *doc.Token.ID != tok):
+			t.Errorf("expected token.id %q in the body, got %v", tok, doc.Token.ID)
+		case !enabled && doc.Token.ID != nil:
+			t.Errorf("expected no token.id by default, got %q", *doc.Token.ID)
+		}
+	}
+}
+
+func TestInterfaceURLs(t *testing.T) {
+	opt := func(c *Config) {
+		_ = c.CatalogInterfaces.Set("public,internal,admin")
+		_ = c.InterfaceURLs.Set("internal=http://10.0.0.1:19090/,compute/internal=https://nova.internal,compute/admin=https://nova-admin.example")
+	}
+	for _, svc := range issueToken(t, opt).Token.Catalog {
+		urls := map[string]string{}
+		for _, ep := range svc.Endpoints {
+			urls[ep["interface"].(string)] = ep["url"].(string)
+		}
+		wantInternal, wantAdmin := "http://10.0.0.1:19090", "http://127.0.0.1:"
+		if svc.Type == "compute" {
+			wantInternal, wantAdmin = "https://nova.internal", "https://nova-admin.example"
+		}
+		if !strings.HasPrefix(urls["public"], "http://127.0.0.1:") || !strings.HasPrefix(urls["internal"], wantInternal) ||
+			!strings.HasPrefix(urls["admin"], wantAdmin) {
+			t.Errorf("%s: unexpected endpoints %v", svc.Type, urls)
+		}
+		if urls["public"] == urls["internal"] {
+			t.Errorf("%s: expected distinct public and internal URLs, got %v", svc.Type, urls)
+		}
+	}
+
+	var l interfaceURLs
+	for _, v := range []string{"internal", "private=http://a", "/internal=http://a", "internal=ftp://a"} {
+		if err := l.Set(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
+
+func TestSystemScope(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.EnforceProjectScope = true }))
+	defer ts.Close()
+
+	body := `{"auth": {"identity": {"methods": ["password"]}, "scope": {"system": {"all": true}}}}`
+	resp, err := http.Post(ts.URL+"/v3/auth/tokens", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 Created, got %d", resp.StatusCode)
+	}
+	var doc struct {
+		Token map[string]json.RawMessage `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("decoding token failed: %v", err)
+	}
+	if got := string(doc.Token["system"]); got != `{"all":true}` {
+		t.Errorf("expected system {\"all\":true}, got %s", got)
+	}
+	if _, ok := doc.Token["project"]; ok {
+		t.Errorf("expected no project in a system-scoped token")
+	}
+	var catalog []interface{}
+	if err := json.Unmarshal(doc.Token["catalog"], &catalog); err != nil || len(catalog) != len(issueToken(t).Token.Catalog) {
+		t.Errorf("expected the full catalog, got %s", doc.Token["catalog"])
+	}
+
+	tok := resp.Header.Get("X-Subject-Token")
+	if status := getWithHeaders(t, ts.URL+"/volumes", map[string]string{"X-Auth-Token": tok, "X-Project-Id": "other"}); status != http.StatusOK {
+		t.Errorf("expected a system-scoped token to address any project, got %d", status)
+	}
+
+	// Project scope stays the default.
+	if doc := issueToken(t); doc.Token.Project.ID == "" {
+		t.Errorf("expected a project-scoped token without scope in the body")
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	ts := httptest.NewServer(buildDispatcherForTest(t, func(c *Config) { c.EnableAdmin = true }))
+	defer ts.Close()
+
+	issue := func() (string, string) {
+		resp, body := doRequest(t, http.MethodPost, ts.URL+"/v3/auth/tokens", nil)
+		return resp.Header.Get("X-Subject-Token"), body
+	}
+	validate := func(method, auth, subject string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ts.URL+"/v3/auth/tokens", nil)
+		req.Header.Set("X-Auth-Token", auth)
+		req.Header.Set("X-Subject-Token", subject)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	auth, _ := issue()
+	subject, doc := issue()
+	resp, body := validate(http.MethodGet, auth, subject)
+	if resp.StatusCode != http.StatusOK || body != doc || resp.Header.Get("X-Subject-Token") != subject {
+		t.Errorf("expected 200 with the issued document, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := validate(http.MethodHead, auth, subject); resp.StatusCode != http.StatusOK || body != "" {
+		t.Errorf("expected 200 without body for HEAD, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := validate(http.MethodGet, auth, "unknown"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown token, got %d", resp.StatusCode)
+	}
+	if resp, _ := validate(http.MethodGet, "unknown", subject); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an invalid auth token, got %d", resp.StatusCode)
+	}
+
+	// Once the subject token expired, it is not found; the auth token is
+	// issued after advancing the clock, so that it stays valid.
+	doRequest(t, http.MethodPost, ts.URL+"/mock/clock", strings.NewReader(`{"offset": "2h"}`))
+	auth, _ = issue()
+	if resp, _ := validate(http.MethodGet, auth, subject); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an expired token, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/go-http-utils/headers"
+)
+
+// WebUIPath is the page served with Config.WebUI. It is served regardless of
+// Config.EnableAdmin; the admin controls are only shown with it.
+const WebUIPath = AdminPathPrefix + "ui"
+
+// webUITemplate is the web UI page. Its script only calls the admin JSON
+// endpoints.
+var webUITemplate = template.Must(template.New("ui").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>openstack-mock</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; }
+pre { background: #f4f4f4; padding: 1em; }
+</style>
+</head>
+<body>
+<h1>openstack-mock</h1>
+<p>Auth URL: <code>{{.AuthURL}}</code></p>
+<h2>Endpoints</h2>
+<table>
+<tr><th>Type</th><th>Name</th><th>URL</th><th>Backend</th></tr>
+{{- range .Services}}
+<tr><td>{{.Type}}</td><td>{{.Name}}</td><td><code>{{.URL}}</code></td><td><code>{{.Backend}}</code></td></tr>
+{{- end}}
+</table>
+<h2>State</h2>
+<p>
+{{- if .Admin}}
+<button id="reset">Reset</button>
+{{- end}}
+<button id="stats">Stats</button>
+</p>
+{{- if .Admin}}
+<h2>Faults</h2>
+<p>
+{{- range .Faults}}
+<button class="fault" data-fault="{{.}}">Toggle {{.}}</button>
+{{- end}}
+<button id="faults">Show faults</button>
+</p>
+{{- end}}
+<pre id="output"></pre>
+<script>
+const output = document.getElementById("output");
+async function call(method, path, body) {
+  const resp = await fetch(path, {method: method, headers: {"Content-Type": "application/json"}, body: body && JSON.stringify(body)});
+  const text = await resp.text();
+  output.textContent = resp.status + " " + resp.statusText + (text ? "\n" + text : "");
+  return text ? JSON.parse(text) : null;
+}
+document.getElementById("stats").onclick = () => call("GET", "{{.StatusPath}}");
+{{- if .Admin}}
+document.getElementById("reset").onclick = () => call("POST", "{{.ResetPath}}");
+document.getElementById("faults").onclick = () => call("GET", "{{.FaultsPath}}");
+for (const button of document.querySelectorAll("button.fault")) {
+  button.onclick = async () => {
+    const faults = await call("GET", "{{.FaultsPath}}");
+    call("POST", "{{.FaultsPath}}", {[button.dataset.fault]: !faults[button.dataset.fault]});
+  };
+}
+{{- end}}
+</script>
+</body>
+</html>
+`))
+
+// webUIService is a row of the endpoint table of the web UI.
+type webUIService struct {
+	Type, Name, URL, Backend string
+}
+
+// newWebUIHandler returns the handler of WebUIPath, listing the endpoints of
+// services as the token catalog does and, with the admin endpoints' faults,
+// buttons to reset the mock state and to toggle the faults.
+func newWebUIHandler(e Endpoints, services []catalogService, faults *faultSwitches) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		base := requestBase(r)
+		rows := make([]webUIService, 0, len(services))
+		for _, svc := range services {
+			row := webUIService{Type: svc.Type, Name: svc.Name, URL: base + svc.Path}
+			if svc.Backend != nil {
+				row.Backend = svc.Backend(e)
+			}
+			rows = append(rows, row)
+		}
+		var faultNames []string
+		if faults != nil {
+			faultNames = faults.names()
+		}
+		w.Header().Set(headers.ContentType, "text/html; charset=utf-8")
+		_ = webUITemplate.Execute(w, map[string]interface{}{
+			"AuthURL":    base + IdentityVersionPath,
+			"Services":   rows,
+			"Admin":      faults != nil,
+			"Faults":     faultNames,
+			"StatusPath": StatusPath,
+			"ResetPath":  AdminPathPrefix + "reset",
+			"FaultsPath": AdminPathPrefix + "faults",
+		})
+	})
+}
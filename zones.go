@@ -0,0 +1,109 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// zoneStatusTracker simulates asynchronous Designate zone creation: zones
+// created via POST /zones are reported as PENDING until delay has passed since
+// their creation, regardless of the status returned by the backend.
+type zoneStatusTracker struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	created map[string]time.Time
+}
+
+func newZoneStatusTracker(delay time.Duration) *zoneStatusTracker {
+	return &zoneStatusTracker{delay: delay, created: map[string]time.Time{}}
+}
+
+// modifyResponse is a httputil.ReverseProxy ModifyResponse hook rewriting the
+// status of pending zones in zone responses.
+func (z *zoneStatusTracker) modifyResponse(resp *http.Response) error {
+	req := resp.Request
+	if !strings.HasPrefix(req.URL.Path, "/zones") || resp.StatusCode >= http.StatusMultipleChoices {
+		return nil
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		return nil
+	}
+	return rewriteJSONBody(resp, func(doc map[string]interface{}) {
+		for _, zone := range zonesOf(doc) {
+			id, _ := zone["id"].(string)
+			if id == "" {
+				continue
+			}
+			if z.pending(id, req.Method == http.MethodPost && req.URL.Path == "/zones") {
+				zone["status"] = "PENDING"
+				zone["action"] = "CREATE"
+			}
+		}
+	})
+}
+
+// pending reports whether the zone with the given id is still being created,
+// registering it as created now if create is set.
+func (z *zoneStatusTracker) pending(id string, create bool) bool {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	now := time.Now()
+	if create {
+		z.created[id] = now
+	}
+	createdAt, ok := z.created[id]
+	if !ok {
+		return false
+	}
+	if now.Sub(createdAt) >= z.delay {
+		delete(z.created, id)
+		return false
+	}
+	return true
+}
+
+// zonesOf returns the zone objects of a Designate response, which is either a
+// zone list, a single wrapped zone or a flat zone document.
+func zonesOf(doc map[string]interface{}) []map[string]interface{} {
+	if list, ok := doc["zones"].([]interface{}); ok {
+		var zones []map[string]interface{}
+		for _, item := range list {
+			if zone, ok := item.(map[string]interface{}); ok {
+				zones = append(zones, zone)
+			}
+		}
+		return zones
+	}
+	if zone, ok := doc["zone"].(map[string]interface{}); ok {
+		return []map[string]interface{}{zone}
+	}
+	return []map[string]interface{}{doc}
+}
+
+// rewriteJSONBody decodes a JSON object response body, lets rewrite modify it
+// and replaces the body with the re-encoded document. Bodies that are not
+// JSON objects are left untouched.
+func rewriteJSONBody(resp *http.Response, rewrite func(map[string]interface{})) error {
+	b, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if json.Unmarshal(b, &doc) == nil {
+		rewrite(doc)
+		b, _ = json.Marshal(doc)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	return nil
+}
@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestZoneStatusTransition(t *testing.T) {
+	// Like the mock backend, the fake Designate reports zones ACTIVE at once.
+	dns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"zone": {"id": "zone-1", "name": "example.com.", "status": "ACTIVE"}}`))
+		case r.URL.Path == "/zones":
+			_, _ = w.Write([]byte(`{"zones": [{"id": "zone-1", "status": "ACTIVE"}, {"id": "zone-0", "status": "ACTIVE"}]}`))
+		default:
+			_, _ = w.Write([]byte(`{"zone": {"id": "zone-1", "status": "ACTIVE"}}`))
+		}
+	}))
+	defer dns.Close()
+
+	const delay = 300 * time.Millisecond
+	ts := httptest.NewServer(NewDispatcher(Endpoints{DNS: dns.URL}, func(c *Config) {
+		c.DNSAsync = true
+		c.DNSAsyncDelay = delay
+	}))
+	defer ts.Close()
+
+	status := func(method, path string) string {
+		var body string
+		if method == http.MethodPost {
+			_, body = doRequest(t, method, ts.URL+path, strings.NewReader(`{"name": "example.com."}`))
+		} else {
+			_, body = doRequest(t, method, ts.URL+path, nil)
+		}
+		return body
+	}
+
+	if body := status(http.MethodPost, "/zones"); !strings.Contains(body, `"status":"PENDING"`) {
+		t.Errorf("expected created zone to be PENDING, got %s", body)
+	}
+	if body := status(http.MethodGet, "/zones/zone-1"); !strings.Contains(body, `"status":"PENDING"`) {
+		t.Errorf("expected zone to stay PENDING within the delay, got %s", body)
+	}
+	if body := status(http.MethodGet, "/zones"); strings.Count(body, `"status":"PENDING"`) != 1 {
+		t.Errorf("expected only the new zone to be PENDING in the list, got %s", body)
+	}
+
+	time.Sleep(delay)
+	if body := status(http.MethodGet, "/zones/zone-1"); !strings.Contains(body, `"status":"ACTIVE"`) {
+		t.Errorf("expected zone to become ACTIVE after the delay, got %s", body)
+	}
+}